@@ -2,29 +2,210 @@ package epos
 
 import (
 	"fmt"
+	"strings"
 )
 
 type StorageType string
 
 const (
-	STORAGE_AUTO      StorageType = "auto"
-	STORAGE_DISKV     StorageType = "diskv"
-	STORAGE_LEVELDB   StorageType = "leveldb"
+	STORAGE_AUTO       StorageType = "auto"
+	STORAGE_DISKV      StorageType = "diskv"
+	STORAGE_LEVELDB    StorageType = "leveldb"
+	STORAGE_GOLEVELDB  StorageType = "goleveldb"
+	STORAGE_MEMORY     StorageType = "memory"
+	STORAGE_SINGLEFILE StorageType = "singlefile"
 )
 
+// StorageBackend stores the objects of a collection under their keys. Read
+// returns ErrNotFound if a key doesn't exist.
+//
+// Keys that start with an underscore are internal, e.g. the ID counter of the
+// collection. Storage backends that wrap other storage backends and transform
+// the values, like ChecksummedStorageBackend, EncryptedStorageBackend and
+// CompressedStorageBackend, store the values of internal keys unchanged.
 type StorageBackend interface {
 	Read(key string) ([]byte, error)
 	Write(key string, value []byte) error
 	Erase(key string) error
 	Keys() <-chan string
+	Close() error
+}
+
+// BatchOp describes a single operation within a batch: either value is
+// written under key, or, if Erase is set, key is erased.
+type BatchOp struct {
+	Key   string
+	Value []byte
+	Erase bool
+}
+
+// BatchStorageBackend is an optional extension of StorageBackend for backends
+// that can apply a whole batch of operations at once. Backends that don't
+// implement it get the operations of a batch applied one by one.
+type BatchStorageBackend interface {
+	StorageBackend
+	WriteBatch(ops []BatchOp) error
+}
+
+func isInternalKey(key string) bool {
+	return strings.HasPrefix(key, "_")
+}
+
+// wrappedStore is embedded by storage backends that wrap another storage
+// backend, and forwards everything that the wrapper doesn't change.
+type wrappedStore struct {
+	store StorageBackend
+}
+
+func (s wrappedStore) Erase(key string) error {
+	return s.store.Erase(key)
+}
+
+func (s wrappedStore) Keys() <-chan string {
+	return s.store.Keys()
 }
 
-var storageBackends map[StorageType]func(string) StorageBackend
+func (s wrappedStore) Close() error {
+	return s.store.Close()
+}
+
+func (s wrappedStore) Sync() error {
+	if syncer, ok := s.store.(Syncer); ok {
+		return syncer.Sync()
+	}
+	return nil
+}
+
+func (s wrappedStore) Compact() error {
+	if compacter, ok := s.store.(Compacter); ok {
+		return compacter.Compact()
+	}
+	return nil
+}
+
+func writeBatch(store StorageBackend, ops []BatchOp) error {
+	if batchStore, ok := store.(BatchStorageBackend); ok {
+		return batchStore.WriteBatch(ops)
+	}
+
+	for _, op := range ops {
+		var err error
+		if op.Erase {
+			err = store.Erase(op.Key)
+		} else {
+			err = store.Write(op.Key, op.Value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Syncer is an optional extension of StorageBackend for backends that can
+// commit written data to stable storage on request. It is used to implement
+// the database's durability.
+type Syncer interface {
+	Sync() error
+}
+
+// Iterator iterates over a range of key/value pairs of a storage backend in
+// ascending order of their keys. Next must be called before the first pair can
+// be accessed. Close releases the iterator and returns the first error that
+// occured while iterating.
+type Iterator interface {
+	Next() bool
+	Key() string
+	Value() []byte
+	Close() error
+}
+
+// OrderedBackend is an optional extension of StorageBackend for backends that
+// can iterate over their keys in order. Range returns an iterator over all
+// keys from start up to, but not including, end. An empty end means that
+// there is no upper limit. Backends that don't implement OrderedBackend get
+// their ranges emulated by sorting all keys.
+type OrderedBackend interface {
+	StorageBackend
+	Range(start, end string) Iterator
+}
+
+// Compacter is an optional extension of StorageBackend for backends that keep
+// previous versions of values around for some time. Compact drops them, e.g.
+// so that no unencrypted or uncompressed copies remain after all values have
+// been rewritten.
+type Compacter interface {
+	Compact() error
+}
+
+// Snapshotter is an optional extension of StorageBackend for backends that
+// can provide a consistent view of their content while it is being modified.
+// Snapshot returns an iterator over all keys and values as they are when
+// Snapshot is called; closing the iterator releases the snapshot.
+type Snapshotter interface {
+	Snapshot() (Iterator, error)
+}
+
+// MultiReader is an optional extension of StorageBackend for backends that
+// can read several keys at once more efficiently than one after another, e.g.
+// in a single pass over their keys. ReadMany returns the values of keys in the
+// same order, and nil for keys that don't exist. All values are read from the
+// same consistent view. Backends that don't implement MultiReader get their
+// keys read one by one.
+type MultiReader interface {
+	ReadMany(keys []string) ([][]byte, error)
+}
+
+func readMany(store StorageBackend, keys []string) ([][]byte, error) {
+	if multi, ok := store.(MultiReader); ok {
+		return multi.ReadMany(keys)
+	}
+
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		value, err := store.Read(key)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		values[i] = value
+	}
+	return values, nil
+}
+
+// decodeMany reads keys from store like readMany, and decodes all values that
+// exist with decode.
+func decodeMany(store StorageBackend, keys []string, decode func(key string, data []byte) ([]byte, error)) ([][]byte, error) {
+	values, err := readMany(store, keys)
+	if err != nil {
+		return nil, err
+	}
+	for i, data := range values {
+		if data == nil {
+			continue
+		}
+		if values[i], err = decode(keys[i], data); err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+// StorageFactory creates or opens a storage backend that writes its data to
+// path. opts are the options the database has been opened with, so that the
+// backend can configure itself accordingly.
+type StorageFactory func(path string, opts *Options) (StorageBackend, error)
+
+var storageBackends map[StorageType]StorageFactory
 
 func init() {
-	storageBackends = make(map[StorageType]func(string) StorageBackend)
-	RegisterStorageBackend(string(STORAGE_LEVELDB), NewLevelDBStorageBackend)
+	storageBackends = make(map[StorageType]StorageFactory)
 	RegisterStorageBackend(string(STORAGE_DISKV), NewDiskvStorageBackend)
+	RegisterStorageBackend(string(STORAGE_GOLEVELDB), NewGoLevelDBStorageBackend)
+	RegisterStorageBackend(string(STORAGE_MEMORY), NewMemoryStorageBackend)
+	RegisterStorageBackend(string(STORAGE_SINGLEFILE), NewSingleFileStorageBackend)
 }
 
 // RegisterStorageBackend registers a new custom storage backend under a new 
@@ -32,9 +213,10 @@ func init() {
 //
 // In order to create a new custom storage backend, the programmer must also 
 // provide a function that takes the path where the storage backend must write 
-// its data (as a single file or within a directory) and that returns an object 
-// that satisfies the interface StorageBackend
-func RegisterStorageBackend(name string, factoryFunc func(path string) StorageBackend) error {
+// its data (as a single file or within a directory) and the database options,
+// and that returns an object that satisfies the interface StorageBackend, or
+// an error if the storage backend couldn't be opened.
+func RegisterStorageBackend(name string, factoryFunc StorageFactory) error {
 	if _, contains := storageBackends[StorageType(name)]; contains {
 		return fmt.Errorf("storage backend %s already registered", name)
 	}
@@ -0,0 +1,406 @@
+package epos
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+)
+
+// A backup starts with backupMagic, followed by records that consist of a
+// kind byte and three length-prefixed strings: the collection, the key and
+// the value. It ends with a backupEnd record, which is followed by the
+// CRC-32C of everything before it instead of the strings.
+const backupMagic = "EPOSBAK1"
+
+const (
+	backupEngine   = 'e' // value is the storage type.
+	backupKeyCheck = 'k' // value is the key check record.
+	backupMeta     = 'm' // value is the metadata of the collection.
+	backupIndex    = 'i' // key is the field of an index of the collection.
+	backupObject   = 'o' // key and value as stored in the collection.
+	backupKey      = 'K' // key is the ID of the next object, value its key (archives only).
+	backupEnd      = 'z'
+)
+
+type backupWriter struct {
+	w   *bufio.Writer
+	crc hash.Hash32
+	err error
+}
+
+func newBackupWriter(w io.Writer, magic string) *backupWriter {
+	bw := &backupWriter{w: bufio.NewWriter(w), crc: crc32.New(castagnoli)}
+	bw.write([]byte(magic))
+	return bw
+}
+
+func (bw *backupWriter) write(data []byte) {
+	if bw.err != nil {
+		return
+	}
+	bw.crc.Write(data)
+	_, bw.err = bw.w.Write(data)
+}
+
+func (bw *backupWriter) record(kind byte, coll, key string, value []byte) {
+	buf := make([]byte, binary.MaxVarintLen64)
+	bw.write([]byte{kind})
+	for _, s := range [][]byte{[]byte(coll), []byte(key), value} {
+		bw.write(buf[:binary.PutUvarint(buf, uint64(len(s)))])
+		bw.write(s)
+	}
+}
+
+func (bw *backupWriter) close() error {
+	bw.write([]byte{backupEnd})
+	if bw.err == nil {
+		bw.err = binary.Write(bw.w, binary.BigEndian, bw.crc.Sum32())
+	}
+	if bw.err == nil {
+		bw.err = bw.w.Flush()
+	}
+	return bw.err
+}
+
+type backupReader struct {
+	r   *bufio.Reader
+	crc hash.Hash32
+}
+
+type backupRecord struct {
+	kind  byte
+	coll  string
+	key   string
+	value []byte
+}
+
+var errInvalidBackup = errors.New("invalid backup")
+
+func newBackupReader(r io.Reader, magic string) (*backupReader, error) {
+	br := &backupReader{r: bufio.NewReader(r), crc: crc32.New(castagnoli)}
+	buf := make([]byte, len(magic))
+	if _, err := io.ReadFull(br, buf); err != nil || string(buf) != magic {
+		return nil, errInvalidBackup
+	}
+	return br, nil
+}
+
+func (br *backupReader) Read(p []byte) (int, error) {
+	n, err := br.r.Read(p)
+	br.crc.Write(p[:n])
+	return n, err
+}
+
+func (br *backupReader) ReadByte() (byte, error) {
+	b, err := br.r.ReadByte()
+	if err == nil {
+		br.crc.Write([]byte{b})
+	}
+	return b, err
+}
+
+// next returns the next record of the backup, or io.EOF after the end record
+// if the backup is complete and intact.
+func (br *backupReader) next() (*backupRecord, error) {
+	kind, err := br.ReadByte()
+	if err != nil {
+		return nil, fmt.Errorf("backup is truncated: %v", err)
+	}
+	if kind == backupEnd {
+		sum := br.crc.Sum32()
+		var stored uint32
+		if err = binary.Read(br.r, binary.BigEndian, &stored); err != nil {
+			return nil, fmt.Errorf("backup is truncated: %v", err)
+		}
+		if stored != sum {
+			return nil, errors.New("backup is corrupt: checksum mismatch")
+		}
+		return nil, io.EOF
+	}
+
+	fields := make([][]byte, 3)
+	for i := range fields {
+		length, err := binary.ReadUvarint(br)
+		if err != nil {
+			return nil, fmt.Errorf("backup is truncated: %v", err)
+		}
+		// the field is copied instead of allocated up front, so that
+		// a damaged length doesn't allocate more memory than the
+		// backup has.
+		buf := bytes.NewBuffer([]byte{})
+		if _, err = io.CopyN(buf, br, int64(length)); err != nil {
+			return nil, fmt.Errorf("backup is truncated: %v", err)
+		}
+		fields[i] = buf.Bytes()
+	}
+	return &backupRecord{kind: kind, coll: string(fields[0]), key: string(fields[1]), value: fields[2]}, nil
+}
+
+// backupSource is a collection that is being backed up, with the iterator
+// over its stored objects.
+type backupSource struct {
+	coll   *Collection
+	meta   []byte
+	fields []string
+	it     Iterator
+}
+
+// Backup writes a consistent backup of the whole database to w, while other
+// goroutines keep inserting, updating and deleting objects. Objects are
+// backed up as they are stored, i.e. compressed and encrypted if the database
+// is. Index files aren't backed up; Restore rebuilds the indexes.
+//
+// With LevelDB, the backup is taken from a snapshot, so changes are only
+// held up while the snapshot is created. With other storage types, changes
+// wait until the backup has been written completely.
+func (db *Database) Backup(w io.Writer) error {
+	colls, err := db.Collections()
+	if err != nil {
+		return err
+	}
+
+	bw := newBackupWriter(w, backupMagic)
+	engine, err := readFile(db.fs, db.path+"/engine")
+	if err != nil {
+		return err
+	}
+	bw.record(backupEngine, "", "", engine)
+	if keycheck, err := readFile(db.fs, db.path+"/keycheck"); err == nil {
+		bw.record(backupKeyCheck, "", "", keycheck)
+	}
+
+	db.mu.Lock()
+	locked := true
+	defer func() {
+		if locked {
+			db.mu.Unlock()
+		}
+	}()
+
+	sources := []*backupSource{}
+	defer func() {
+		for _, src := range sources {
+			if src.it != nil {
+				src.it.Close()
+			}
+		}
+	}()
+
+	snapshots := true
+	for _, name := range colls {
+		coll, err := db.CollE(name)
+		if err != nil {
+			return err
+		}
+		src := &backupSource{coll: coll}
+		if src.meta, err = json.Marshal(coll.meta); err != nil {
+			return err
+		}
+		for field := range coll.indexes {
+			src.fields = append(src.fields, field)
+		}
+		sort.Strings(src.fields)
+		if snapshotter, ok := coll.raw.(Snapshotter); ok {
+			if src.it, err = snapshotter.Snapshot(); err != nil {
+				return err
+			}
+		} else {
+			snapshots = false
+		}
+		sources = append(sources, src)
+	}
+
+	// once all collections have their snapshots, changes can continue.
+	if snapshots {
+		db.mu.Unlock()
+		locked = false
+	}
+
+	for _, src := range sources {
+		name := src.coll.name
+		bw.record(backupMeta, name, "", src.meta)
+		for _, field := range src.fields {
+			bw.record(backupIndex, name, field, nil)
+		}
+
+		if src.it == nil {
+			src.it = storeRange(src.coll.raw, "", "")
+		}
+		for src.it.Next() {
+			bw.record(backupObject, name, src.it.Key(), src.it.Value())
+		}
+		err := src.it.Close()
+		src.it = nil
+		if err != nil {
+			return err
+		}
+		if bw.err != nil {
+			return bw.err
+		}
+	}
+
+	return bw.close()
+}
+
+// BackupTo writes a consistent backup of the whole database to a new
+// database at path, which can be opened right away. See Backup.
+func (db *Database) BackupTo(path string) error {
+	return db.backupTo(path, STORAGE_AUTO)
+}
+
+// backupTo writes a backup of the database to a new database of storage type
+// typ at path.
+func (db *Database) backupTo(path string, typ StorageType) error {
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(db.Backup(w))
+	}()
+
+	err := Restore(r, path, db.copyOptions(typ))
+	// stop the backup if Restore failed.
+	r.CloseWithError(err)
+	return err
+}
+
+// copyOptions returns the options for creating and opening a copy of the
+// database of storage type typ, e.g. a backup or a migrated database. The
+// copy can be decrypted with the same keys as the database.
+func (db *Database) copyOptions(typ StorageType) *Options {
+	return &Options{
+		Type:              typ,
+		EncryptionKey:     db.opts.EncryptionKey,
+		OldEncryptionKeys: db.opts.OldEncryptionKeys,
+		FileMode:          db.opts.FileMode,
+		DirMode:           db.opts.DirMode,
+		Logger:            db.opts.Logger,
+		LevelDBCacheSize:  db.opts.LevelDBCacheSize,
+		DiskvCacheSize:    db.opts.DiskvCacheSize,
+		NodeId:            db.opts.NodeId,
+	}
+}
+
+// Restore creates a new database at path from a backup that has been written
+// by Backup. The database is created with the storage type of the backed up
+// database, unless opts specifies a different one, and it must be opened
+// with the same encryption key as the backed up database. Restore fails if
+// there is already something at path, and it removes the new database again
+// if the backup is incomplete or corrupt.
+func Restore(r io.Reader, path string, opts *Options) error {
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("%s already exists", path)
+	}
+	opts = opts.withDefaults()
+
+	br, err := newBackupReader(r, backupMagic)
+	if err != nil {
+		return err
+	}
+	rec, err := br.next()
+	if err != nil {
+		return err
+	}
+	if rec.kind != backupEngine {
+		return errInvalidBackup
+	}
+	if opts.Type == STORAGE_AUTO && StorageType(rec.value) != STORAGE_MEMORY {
+		opts.Type = StorageType(rec.value)
+	}
+
+	db, err := OpenDatabaseWithOptions(path, opts)
+	if err != nil {
+		return err
+	}
+	if err = db.restore(br); err != nil {
+		db.Close()
+		db.Remove()
+		return err
+	}
+	return db.Close()
+}
+
+func (db *Database) restore(br *backupReader) error {
+	var coll *Collection
+	ops := []BatchOp{}
+	indexes := make(map[*Collection][]string)
+
+	flush := func() error {
+		if len(ops) == 0 {
+			return nil
+		}
+		err := writeBatch(coll.raw, ops)
+		ops = ops[:0]
+		coll.dirty = true
+		return err
+	}
+
+	for {
+		rec, err := br.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		switch rec.kind {
+		case backupKeyCheck:
+			if err = writeFile(db.fs, db.path+"/keycheck", rec.value, db.opts.FileMode); err != nil {
+				return err
+			}
+			if err = db.checkKey(); err != nil {
+				return err
+			}
+		case backupMeta:
+			if err = flush(); err != nil {
+				return err
+			}
+			meta := &collMeta{}
+			if err = json.Unmarshal(rec.value, meta); err != nil {
+				return err
+			}
+			if err = db.writeCollMeta(rec.coll, meta); err != nil {
+				return err
+			}
+			if coll, err = db.CollE(rec.coll); err != nil {
+				return err
+			}
+		case backupIndex, backupObject:
+			if coll == nil || coll.name != rec.coll {
+				return errInvalidBackup
+			}
+			if rec.kind == backupIndex {
+				indexes[coll] = append(indexes[coll], rec.key)
+				continue
+			}
+			ops = append(ops, BatchOp{Key: rec.key, Value: rec.value})
+			if len(ops) >= rewriteBatchSize {
+				if err = flush(); err != nil {
+					return err
+				}
+			}
+		default:
+			return errInvalidBackup
+		}
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+
+	// the indexes are only built once the backup is known to be intact.
+	for coll, fields := range indexes {
+		for _, field := range fields {
+			if err := coll.AddIndex(field); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package epos
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestBackupRestore(t *testing.T) {
+	for _, typ := range []StorageType{STORAGE_GOLEVELDB, STORAGE_DISKV} {
+		db, err := OpenDatabase("testdb_backup", typ)
+		if err != nil {
+			t.Fatalf("%s: couldn't open testdb_backup: %v", typ, err)
+		}
+		books := db.Coll("books")
+		books.AddIndex("Author")
+		for _, book := range queryData {
+			books.Insert(book)
+		}
+
+		// objects keep being inserted while the backup is taken.
+		done := make(chan bool)
+		go func() {
+			for i := 0; i < 200; i++ {
+				books.Insert(&book{Title: "Concurrent", Author: "Writer"})
+			}
+			done <- true
+		}()
+		buf := bytes.NewBuffer([]byte{})
+		err = db.Backup(buf)
+		<-done
+		if err != nil {
+			t.Fatalf("%s: Backup failed: %v", typ, err)
+		}
+		db.Close()
+		db.Remove()
+
+		if err = Restore(bytes.NewReader(buf.Bytes()), "testdb_restore", nil); err != nil {
+			t.Fatalf("%s: Restore failed: %v", typ, err)
+		}
+		restored, err := OpenDatabase("testdb_restore", STORAGE_AUTO)
+		if err != nil {
+			t.Fatalf("%s: couldn't open restored database: %v", typ, err)
+		}
+		if engine, _ := readFile(restored.fs, "testdb_restore/engine"); string(engine) != string(typ) {
+			t.Errorf("%s: restored database has storage type %s", typ, engine)
+		}
+
+		// the backup is consistent if it contains exactly the objects
+		// that have been inserted before the ID counter's value.
+		books = restored.Coll("books")
+		next_id := books.getNextId()
+		result, _ := books.QueryAll()
+		if Id(result.Count()) != next_id-1 {
+			t.Errorf("%s: restored collection has %d objects, but next ID %d", typ, result.Count(), next_id)
+		}
+		result, err = books.Query(&Equals{Field: "Author", Value: "Aesop"})
+		if err != nil || result.Count() != 1 {
+			t.Errorf("%s: query on restored index failed (error: %v)", typ, err)
+		}
+		restored.Close()
+		restored.Remove()
+	}
+}
+
+func TestBackupTo(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	db, err := OpenDatabaseWithOptions("testdb_backup", &Options{Type: STORAGE_DISKV, EncryptionKey: key})
+	if err != nil {
+		t.Fatalf("couldn't open testdb_backup: %v", err)
+	}
+	defer db.Remove()
+	defer db.Close()
+	for _, book := range queryData {
+		db.Coll("books").Insert(book)
+	}
+
+	if err = db.BackupTo("testdb_backup_copy"); err != nil {
+		t.Fatalf("BackupTo failed: %v", err)
+	}
+	if err = db.BackupTo("testdb_backup_copy"); err == nil {
+		t.Errorf("BackupTo overwrote an existing database")
+	}
+
+	if _, err = OpenDatabase("testdb_backup_copy", STORAGE_AUTO); err != ErrWrongKey {
+		t.Errorf("opening encrypted backup without key returned %v", err)
+	}
+	backup, err := OpenDatabaseWithOptions("testdb_backup_copy", &Options{EncryptionKey: key})
+	if err != nil {
+		t.Fatalf("couldn't open backup: %v", err)
+	}
+	defer backup.Remove()
+	defer backup.Close()
+	result, _ := backup.Coll("books").QueryAll()
+	if result.Count() != len(queryData) {
+		t.Errorf("backup contains %d objects, expected %d", result.Count(), len(queryData))
+	}
+
+	// a damaged backup is rejected, and nothing is left behind.
+	buf := bytes.NewBuffer([]byte{})
+	if err = db.Backup(buf); err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+	data := buf.Bytes()
+	data[len(data)/2] ^= 0xff
+	if err = Restore(bytes.NewReader(data), "testdb_restore", &Options{EncryptionKey: key}); err == nil {
+		t.Errorf("restoring damaged backup succeeded")
+	}
+	if _, err = os.Stat("testdb_restore"); err == nil {
+		t.Errorf("damaged backup has been partially restored")
+		os.RemoveAll("testdb_restore")
+	}
+	if err = Restore(bytes.NewReader(data[:len(data)-10]), "testdb_restore", &Options{EncryptionKey: key}); err == nil {
+		t.Errorf("restoring truncated backup succeeded")
+		os.RemoveAll("testdb_restore")
+	}
+}
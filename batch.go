@@ -0,0 +1,197 @@
+package epos
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+)
+
+// InsertMany inserts a number of objects into the collection in a single
+// batch. It returns the IDs of the inserted objects in the same order as
+// the objects were provided. Either all or none of the objects are inserted.
+func (c *Collection) InsertMany(values []interface{}) ([]Id, error) {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	return c.insertMany(values)
+}
+
+func (c *Collection) insertMany(values []interface{}) ([]Id, error) {
+	if err := c.db.checkWritable(); err != nil {
+		return nil, err
+	}
+	if c.meta.IdStrategy == ID_KEY {
+		return nil, fmt.Errorf("objects of collection %s need a key; use InsertWithKey", c.name)
+	}
+	data, _ := c.store.Read("_next_id")
+	next, _ := binary.Varint(data)
+	next_id := Id(next)
+
+	ids := make([]Id, len(values))
+	ops := make([]walOp, 0, len(values)+1)
+	for i, value := range values {
+		encoded, err := c.codec.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		ids[i] = c.allocId(next_id)
+		next_id = ids[i] + 1
+		id_str := fmt.Sprintf("%d", ids[i])
+		ops = append(ops, walOp{typ: walInsert, coll: c.name, key: id_str, data: encoded})
+		if key := c.newKey(); key != "" {
+			ops = append(ops, c.keyOps(key, id_str)...)
+		}
+	}
+
+	if err := c.commitBatch(append(ops, c.nextIdOp(next_id))); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// UpdateMany replaces the objects identified by ids with the objects in
+// values, in a single batch. Either all or none of the objects are updated.
+// If any of the objects doesn't exist, UpdateMany returns an error that wraps
+// ErrNotFound.
+func (c *Collection) UpdateMany(ids []Id, values []interface{}) error {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	return c.updateMany(ids, values)
+}
+
+func (c *Collection) updateMany(ids []Id, values []interface{}) error {
+	if err := c.db.checkWritable(); err != nil {
+		return err
+	}
+	if len(ids) != len(values) {
+		return fmt.Errorf("got %d IDs but %d objects", len(ids), len(values))
+	}
+
+	ops := make([]walOp, len(values))
+	for i, value := range values {
+		if !c.Exists(ids[i]) {
+			return fmt.Errorf("object %d: %w", ids[i], ErrNotFound)
+		}
+		encoded, err := c.codec.Marshal(value)
+		if err != nil {
+			return err
+		}
+		ops[i] = walOp{typ: walUpdate, coll: c.name, key: fmt.Sprintf("%d", ids[i]), data: encoded}
+	}
+
+	return c.commitBatch(ops)
+}
+
+// DeleteMany deletes the objects identified by ids from the collection in a
+// single batch. Either all or none of the objects are deleted.
+func (c *Collection) DeleteMany(ids []Id) error {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	return c.deleteMany(ids)
+}
+
+func (c *Collection) deleteMany(ids []Id) error {
+	if err := c.db.checkWritable(); err != nil {
+		return err
+	}
+	ops := make([]walOp, len(ids))
+	for i, id := range ids {
+		ops[i] = walOp{typ: walDelete, coll: c.name, key: fmt.Sprintf("%d", id)}
+	}
+
+	return c.commitBatch(ops)
+}
+
+// nextIdOp returns the operation that sets the ID counter of the collection,
+// so that it is logged and replayed together with the objects of a batch.
+func (c *Collection) nextIdOp(next_id Id) walOp {
+	return walOp{typ: walUpdate, coll: c.name, key: "_next_id", data: encodeNextId(next_id)}
+}
+
+// commitBatch logs ops to the write-ahead log, together with the revisions of
+// the objects they write, and then applies them with a single write to the
+// storage backend and a single commit of the storage backend and the index
+// files.
+func (c *Collection) commitBatch(ops []walOp) error {
+	if err := c.checkUnique(ops); err != nil {
+		return err
+	}
+
+	revs := make(map[string]Rev)
+	logged := make([]walOp, 0, 2*len(ops))
+	for _, op := range ops {
+		if !isInternalKey(op.key) {
+			rev, ok := revs[op.key]
+			if !ok {
+				rev = readRev(c.raw, op.key)
+			}
+			if op.typ == walDelete {
+				revs[op.key] = 0
+			} else {
+				revs[op.key] = rev + 1
+				logged = append(logged, c.revisionOp(op.key, rev+1))
+			}
+		}
+		logged = append(logged, op)
+	}
+	ops = logged
+
+	if err := c.db.wal.Log(ops); err != nil {
+		return err
+	}
+
+	batch := make([]BatchOp, 0, len(ops))
+	revised := make(map[string]bool)
+	for _, op := range ops {
+		if op.typ == walDelete && !isInternalKey(op.key) {
+			if revised[revKey(op.key)] {
+				batch = append(batch, BatchOp{Key: revKey(op.key), Erase: true})
+			} else {
+				batch = append(batch, c.unrevisionOps(op.key)...)
+			}
+		}
+		revised[op.key] = op.typ != walDelete
+		if op.typ == walDelete {
+			batch = append(batch, c.unkeyOps(op.key)...)
+		}
+		batch = append(batch, BatchOp{Key: op.key, Value: op.data, Erase: op.typ == walDelete})
+	}
+	if err := writeBatch(c.store, batch); err != nil {
+		return c.completeBatch(ops, err)
+	}
+
+	for i, op := range ops {
+		if err := c.updateIndexes(op); err != nil {
+			// the indexes of the preceding ops are complete.
+			return c.completeBatch(ops[i:], err)
+		}
+	}
+
+	return c.db.commit(c)
+}
+
+// completeBatch is called if applying ops has failed with err. The batch is
+// logged, so the only way to keep it atomic is to complete it by redoing ops.
+func (c *Collection) completeBatch(ops []walOp, err error) error {
+	for _, op := range ops {
+		if redo_err := c.redo(op); redo_err != nil {
+			c.db.wal.err = fmt.Errorf("incomplete batch needs recovery, reopen database: %v", err)
+			return c.db.wal.err
+		}
+	}
+	return c.db.commit(c)
+}
+
+// updateIndexes updates the index entries of the object changed by op.
+func (c *Collection) updateIndexes(op walOp) error {
+	if isInternalKey(op.key) {
+		return nil
+	}
+	id, _ := strconv.ParseInt(op.key, 10, 64)
+	if op.typ != walInsert {
+		c.removeFromIndexes(Id(id))
+	}
+	if op.typ != walDelete {
+		return c.addToIndexes(Id(id), op.data)
+	}
+	return nil
+}
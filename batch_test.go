@@ -0,0 +1,123 @@
+package epos
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestBatch(t *testing.T) {
+	db, err := OpenDatabase("testdb_batch", STORAGE_AUTO)
+	if err != nil {
+		t.Fatalf("couldn't open testdb_batch: %v", err)
+	}
+	defer db.Close()
+
+	books := db.Coll("books")
+	books.AddIndex("Author")
+
+	values := []interface{}{}
+	for _, b := range queryData {
+		values = append(values, b)
+	}
+
+	ids, err := books.InsertMany(values)
+	if err != nil {
+		t.Fatalf("InsertMany failed: %v", err)
+	}
+	for i, id := range ids {
+		if id != Id(i+1) {
+			t.Errorf("%d. got ID %d, expected %d", i, id, i+1)
+		}
+	}
+
+	result, _ := books.Query(&Equals{Field: "Author", Value: "Mark Twain"})
+	if result.Count() != 2 {
+		t.Errorf("expected 2 Mark Twain books, got %d instead.", result.Count())
+	}
+
+	if id, _ := books.Insert(book{Title: "Emma", Author: "Jane Austen"}); id != Id(len(queryData)+1) {
+		t.Errorf("Insert after InsertMany returned ID %d, expected %d", id, len(queryData)+1)
+	}
+
+	if err = books.UpdateMany(ids[:2], []interface{}{book{Title: "Persuasion", Author: "Jane Austen"}}); err == nil {
+		t.Errorf("UpdateMany with mismatching number of IDs and objects didn't fail")
+	}
+
+	if err = books.UpdateMany(ids[:2], []interface{}{book{Title: "Persuasion", Author: "Jane Austen"}, book{Title: "Sanditon", Author: "Jane Austen"}}); err != nil {
+		t.Errorf("UpdateMany failed: %v", err)
+	}
+
+	result, _ = books.Query(&Equals{Field: "Author", Value: "Jane Austen"})
+	if result.Count() != 3 {
+		t.Errorf("expected 3 Jane Austen books, got %d instead.", result.Count())
+	}
+	result, _ = books.Query(&Equals{Field: "Author", Value: "Mark Twain"})
+	if result.Count() != 1 {
+		t.Errorf("expected 1 Mark Twain book, got %d instead.", result.Count())
+	}
+
+	if err = books.DeleteMany(ids); err != nil {
+		t.Errorf("DeleteMany failed: %v", err)
+	}
+
+	result, _ = books.QueryAll()
+	if result.Count() != 1 {
+		t.Errorf("expected 1 book to be left, got %d instead.", result.Count())
+	}
+
+	db.Remove()
+}
+
+type batchFailingBackend struct {
+	StorageBackend
+	fail *bool
+}
+
+func (s batchFailingBackend) WriteBatch(ops []BatchOp) error {
+	if *s.fail {
+		*s.fail = false
+		return errors.New("batch failed")
+	}
+	return writeBatch(s.StorageBackend, ops)
+}
+
+func TestBatchCompletion(t *testing.T) {
+	fail := false
+	RegisterStorageBackend("batchfailing", func(path string, opts *Options) (StorageBackend, error) {
+		store, err := NewMemoryStorageBackend(path, opts)
+		return batchFailingBackend{store, &fail}, err
+	})
+	db, err := OpenDatabase("testdb_batch", StorageType("batchfailing"))
+	if err != nil {
+		t.Fatalf("couldn't open testdb_batch: %v", err)
+	}
+	defer db.Remove()
+	defer db.Close()
+	books := db.Coll("books")
+	books.AddIndex("Author")
+
+	// a batch whose write fails is completed from the write-ahead log,
+	// including the ID counter.
+	fail = true
+	ids, err := books.InsertMany([]interface{}{book{Title: "Emma", Author: "Jane Austen"}, book{Title: "Persuasion", Author: "Jane Austen"}})
+	if err != nil {
+		t.Fatalf("InsertMany failed: %v", err)
+	}
+	if id, _ := books.Insert(book{Title: "Sanditon", Author: "Jane Austen"}); id != ids[1]+1 {
+		t.Errorf("Insert after completed batch returned ID %d, expected %d", id, ids[1]+1)
+	}
+	if result, _ := books.Query(&Equals{Field: "Author", Value: "Jane Austen"}); result.Count() != 3 {
+		t.Errorf("expected 3 Jane Austen books, got %d instead.", result.Count())
+	}
+
+	if err = books.UpdateMany([]Id{ids[0], 42}, []interface{}{book{Title: "Lady Susan"}, book{Title: "Unknown"}}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("UpdateMany of missing object returned %v", err)
+	}
+	var b book
+	if books.Get(ids[0], &b); b.Title != "Emma" {
+		t.Errorf("UpdateMany of missing object changed object %d to %#v", ids[0], b)
+	}
+	if books.Exists(42) {
+		t.Errorf("UpdateMany of missing object created it")
+	}
+}
@@ -0,0 +1,197 @@
+package epos
+
+import (
+	"container/list"
+	"sync"
+)
+
+// CacheStats describes how effective the document cache of a collection is.
+type CacheStats struct {
+	Hits    uint64
+	Misses  uint64
+	Entries int
+	Size    int
+}
+
+type cacheEntry struct {
+	key   string
+	value []byte
+}
+
+// CachedStorageBackend wraps another storage backend and keeps the most
+// recently read values in memory, up to a maximum size. Values are removed
+// from the cache when they are written or erased, so the cache never returns
+// stale values as long as the wrapped store is only modified through the
+// CachedStorageBackend.
+type CachedStorageBackend struct {
+	wrappedStore
+	maxSize int
+
+	mu      sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+	size    int
+	hits    uint64
+	misses  uint64
+
+	// generation is incremented whenever values are invalidated, so that a
+	// value that has been read concurrently to a write isn't cached.
+	generation uint64
+}
+
+// NewCachedStorageBackend returns a storage backend that caches up to maxSize
+// bytes of the values it reads from store. The size of a value includes its
+// key. Values that are larger than maxSize are never cached.
+func NewCachedStorageBackend(store StorageBackend, maxSize int) *CachedStorageBackend {
+	return &CachedStorageBackend{wrappedStore: wrappedStore{store}, maxSize: maxSize, lru: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// Read returns the value of key from the cache if it is there, and otherwise
+// reads it from the wrapped store and caches it. The returned value must not
+// be modified.
+func (s *CachedStorageBackend) Read(key string) ([]byte, error) {
+	s.mu.Lock()
+	if elem, ok := s.entries[key]; ok {
+		s.lru.MoveToFront(elem)
+		s.hits++
+		value := elem.Value.(*cacheEntry).value
+		s.mu.Unlock()
+		return value, nil
+	}
+	s.misses++
+	generation := s.generation
+	s.mu.Unlock()
+
+	value, err := s.store.Read(key)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	if generation == s.generation {
+		s.add(key, value)
+	}
+	s.mu.Unlock()
+	return value, nil
+}
+
+// ReadMany returns the values of keys that are cached, and reads all others
+// from the wrapped store at once.
+func (s *CachedStorageBackend) ReadMany(keys []string) ([][]byte, error) {
+	values := make([][]byte, len(keys))
+	var missing []string
+	var missing_idx []int
+	s.mu.Lock()
+	for i, key := range keys {
+		if elem, ok := s.entries[key]; ok {
+			s.lru.MoveToFront(elem)
+			s.hits++
+			values[i] = elem.Value.(*cacheEntry).value
+		} else {
+			s.misses++
+			missing = append(missing, key)
+			missing_idx = append(missing_idx, i)
+		}
+	}
+	generation := s.generation
+	s.mu.Unlock()
+
+	if len(missing) == 0 {
+		return values, nil
+	}
+	read, err := readMany(s.store, missing)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	for j, i := range missing_idx {
+		values[i] = read[j]
+		if read[j] != nil && generation == s.generation {
+			s.add(missing[j], read[j])
+		}
+	}
+	s.mu.Unlock()
+	return values, nil
+}
+
+func (s *CachedStorageBackend) add(key string, value []byte) {
+	size := len(key) + len(value)
+	if size > s.maxSize {
+		return
+	}
+	s.remove(key)
+	s.entries[key] = s.lru.PushFront(&cacheEntry{key: key, value: value})
+	s.size += size
+	for s.size > s.maxSize {
+		s.remove(s.lru.Back().Value.(*cacheEntry).key)
+	}
+}
+
+func (s *CachedStorageBackend) remove(key string) {
+	if elem, ok := s.entries[key]; ok {
+		entry := s.lru.Remove(elem).(*cacheEntry)
+		delete(s.entries, key)
+		s.size -= len(entry.key) + len(entry.value)
+	}
+}
+
+func (s *CachedStorageBackend) invalidate(keys ...string) {
+	s.mu.Lock()
+	s.generation++
+	for _, key := range keys {
+		s.remove(key)
+	}
+	s.mu.Unlock()
+}
+
+func (s *CachedStorageBackend) Write(key string, value []byte) error {
+	defer s.invalidate(key)
+	return s.store.Write(key, value)
+}
+
+func (s *CachedStorageBackend) Erase(key string) error {
+	defer s.invalidate(key)
+	return s.store.Erase(key)
+}
+
+func (s *CachedStorageBackend) WriteBatch(ops []BatchOp) error {
+	keys := make([]string, len(ops))
+	for i, op := range ops {
+		keys[i] = op.Key
+	}
+	defer s.invalidate(keys...)
+	return writeBatch(s.store, ops)
+}
+
+// Stats returns the number of cache hits and misses so far, and the number
+// and total size of the values that are currently cached.
+func (s *CachedStorageBackend) Stats() CacheStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return CacheStats{Hits: s.hits, Misses: s.misses, Entries: len(s.entries), Size: s.size}
+}
+
+func (s *CachedStorageBackend) Close() error {
+	s.mu.Lock()
+	s.lru.Init()
+	s.entries = make(map[string]*list.Element)
+	s.size = 0
+	s.mu.Unlock()
+	return s.store.Close()
+}
+
+// Range iterates over the wrapped store directly; values that are read by
+// iterating are not cached.
+func (s *CachedStorageBackend) Range(start, end string) Iterator {
+	return storeRange(s.store, start, end)
+}
+
+// CacheStats returns the statistics of the collection's document cache. If
+// the database has been opened without a cache, all statistics are 0.
+func (c *Collection) CacheStats() CacheStats {
+	if c.cache == nil {
+		return CacheStats{}
+	}
+	return c.cache.Stats()
+}
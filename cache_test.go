@@ -0,0 +1,56 @@
+package epos
+
+import (
+	"testing"
+)
+
+func TestCache(t *testing.T) {
+	db, err := OpenDatabaseWithOptions("testdb_cache", &Options{Type: STORAGE_DISKV, CacheSize: 100})
+	if err != nil {
+		t.Fatalf("couldn't open testdb_cache: %v", err)
+	}
+	defer db.Remove()
+	defer db.Close()
+
+	coll := db.Coll("cache")
+	id, err := coll.Insert(map[string]string{"foo": "bar"})
+	if err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+
+	query := func(expected string) {
+		result, err := coll.QueryId(id)
+		entry := map[string]string{}
+		if err != nil || !result.Next(nil, &entry) || entry["foo"] != expected {
+			t.Errorf("QueryId returned %v, expected %s (error: %v)", entry, expected, err)
+		}
+	}
+
+	query("bar")
+	query("bar")
+	if stats := coll.CacheStats(); stats.Hits != 1 || stats.Entries == 0 {
+		t.Errorf("unexpected cache statistics after repeated query: %+v", stats)
+	}
+
+	if err = coll.Update(id, map[string]string{"foo": "baz"}); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	query("baz")
+
+	if err = coll.Delete(id); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if result, err := coll.QueryId(id); err != nil || result.Next(nil, &map[string]string{}) {
+		t.Errorf("deleted object has been returned from cache (error: %v)", err)
+	}
+
+	for i := 0; i < 20; i++ {
+		id, _ := coll.Insert(map[string]int{"i": i})
+		if result, err := coll.QueryId(id); err != nil || !result.Next(nil, &map[string]int{}) {
+			t.Errorf("%d. QueryId failed: %v", i, err)
+		}
+	}
+	if stats := coll.CacheStats(); stats.Size > 100 {
+		t.Errorf("cache exceeds its maximum size: %+v", stats)
+	}
+}
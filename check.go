@@ -0,0 +1,315 @@
+package epos
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// CheckReport is the result of Database.Check.
+type CheckReport struct {
+	Collections []*CollectionReport
+}
+
+// OK returns true if no problems have been found.
+func (r *CheckReport) OK() bool {
+	for _, coll := range r.Collections {
+		if !coll.OK() {
+			return false
+		}
+	}
+	return true
+}
+
+// CollectionReport describes the state of a collection.
+type CollectionReport struct {
+	Name    string
+	Objects int
+	// NextId is the ID the next inserted object will get. It must be
+	// greater than MaxId, the greatest ID of all objects.
+	NextId Id
+	MaxId  Id
+	// Corrupt contains the objects that fail their checksum or can't be
+	// decoded.
+	Corrupt []*CorruptError
+	Indexes []*IndexReport
+}
+
+// OK returns true if no problems have been found in the collection.
+func (r *CollectionReport) OK() bool {
+	if len(r.Corrupt) > 0 || r.NextId <= r.MaxId {
+		return false
+	}
+	for _, idx := range r.Indexes {
+		if !idx.OK() {
+			return false
+		}
+	}
+	return true
+}
+
+// IndexReport describes the state of an index file.
+type IndexReport struct {
+	Field   string
+	Entries int
+	// Missing is the number of objects that contain the field, but aren't
+	// in the index. Stale is the number of index entries that refer to
+	// objects that don't exist or contain a different value.
+	Missing int
+	Stale   int
+	// Corrupt contains the entries that fail their checksum or are
+	// incomplete.
+	Corrupt []*CorruptError
+	// Err is set if the index file can't be read at all.
+	Err error
+}
+
+// OK returns true if the index agrees with the objects of the collection.
+func (r *IndexReport) OK() bool {
+	return r.Err == nil && len(r.Corrupt) == 0 && r.Missing == 0 && r.Stale == 0
+}
+
+type indexKey struct {
+	value string
+	id    int64
+}
+
+// Check verifies the integrity of all collections of the database: that all
+// objects can be read, that the index files are intact and agree with the
+// objects, and that the ID counter is greater than all existing IDs. Check
+// doesn't modify the database; Repair fixes the problems it finds. Changes
+// wait until the check is complete.
+func (db *Database) Check() (*CheckReport, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.check()
+}
+
+// check is Check for callers that hold db.mu.
+func (db *Database) check() (*CheckReport, error) {
+	colls, err := db.Collections()
+	if err != nil {
+		return nil, err
+	}
+
+	report := &CheckReport{}
+	for _, name := range colls {
+		coll_report, err := db.checkColl(name)
+		if err != nil {
+			return nil, err
+		}
+		report.Collections = append(report.Collections, coll_report)
+	}
+	return report, nil
+}
+
+func (db *Database) checkColl(name string) (*CollectionReport, error) {
+	// the index files are read by the check itself, so collections that
+	// aren't open yet are opened without loading their indexes, which
+	// would fail if they are broken.
+	db.colls_mu.Lock()
+	coll := db.colls[name]
+	db.colls_mu.Unlock()
+	if coll == nil {
+		var err error
+		if coll, err = db.newColl(name, nil); err != nil {
+			return nil, err
+		}
+		defer coll.close()
+	}
+
+	report := &CollectionReport{Name: name}
+	data, _ := coll.store.Read("_next_id")
+	next_id, _ := binary.Varint(data)
+	report.NextId = Id(next_id)
+
+	objects := make(map[int64]map[string]interface{})
+	for key := range coll.store.Keys() {
+		if isInternalKey(key) {
+			continue
+		}
+		report.Objects++
+		id, err := strconv.ParseInt(key, 10, 64)
+		if err != nil {
+			report.Corrupt = append(report.Corrupt, &CorruptError{Collection: name, Key: key, Reason: "key isn't an ID"})
+			continue
+		}
+		if Id(id) > report.MaxId {
+			report.MaxId = Id(id)
+		}
+
+		data, err := coll.store.Read(key)
+		if err != nil {
+			cerr, ok := err.(*CorruptError)
+			if !ok {
+				cerr = &CorruptError{Collection: name, Key: key, Reason: err.Error()}
+			}
+			report.Corrupt = append(report.Corrupt, cerr)
+			continue
+		}
+		var object map[string]interface{}
+		if err = coll.codec.Unmarshal(data, &object); err != nil {
+			// gob can only decode objects into the type they have
+			// been encoded from.
+			if coll.codec.Name() != CODEC_GOB {
+				report.Corrupt = append(report.Corrupt, &CorruptError{Collection: name, Key: key, Reason: "decoding failed: " + err.Error()})
+			}
+			continue
+		}
+		objects[id] = object
+	}
+
+	fields, err := db.indexFields(name)
+	if err != nil {
+		return nil, err
+	}
+	for _, field := range fields {
+		report.Indexes = append(report.Indexes, db.checkIndex(name, field, objects))
+	}
+	return report, nil
+}
+
+// indexFields returns the fields of all indexes of a collection.
+func (db *Database) indexFields(name string) ([]string, error) {
+	entries, err := db.fs.ReadDir(db.path + "/indexes/" + name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	fields := []string{}
+	for _, info := range entries {
+		if (info.Mode()&os.ModeType) == 0 && !strings.HasPrefix(info.Name(), ".") {
+			fields = append(fields, info.Name())
+		}
+	}
+	return fields, nil
+}
+
+// checkIndex reads an index file and compares its entries with the index
+// entries of objects.
+func (db *Database) checkIndex(name, field string, objects map[int64]map[string]interface{}) *IndexReport {
+	report := &IndexReport{Field: field}
+	file, err := db.fs.OpenFile(db.path+"/indexes/"+name+"/"+field, os.O_RDONLY, 0)
+	if err != nil {
+		report.Err = err
+		return report
+	}
+	defer file.Close()
+
+	idx := newIndex(file, field, nil)
+	if err = idx.readHeader(db.opts.keys); err != nil {
+		report.Err = err
+		return report
+	}
+
+	entries := make(map[indexKey]bool)
+	for {
+		entry, err := idx.readEntry()
+		if err == io.EOF {
+			break
+		}
+		if err == io.ErrUnexpectedEOF {
+			report.Corrupt = append(report.Corrupt, &CorruptError{Collection: name, Index: field, Offset: entry.fpos, Reason: "entry is incomplete"})
+			break
+		}
+		if cerr, ok := err.(*CorruptError); ok {
+			cerr.Collection = name
+			report.Corrupt = append(report.Corrupt, cerr)
+			continue
+		}
+		if err != nil {
+			report.Err = err
+			return report
+		}
+		if !entry.Deleted() {
+			report.Entries++
+			entries[indexKey{value: entry.value, id: entry.id}] = true
+		}
+	}
+
+	for id, object := range objects {
+		if value, exists := object[field]; exists {
+			key := indexKey{value: fmt.Sprintf("%v", value), id: id}
+			if entries[key] {
+				delete(entries, key)
+			} else {
+				report.Missing++
+			}
+		}
+	}
+	report.Stale = len(entries)
+	return report
+}
+
+// Repair checks the database like Check, and fixes the problems it finds:
+// broken indexes are rebuilt, and the ID counter is set past the greatest
+// existing ID. Corrupt objects aren't touched; they are left out of rebuilt
+// indexes. Repair returns the report of the problems it has found.
+//
+// Collections that have broken indexes are closed and opened again, so
+// previously obtained *Collection values of them must not be used anymore.
+func (db *Database) Repair() (*CheckReport, error) {
+	if err := db.checkWritable(); err != nil {
+		return nil, err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	report, err := db.check()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, coll_report := range report.Collections {
+		if coll_report.OK() {
+			continue
+		}
+
+		broken := []string{}
+		for _, idx := range coll_report.Indexes {
+			if !idx.OK() {
+				broken = append(broken, idx.Field)
+			}
+		}
+		if len(broken) > 0 {
+			db.colls_mu.Lock()
+			coll := db.colls[coll_report.Name]
+			db.colls_mu.Unlock()
+			if coll != nil {
+				if err = coll.closeAndForget(); err != nil {
+					return nil, err
+				}
+			}
+			for _, field := range broken {
+				if err = db.fs.Remove(db.path + "/indexes/" + coll_report.Name + "/" + field); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		coll, err := db.CollE(coll_report.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, field := range broken {
+			if err = coll.addIndex(field); err != nil {
+				return nil, err
+			}
+		}
+		if coll_report.NextId <= coll_report.MaxId {
+			coll.setNextId(coll_report.MaxId + 1)
+			coll.dirty = true
+		}
+		if err = coll.sync(); err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
+}
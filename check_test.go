@@ -0,0 +1,120 @@
+package epos
+
+import (
+	"os"
+	"testing"
+)
+
+func TestCheckAndRepair(t *testing.T) {
+	db, err := OpenDatabase("testdb_check", STORAGE_DISKV)
+	if err != nil {
+		t.Fatalf("couldn't open testdb_check: %v", err)
+	}
+	books := db.Coll("books")
+	books.AddIndex("Author")
+	books.AddIndex("Title")
+	for i, book := range queryData {
+		if _, err := books.Insert(book); err != nil {
+			t.Errorf("%d. Insert failed: %v", i, err)
+		}
+	}
+	if report, err := db.Check(); err != nil || !report.OK() {
+		t.Errorf("check of intact database failed: %#v (error: %v)", report, err)
+	}
+	db.Close()
+
+	// reset the ID counter, remove an object behind the index's back, and
+	// cut off the last entry of the other index in the middle.
+	store, _ := NewDiskvStorageBackend("testdb_check/colls/books", (&Options{}).withDefaults())
+	store.Write("_next_id", encodeNextId(Id(2)))
+	store.Erase("1")
+	fi, _ := os.Stat("testdb_check/indexes/books/Title")
+	os.Truncate("testdb_check/indexes/books/Title", fi.Size()-3)
+
+	db, err = OpenDatabase("testdb_check", STORAGE_AUTO)
+	if err != nil {
+		t.Fatalf("couldn't reopen testdb_check: %v", err)
+	}
+	defer db.Remove()
+	defer db.Close()
+
+	if _, err = db.CollE("books"); err == nil {
+		t.Errorf("opening collection with broken index succeeded")
+	}
+
+	report, err := db.Check()
+	if err != nil || len(report.Collections) != 1 {
+		t.Fatalf("Check returned %#v (error: %v)", report, err)
+	}
+	coll := report.Collections[0]
+	if coll.OK() || coll.NextId != 2 || coll.MaxId != Id(len(queryData)) || coll.Objects != len(queryData)-1 {
+		t.Errorf("unexpected collection report %#v", coll)
+	}
+	for _, idx := range coll.Indexes {
+		switch idx.Field {
+		case "Author":
+			if idx.Stale != 1 || idx.Missing != 0 || len(idx.Corrupt) != 0 {
+				t.Errorf("unexpected report for index Author: %#v", idx)
+			}
+		case "Title":
+			if len(idx.Corrupt) != 1 {
+				t.Errorf("truncated index Title hasn't been reported: %#v", idx)
+			}
+		default:
+			t.Errorf("unexpected index %s", idx.Field)
+		}
+	}
+
+	if _, err = db.Repair(); err != nil {
+		t.Fatalf("Repair failed: %v", err)
+	}
+	if report, err = db.Check(); err != nil || !report.OK() {
+		t.Errorf("database is still broken after Repair: %#v (error: %v)", report.Collections[0], err)
+	}
+
+	books, err = db.CollE("books")
+	if err != nil {
+		t.Fatalf("opening collection after Repair failed: %v", err)
+	}
+	if id, err := books.Insert(&book{Title: "New", Author: "Someone"}); err != nil || id != Id(len(queryData)+1) {
+		t.Errorf("Insert after Repair returned ID %d (error: %v)", id, err)
+	}
+	result, err := books.Query(&Equals{Field: "Title", Value: "New"})
+	if err != nil || result.Count() != 1 {
+		t.Errorf("query on rebuilt index failed (error: %v)", err)
+	}
+}
+
+func TestCheckNonNumericKeys(t *testing.T) {
+	db, err := OpenDatabase("testdb_check", STORAGE_DISKV)
+	if err != nil {
+		t.Fatalf("couldn't open testdb_check: %v", err)
+	}
+	db.Coll("books").AddIndex("Author")
+	db.Coll("books").Insert(&book{Title: "Fables", Author: "Aesop"})
+	db.Close()
+
+	store, _ := NewDiskvStorageBackend("testdb_check/colls/books", (&Options{}).withDefaults())
+	for _, key := range []string{"abc", "def"} {
+		NewChecksummedStorageBackend(store).Write(key, []byte(`{"Title":"Stray","Author":"Nobody"}`))
+	}
+	store.Close()
+
+	db, err = OpenDatabase("testdb_check", STORAGE_AUTO)
+	if err != nil {
+		t.Fatalf("couldn't reopen testdb_check: %v", err)
+	}
+	defer db.Remove()
+	defer db.Close()
+	report, err := db.Check()
+	if err != nil || len(report.Collections) != 1 {
+		t.Fatalf("Check returned %#v (error: %v)", report, err)
+	}
+	coll := report.Collections[0]
+	if len(coll.Corrupt) != 2 || coll.MaxId != 1 {
+		t.Errorf("unexpected collection report %#v", coll)
+	}
+	if idx := coll.Indexes[0]; !idx.OK() {
+		t.Errorf("unexpected report for index Author: %#v", idx)
+	}
+}
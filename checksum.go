@@ -0,0 +1,151 @@
+package epos
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+)
+
+// checksummed values start with checksumMagic, followed by the CRC-32C of
+// the value in big endian byte order and the value itself. Values that have
+// been written by earlier versions have no checksum.
+const (
+	checksumMagic = "\x00epc"
+	checksumLen   = 4
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+func checksum(data []byte) uint32 {
+	return crc32.Checksum(data, castagnoli)
+}
+
+// ChecksummedStorageBackend wraps another storage backend and stores a
+// checksum with every value, so that values that have been partially written
+// or damaged on disk are detected when they are read. Reading a damaged value
+// fails with a CorruptError.
+type ChecksummedStorageBackend struct {
+	wrappedStore
+	name string // the name of the collection, for error messages.
+
+	// required is set if all values have been written with a checksum,
+	// so that values without one are corrupt, e.g. because their magic
+	// has been damaged.
+	required bool
+}
+
+// NewChecksummedStorageBackend returns a storage backend that adds checksums
+// to all values and writes them to store.
+func NewChecksummedStorageBackend(store StorageBackend) *ChecksummedStorageBackend {
+	return &ChecksummedStorageBackend{wrappedStore: wrappedStore{store}}
+}
+
+func (s *ChecksummedStorageBackend) encode(key string, value []byte) []byte {
+	if isInternalKey(key) {
+		return value
+	}
+	data := make([]byte, len(checksumMagic)+checksumLen, len(checksumMagic)+checksumLen+len(value))
+	copy(data, checksumMagic)
+	binary.BigEndian.PutUint32(data[len(checksumMagic):], checksum(value))
+	return append(data, value...)
+}
+
+func (s *ChecksummedStorageBackend) decode(key string, data []byte) ([]byte, error) {
+	if len(data) < len(checksumMagic) || string(data[:len(checksumMagic)]) != checksumMagic {
+		if s.required && !isInternalKey(key) {
+			return nil, &CorruptError{Collection: s.name, Key: key, Reason: "checksum is missing"}
+		}
+		return data, nil
+	}
+	if len(data) < len(checksumMagic)+checksumLen {
+		return nil, &CorruptError{Collection: s.name, Key: key, Reason: "value is truncated"}
+	}
+	sum, value := binary.BigEndian.Uint32(data[len(checksumMagic):]), data[len(checksumMagic)+checksumLen:]
+	if checksum(value) != sum {
+		return nil, &CorruptError{Collection: s.name, Key: key, Reason: "checksum mismatch"}
+	}
+	return value, nil
+}
+
+func (s *ChecksummedStorageBackend) Read(key string) ([]byte, error) {
+	data, err := s.store.Read(key)
+	if err != nil {
+		return nil, err
+	}
+	return s.decode(key, data)
+}
+
+func (s *ChecksummedStorageBackend) Write(key string, value []byte) error {
+	return s.store.Write(key, s.encode(key, value))
+}
+
+func (s *ChecksummedStorageBackend) WriteBatch(ops []BatchOp) error {
+	checksummed := make([]BatchOp, len(ops))
+	for i, op := range ops {
+		checksummed[i] = op
+		if !op.Erase {
+			checksummed[i].Value = s.encode(op.Key, op.Value)
+		}
+	}
+	return writeBatch(s.store, checksummed)
+}
+
+func (s *ChecksummedStorageBackend) Range(start, end string) Iterator {
+	return &decodingIterator{Iterator: storeRange(s.store, start, end), decode: s.decode}
+}
+
+func (s *ChecksummedStorageBackend) ReadMany(keys []string) ([][]byte, error) {
+	return decodeMany(s.store, keys, s.decode)
+}
+
+// CorruptRecords checks all objects and index entries of the collection, and
+// returns the ones that are corrupt: objects that fail their checksum or
+// can't be decoded, and index entries that failed their checksum when the
+// collection was opened.
+func (c *Collection) CorruptRecords() []*CorruptError {
+	corrupt := []*CorruptError{}
+	for key := range c.store.Keys() {
+		if isInternalKey(key) {
+			continue
+		}
+		data, err := c.store.Read(key)
+		// gob can only decode objects into the type they have been
+		// encoded from, so objects encoded with gob can't be checked.
+		if err == nil && c.codec.Name() != CODEC_GOB {
+			var value interface{}
+			if err = c.codec.Unmarshal(data, &value); err != nil {
+				err = &CorruptError{Collection: c.name, Key: key, Reason: "decoding failed: " + err.Error()}
+			}
+		}
+		if err != nil {
+			cerr, ok := err.(*CorruptError)
+			if !ok {
+				cerr = &CorruptError{Collection: c.name, Key: key, Reason: err.Error()}
+			}
+			corrupt = append(corrupt, cerr)
+		}
+	}
+
+	for _, idx := range c.indexes {
+		corrupt = append(corrupt, idx.corrupt...)
+	}
+	return corrupt
+}
+
+// CorruptRecords returns the corrupt objects and index entries of all
+// collections of the database.
+func (db *Database) CorruptRecords() ([]*CorruptError, error) {
+	colls, err := db.Collections()
+	if err != nil {
+		return nil, err
+	}
+
+	corrupt := []*CorruptError{}
+	for _, name := range colls {
+		coll, err := db.CollE(name)
+		if err != nil {
+			return nil, err
+		}
+		corrupt = append(corrupt, coll.CorruptRecords()...)
+	}
+	return corrupt, nil
+}
@@ -0,0 +1,112 @@
+package epos
+
+import (
+	"errors"
+	"io/ioutil"
+	"testing"
+)
+
+func TestChecksums(t *testing.T) {
+	db, err := OpenDatabase("testdb_checksums", STORAGE_DISKV)
+	if err != nil {
+		t.Fatalf("couldn't open testdb_checksums: %v", err)
+	}
+	books := db.Coll("books")
+	books.AddIndex("Author")
+	for i, book := range queryData {
+		if _, err := books.Insert(book); err != nil {
+			t.Errorf("%d. Insert failed: %v", i, err)
+		}
+	}
+	if corrupt, err := db.CorruptRecords(); err != nil || len(corrupt) != 0 {
+		t.Errorf("intact database has corrupt records: %v (error: %v)", corrupt, err)
+	}
+	db.Close()
+
+	// damage the first object and the value of the first index entry.
+	store, _ := NewDiskvStorageBackend("testdb_checksums/colls/books", (&Options{}).withDefaults())
+	data, _ := store.Read("1")
+	data[len(data)-1] ^= 0xff
+	store.Write("1", data)
+
+	data, _ = ioutil.ReadFile("testdb_checksums/indexes/books/Author")
+	data[len(indexMagic)+2+1+4] ^= 0xff
+	ioutil.WriteFile("testdb_checksums/indexes/books/Author", data, 0644)
+
+	db, err = OpenDatabase("testdb_checksums", STORAGE_AUTO)
+	if err != nil {
+		t.Fatalf("couldn't reopen testdb_checksums: %v", err)
+	}
+	defer db.Remove()
+	defer db.Close()
+	books = db.Coll("books")
+
+	result, err := books.QueryId(1)
+	var b book
+	if err != nil || result.Next(nil, &b) {
+		t.Errorf("corrupt object has been returned: %#v (error: %v)", b, err)
+	}
+	if !errors.Is(result.Err(), ErrCorrupt) {
+		t.Errorf("reading corrupt object returned %v instead of ErrCorrupt", result.Err())
+	}
+
+	corrupt, err := db.CorruptRecords()
+	if err != nil || len(corrupt) != 2 {
+		t.Fatalf("expected 2 corrupt records, got %v (error: %v)", corrupt, err)
+	}
+	for _, cerr := range corrupt {
+		if cerr.Collection != "books" || (cerr.Key != "1" && cerr.Index != "Author") {
+			t.Errorf("unexpected corrupt record %v", cerr)
+		}
+	}
+
+	if result, err := books.QueryId(2); err != nil || !result.Next(nil, &b) {
+		t.Errorf("intact object couldn't be read (error: %v)", result.Err())
+	}
+}
+
+func TestDamagedChecksumMagic(t *testing.T) {
+	// the objects of collections created by earlier versions have no
+	// checksum.
+	store, _ := NewDiskvStorageBackend("testdb_checksums/colls/books", (&Options{}).withDefaults())
+	store.Write("1", []byte(`{"Title":"Fables"}`))
+	store.Write("_next_id", []byte{4})
+	store.Close()
+
+	db, err := OpenDatabase("testdb_checksums", STORAGE_DISKV)
+	if err != nil {
+		t.Fatalf("couldn't open testdb_checksums: %v", err)
+	}
+	defer db.Remove()
+	books := db.Coll("books")
+	var b book
+	if err = books.Get(1, &b); err != nil || b.Title != "Fables" {
+		t.Errorf("object without checksum couldn't be read: %#v (error: %v)", b, err)
+	}
+	books.Insert(&book{Title: "Dracula"})
+
+	// once all objects have been rewritten, every object must have a
+	// checksum.
+	if err = books.Recompress(COMPRESSION_NONE); err != nil {
+		t.Fatalf("Recompress failed: %v", err)
+	}
+	db.Close()
+
+	store, _ = NewDiskvStorageBackend("testdb_checksums/colls/books", (&Options{}).withDefaults())
+	data, _ := store.Read("2")
+	data[0] ^= 0x01
+	store.Write("2", data)
+	store.Close()
+
+	db, err = OpenDatabase("testdb_checksums", STORAGE_DISKV)
+	if err != nil {
+		t.Fatalf("couldn't reopen testdb_checksums: %v", err)
+	}
+	defer db.Close()
+	if err = db.Coll("books").Get(2, &b); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("object with damaged checksum magic returned %#v (error: %v)", b, err)
+	}
+	if err = db.Coll("books").Get(1, &b); err != nil || b.Title != "Fables" {
+		t.Errorf("rewritten object couldn't be read: %#v (error: %v)", b, err)
+	}
+}
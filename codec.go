@@ -0,0 +1,157 @@
+package epos
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Codec encodes objects before they are stored, and decodes them again.
+// Indexes are built by decoding objects into a map[string]interface{}, so
+// only fields of objects that can be decoded that way can be indexed.
+type Codec interface {
+	// Name identifies the codec. It is recorded in the metadata of every
+	// collection that uses the codec.
+	Name() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+const (
+	CODEC_JSON    = "json"
+	CODEC_MSGPACK = "msgpack"
+	CODEC_CBOR    = "cbor"
+	CODEC_GOB     = "gob"
+)
+
+var codecs map[string]Codec
+
+func init() {
+	codecs = make(map[string]Codec)
+	RegisterCodec(jsonCodec{})
+	RegisterCodec(msgpackCodec{})
+	RegisterCodec(cborCodec{})
+	RegisterCodec(gobCodec{})
+}
+
+// RegisterCodec registers a custom codec under its name, so that collections
+// can use it. If the name is already used, an error is returned.
+func RegisterCodec(codec Codec) error {
+	if _, exists := codecs[codec.Name()]; exists {
+		return fmt.Errorf("codec %s is already registered", codec.Name())
+	}
+	codecs[codec.Name()] = codec
+	return nil
+}
+
+func getCodec(name string) (Codec, error) {
+	codec, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown codec %s", name)
+	}
+	return codec, nil
+}
+
+// jsonCodec encodes objects as JSON. It is the default codec, and the codec
+// of all collections that have been created by earlier versions.
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string                               { return CODEC_JSON }
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+// msgpackCodec encodes objects as MessagePack, which keeps integers and
+// byte slices intact.
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string                               { return CODEC_MSGPACK }
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error)      { return msgpack.Marshal(v) }
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error { return msgpack.Unmarshal(data, v) }
+
+// cborCodec encodes objects as CBOR (RFC 8949), which keeps integers and
+// byte slices intact.
+type cborCodec struct{}
+
+func (cborCodec) Name() string                               { return CODEC_CBOR }
+func (cborCodec) Marshal(v interface{}) ([]byte, error)      { return cbor.Marshal(v) }
+func (cborCodec) Unmarshal(data []byte, v interface{}) error { return cbor.Unmarshal(data, v) }
+
+// gobCodec encodes objects with encoding/gob. gob can only decode objects
+// into the type they have been encoded from, so only fields of objects that
+// have been inserted as map[string]interface{} can be indexed.
+type gobCodec struct{}
+
+func (gobCodec) Name() string { return CODEC_GOB }
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	buf := bytes.NewBuffer([]byte{})
+	if err := gob.NewEncoder(buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// CollectionOptions configures how a collection stores its objects. Empty
+// fields default to the options the database has been opened with.
+type CollectionOptions struct {
+	// Codec is the name of the codec that encodes the objects.
+	Codec string
+
+	// Compression is the compression algorithm for the objects.
+	Compression Compression
+
+	// IdStrategy determines how the IDs and keys of new objects are
+	// generated. It defaults to ID_SEQUENCE.
+	IdStrategy string
+}
+
+// CollWithOptions returns the collection of the specified name, and creates
+// it with opts if it doesn't exist yet. If the collection already exists, it
+// returns an error if the collection has been created with a different codec,
+// compression or ID strategy.
+func (db *Database) CollWithOptions(name string, opts *CollectionOptions) (*Collection, error) {
+	db.colls_mu.Lock()
+	defer db.colls_mu.Unlock()
+
+	coll := db.colls[name]
+	if coll == nil {
+		var err error
+		if coll, err = db.openColl(name, opts); err != nil {
+			return nil, err
+		}
+		db.colls[name] = coll
+	}
+	if err := coll.checkOptions(opts); err != nil {
+		return nil, err
+	}
+	return coll, nil
+}
+
+// Options returns the options the collection has been created with.
+func (c *Collection) Options() *CollectionOptions {
+	return &CollectionOptions{Codec: c.codec.Name(), Compression: c.meta.Compression, IdStrategy: c.meta.IdStrategy}
+}
+
+func (c *Collection) checkOptions(opts *CollectionOptions) error {
+	if opts == nil {
+		return nil
+	}
+	if opts.Codec != "" && opts.Codec != c.codec.Name() {
+		return fmt.Errorf("collection %s uses codec %s, not %s", c.name, c.codec.Name(), opts.Codec)
+	}
+	if opts.Compression != "" && opts.Compression != c.meta.Compression {
+		return fmt.Errorf("collection %s uses compression %s, not %s", c.name, c.meta.Compression, opts.Compression)
+	}
+	if opts.IdStrategy != "" && opts.IdStrategy != c.meta.IdStrategy {
+		return fmt.Errorf("collection %s uses ID strategy %s, not %s", c.name, c.meta.IdStrategy, opts.IdStrategy)
+	}
+	return nil
+}
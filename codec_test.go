@@ -0,0 +1,86 @@
+package epos
+
+import (
+	"testing"
+)
+
+type bigNumber struct {
+	Name  string
+	Value int64
+	Raw   []byte
+}
+
+func TestCodecs(t *testing.T) {
+	for _, codec := range []string{CODEC_MSGPACK, CODEC_CBOR} {
+		db, err := OpenDatabaseWithOptions("testdb_codec", &Options{Type: STORAGE_DISKV, Codec: codec})
+		if err != nil {
+			t.Fatalf("%s: couldn't open testdb_codec: %v", codec, err)
+		}
+
+		numbers := db.Coll("numbers")
+		numbers.AddIndex("Name")
+		value := bigNumber{Name: "big", Value: 1<<53 + 1, Raw: []byte{0, 1, 2}}
+		id, err := numbers.Insert(value)
+		if err != nil {
+			t.Fatalf("%s: Insert failed: %v", codec, err)
+		}
+		db.Close()
+
+		// the collection keeps its codec, no matter which codec the
+		// database is opened with.
+		db, err = OpenDatabase("testdb_codec", STORAGE_AUTO)
+		if err != nil {
+			t.Fatalf("%s: couldn't reopen testdb_codec: %v", codec, err)
+		}
+		numbers = db.Coll("numbers")
+		if numbers.Options().Codec != codec {
+			t.Errorf("%s: reopened collection uses codec %s", codec, numbers.Options().Codec)
+		}
+
+		result, err := numbers.Query(&Equals{Field: "Name", Value: "big"})
+		var n bigNumber
+		var result_id Id
+		if err != nil || !result.Next(&result_id, &n) {
+			t.Fatalf("%s: query returned no result (error: %v)", codec, err)
+		}
+		if result_id != id || n.Value != value.Value || string(n.Raw) != string(value.Raw) {
+			t.Errorf("%s: got %d %#v, expected %d %#v", codec, result_id, n, id, value)
+		}
+
+		if _, err = db.CollWithOptions("numbers", &CollectionOptions{Codec: CODEC_JSON}); err == nil {
+			t.Errorf("%s: opening collection with a different codec succeeded", codec)
+		}
+
+		db.Close()
+		db.Remove()
+	}
+}
+
+func TestGobCodec(t *testing.T) {
+	db, err := OpenDatabase("testdb_gob", STORAGE_DISKV)
+	if err != nil {
+		t.Fatalf("couldn't open testdb_gob: %v", err)
+	}
+	defer db.Remove()
+	defer db.Close()
+
+	coll, err := db.CollWithOptions("gob", &CollectionOptions{Codec: CODEC_GOB})
+	if err != nil {
+		t.Fatalf("CollWithOptions failed: %v", err)
+	}
+	coll.AddIndex("name")
+
+	if _, err = coll.Insert(map[string]interface{}{"name": "foo", "value": 23}); err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+
+	result, err := coll.Query(&Equals{Field: "name", Value: "foo"})
+	entry := map[string]interface{}{}
+	if err != nil || !result.Next(nil, &entry) || entry["value"] != 23 {
+		t.Errorf("query returned %#v (error: %v)", entry, err)
+	}
+
+	if _, err = db.CollWithOptions("invalid", &CollectionOptions{Codec: "xml"}); err == nil {
+		t.Errorf("opening collection with unknown codec succeeded")
+	}
+}
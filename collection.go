@@ -2,70 +2,222 @@ package epos
 
 import (
 	"encoding/binary"
-	"encoding/json"
 	"fmt"
 	"io"
-	"log"
 	"os"
-	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
 )
 
 type Collection struct {
+	db        *Database
+	name      string
 	store     StorageBackend
 	indexpath string
 	indexes   map[string]*index
+	dirty     bool
+
+	codec       Codec
+	meta        *collMeta
+	checksummed *ChecksummedStorageBackend
+	compressed  *CompressedStorageBackend
+	encrypted   *EncryptedStorageBackend // nil if the database isn't encrypted.
+	cache       *CachedStorageBackend
+	raw         StorageBackend // the storage backend without any wrappers.
 }
 
 type Id int64
 
-func (db *Database) openColl(name string) *Collection {
-	// create/open collection
-	coll := &Collection{store: db.storageFactory(db.path + "/colls/" + name), indexpath: db.path + "/indexes/" + name, indexes: make(map[string]*index)}
+func (db *Database) openColl(name string, opts *CollectionOptions) (*Collection, error) {
+	coll, err := db.newColl(name, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if !db.opts.ReadOnly {
+		if err = db.fs.Mkdir(coll.indexpath, db.opts.DirMode); err != nil && !os.IsExist(err) {
+			coll.close()
+			return nil, err
+		}
+	}
 
-	os.Mkdir(coll.indexpath, 0755)
+	if err = coll.loadIndexes(); err != nil {
+		coll.close()
+		return nil, err
+	}
 
-	coll.loadIndexes()
+	if db.opts.ReadOnly {
+		return coll, nil
+	}
 
 	// if _next_id is unset, then set it to 1.
 	if data, err := coll.store.Read("_next_id"); err != nil || len(data) == 0 {
-		coll.setNextId(Id(1))
+		if err = coll.store.Write("_next_id", encodeNextId(Id(1))); err != nil {
+			coll.close()
+			return nil, err
+		}
 	}
-	return coll
+	return coll, nil
 }
 
-func (c *Collection) loadIndexes() {
-	filepath.Walk(c.indexpath, func(path string, info os.FileInfo, err error) error {
-		if (info.Mode() & os.ModeType) == 0 {
-			if err := c.loadIndex(path, filepath.Base(path)); err != nil {
-				log.Printf("loadIndex %s failed: %v", path, err)
-				// TODO: should we maybe remove or rebuild index?
+// newColl opens the storage backend of a collection, but doesn't load its
+// indexes.
+func (db *Database) newColl(name string, opts *CollectionOptions) (*Collection, error) {
+	// new collections are created with opts or the database's options,
+	// existing collections keep what's recorded in their metadata.
+	meta, err := db.readCollMeta(name)
+	if err != nil {
+		return nil, fmt.Errorf("reading metadata of collection %s failed: %v", name, err)
+	}
+	if meta == nil {
+		meta = &collMeta{Codec: db.opts.Codec, Compression: db.opts.Compression, Checksummed: true}
+		if opts != nil && opts.Codec != "" {
+			meta.Codec = opts.Codec
+		}
+		// collections created by earlier versions have no metadata, and
+		// their objects are encoded as JSON and have no checksums.
+		if _, err = db.fs.Stat(db.path + "/colls/" + name); err == nil {
+			meta.Codec = CODEC_JSON
+			meta.Checksummed = false
+		}
+		if opts != nil && opts.Compression != "" {
+			meta.Compression = opts.Compression
+		}
+		if opts != nil && opts.IdStrategy != "" {
+			if err = checkIdStrategy(opts.IdStrategy); err != nil {
+				return nil, err
 			}
+			meta.IdStrategy = opts.IdStrategy
 		}
-		return nil
-	})
+		if err = checkCompression(meta.Compression); err != nil {
+			return nil, err
+		}
+		if _, err = getCodec(meta.Codec); err != nil {
+			return nil, err
+		}
+		if !db.opts.ReadOnly {
+			if err = db.writeCollMeta(name, meta); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if meta.Compression == "" {
+		meta.Compression = COMPRESSION_NONE
+	}
+	if meta.Codec == "" {
+		meta.Codec = CODEC_JSON
+	}
+	if meta.IdStrategy == "" {
+		meta.IdStrategy = ID_SEQUENCE
+	}
+	if meta.IdStrategy == ID_SNOWFLAKE && (db.opts.NodeId < 0 || db.opts.NodeId >= 1<<snowflakeNodeBits) {
+		return nil, fmt.Errorf("node ID %d is out of range for snowflake IDs", db.opts.NodeId)
+	}
+
+	codec, err := getCodec(meta.Codec)
+	if err != nil {
+		return nil, fmt.Errorf("opening collection %s failed: %v", name, err)
+	}
+
+	// create/open collection
+	raw, err := db.storageFactory(db.path+"/colls/"+name, db.opts)
+	if err != nil {
+		return nil, fmt.Errorf("opening storage of collection %s failed: %v", name, err)
+	}
+	checksummed := NewChecksummedStorageBackend(raw)
+	checksummed.name = name
+	checksummed.required = meta.Checksummed
+	var store StorageBackend = checksummed
+
+	var encrypted *EncryptedStorageBackend
+	if db.opts.keys != nil {
+		encrypted = &EncryptedStorageBackend{wrappedStore: wrappedStore{store}, keys: db.opts.keys, name: name, plaintext: db.encrypting}
+		store = encrypted
+	}
+
+	compressed, err := NewCompressedStorageBackend(store, meta.Compression)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+
+	coll := &Collection{db: db, name: name, store: compressed, codec: codec, meta: meta, compressed: compressed, checksummed: checksummed, encrypted: encrypted, raw: raw, indexpath: db.path + "/indexes/" + name, indexes: make(map[string]*index)}
+	if db.opts.CacheSize > 0 {
+		coll.cache = NewCachedStorageBackend(compressed, db.opts.CacheSize)
+		coll.store = coll.cache
+	}
+	return coll, nil
+}
+
+func (c *Collection) loadIndexes() error {
+	entries, err := c.db.fs.ReadDir(c.indexpath)
+	if err != nil {
+		// a collection that has never been written to in a read-only
+		// database has no index directory.
+		if os.IsNotExist(err) && c.db.opts.ReadOnly {
+			return nil
+		}
+		return err
+	}
+
+	for _, info := range entries {
+		if (info.Mode() & os.ModeType) != 0 {
+			continue
+		}
+		path := c.indexpath + "/" + info.Name()
+		// leftovers of an interrupted AddIndex or Vacuum.
+		if strings.HasPrefix(info.Name(), ".") {
+			if !c.db.opts.ReadOnly {
+				c.db.fs.Remove(path)
+			}
+			continue
+		}
+		if err := c.loadIndex(path, info.Name()); err != nil {
+			return fmt.Errorf("loading index %s failed: %w", path, err)
+		}
+	}
+	return nil
 }
 
 func (c *Collection) loadIndex(filepath, field string) error {
-	file, err := os.OpenFile(filepath, os.O_RDWR, 0644)
+	flags := os.O_RDWR
+	if c.db.opts.ReadOnly {
+		flags = os.O_RDONLY
+	}
+	file, err := c.db.fs.OpenFile(filepath, flags, c.db.opts.FileMode)
 	if err != nil {
 		return err
 	}
 
-	idx := newIndex(file, field)
+	idx := newIndex(file, field, nil)
+	if err = idx.readHeader(c.db.opts.keys); err != nil {
+		file.Close()
+		return err
+	}
 
 	for {
-		fpos, _ := file.Seek(0, os.SEEK_CUR)
-		var entry indexEntry
-		_, err = entry.ReadFrom(file)
+		entry, err := idx.readEntry()
 		if err != nil {
 			if err == io.EOF {
 				break
 			}
+			// entries that fail their checksum are skipped and
+			// reported by CorruptRecords. An incomplete entry
+			// makes all following entries unreadable, though.
+			if cerr, ok := err.(*CorruptError); ok {
+				cerr.Collection = c.name
+				idx.corrupt = append(idx.corrupt, cerr)
+				c.db.opts.Logger.Printf("loadIndex: %v", cerr)
+				continue
+			}
+			if err == io.ErrUnexpectedEOF {
+				err = &CorruptError{Collection: c.name, Index: field, Offset: entry.fpos, Reason: "entry is incomplete"}
+			}
+			file.Close()
 			return err
 		}
 		if !entry.Deleted() {
-			entry.fpos = fpos
 			idx.Add(entry)
 		}
 	}
@@ -75,36 +227,73 @@ func (c *Collection) loadIndex(filepath, field string) error {
 }
 
 func (c *Collection) setNextId(next_id Id) {
+	c.store.Write("_next_id", encodeNextId(next_id))
+}
+
+func encodeNextId(next_id Id) []byte {
 	next_id_buf := make([]byte, binary.MaxVarintLen64)
 	length := binary.PutVarint(next_id_buf, int64(next_id))
-	c.store.Write("_next_id", next_id_buf[:length])
+	return next_id_buf[:length]
 }
 
 func (c *Collection) getNextId() Id {
 	data, _ := c.store.Read("_next_id")
 	next_id, _ := binary.Varint(data)
-	c.setNextId(Id(next_id + 1))
-	return Id(next_id)
+	id := c.allocId(Id(next_id))
+	c.setNextId(id + 1)
+	return id
 }
 
 // Insert inserts an object into the collection. It returns the object's
 // ID and, if the insert fails, a non-nil error describing the problem.
 func (c *Collection) Insert(value interface{}) (Id, error) {
-	jsondata, err := json.Marshal(value)
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	return c.insert(value)
+}
+
+func (c *Collection) insert(value interface{}) (Id, error) {
+	if err := c.db.checkWritable(); err != nil {
+		return Id(0), err
+	}
+	if c.meta.IdStrategy == ID_KEY {
+		return Id(0), fmt.Errorf("objects of collection %s need a key; use InsertWithKey", c.name)
+	}
+	if key := c.newKey(); key != "" {
+		return c.insertWithKey(key, value)
+	}
+
+	data, err := c.codec.Marshal(value)
 	if err != nil {
 		return Id(0), err
 	}
 
 	id := c.getNextId()
 	id_str := fmt.Sprintf("%d", id)
-	err = c.store.Write(id_str, jsondata)
+	rev := c.revisionOp(id_str, readRev(c.raw, id_str)+1)
+	ops := []walOp{rev, {typ: walInsert, coll: c.name, key: id_str, data: data}}
+	if err = c.checkUnique(ops); err == nil {
+		err = c.db.wal.Log(ops)
+	}
+	if err != nil {
+		c.setNextId(id) // roll back generated ID
+		return Id(0), err
+	}
+
+	err = writeBatch(c.store, []BatchOp{{Key: rev.key, Value: rev.data}, {Key: id_str, Value: data}})
 	if err != nil {
 		c.setNextId(id) // roll back generated ID
+		c.db.abort()
 		return Id(0), err
 	}
 
-	if err = c.addToIndexes(id, jsondata); err != nil {
+	if err = c.addToIndexes(id, data); err != nil {
+		c.removeFromIndexes(id)
 		c.store.Erase(id_str)
+		c.db.abort()
+		return Id(0), err
+	}
+	if err = c.db.commit(c); err != nil {
 		return Id(0), err
 	}
 	return id, nil
@@ -113,37 +302,55 @@ func (c *Collection) Insert(value interface{}) (Id, error) {
 // Update replaces an existing object with a new object. If an error
 // occurs during that operation, it returns a non-nil error.
 func (c *Collection) Update(id Id, value interface{}) error {
-	jsondata, err := json.Marshal(value)
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	return c.update(id, value)
+}
+
+func (c *Collection) update(id Id, value interface{}) error {
+	if err := c.db.checkWritable(); err != nil {
+		return err
+	}
+
+	data, err := c.codec.Marshal(value)
 	if err != nil {
 		return err
 	}
 
-	if err = c.store.Write(fmt.Sprintf("%d", id), jsondata); err != nil {
+	id_str := fmt.Sprintf("%d", id)
+	rev := c.revisionOp(id_str, readRev(c.raw, id_str)+1)
+	ops := []walOp{rev, {typ: walUpdate, coll: c.name, key: id_str, data: data}}
+	if err = c.checkUnique(ops); err != nil {
+		return err
+	}
+	if err = c.db.wal.Log(ops); err != nil {
+		return err
+	}
+
+	if err = writeBatch(c.store, []BatchOp{{Key: rev.key, Value: rev.data}, {Key: id_str, Value: data}}); err != nil {
+		c.db.abort()
 		return err
 	}
 
 	c.removeFromIndexes(id)
 
-	if err = c.addToIndexes(id, jsondata); err != nil {
+	if err = c.addToIndexes(id, data); err != nil {
+		c.db.abort()
 		return err
 	}
-	return nil
+	return c.db.commit(c)
 }
 
-func (c *Collection) addToIndexes(id Id, jsondata []byte) error {
+func (c *Collection) addToIndexes(id Id, data []byte) error {
 	var value2 map[string]interface{}
 	// no error means that we can unmarshal it into a map.
-	if err := json.Unmarshal(jsondata, &value2); err == nil {
+	if err := c.codec.Unmarshal(data, &value2); err == nil {
 		for field, idx := range c.indexes {
 			if v, contains := value2[field]; contains {
 				entry := indexEntry{deleted: false, value: fmt.Sprintf("%v", v), id: int64(id)}
-				fpos, _ := idx.file.Seek(0, os.SEEK_END)
-				if _, err = entry.WriteTo(idx.file); err != nil {
+				if err = idx.append(entry); err != nil {
 					return err
 				}
-				idx.file.Sync()
-				entry.fpos = fpos
-				idx.Add(entry)
 			}
 		}
 	}
@@ -156,52 +363,78 @@ func (c *Collection) addToIndexes(id Id, jsondata []byte) error {
 //
 // A field describes a top-level element of a struct or a particular key of a map.
 func (c *Collection) AddIndex(field string) error {
+	if err := c.db.checkWritable(); err != nil {
+		return err
+	}
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	return c.addIndex(field)
+}
+
+func (c *Collection) addIndex(field string) error {
+
 	filepath := c.indexpath + "/" + field
 
-	file, err := os.OpenFile(filepath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	// if the index file already exists, then AddIndex is a no-op.
+	if _, err := c.db.fs.Stat(filepath); err == nil {
+		return nil
+	}
+
+	// the index is built in a temporary file that is only renamed to its
+	// final name when it's complete, so that a crash never leaves a
+	// partially built index behind.
+	tmppath := c.indexpath + "/." + field + ".tmp"
+	file, err := c.db.fs.OpenFile(tmppath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, c.db.opts.FileMode)
 	if err != nil {
-		// if we couldn't open the file because it already exists, then AddIndex is a no-op.
-		if os.IsExist(err) {
-			return nil
-		}
 		return err
 	}
 
-	idx := newIndex(file, field)
+	idx := newIndex(file, field, c.db.opts.keys)
+	if err = idx.writeHeader(); err != nil {
+		file.Close()
+		c.db.fs.Remove(tmppath)
+		return err
+	}
 
 	for id_str := range c.store.Keys() {
 		id, err := strconv.ParseInt(id_str, 10, 64)
 		if err != nil {
-			//log.Printf("AddIndex: skipping key %s", id_str)
+			//c.db.opts.Logger.Printf("AddIndex: skipping key %s", id_str)
 			continue
 		}
 
 		var entry map[string]interface{}
 		data, err := c.store.Read(id_str)
 		if err != nil {
-			log.Printf("AddIndex: skipping key %s because read from store failed: %v", id_str, err)
+			c.db.opts.Logger.Printf("AddIndex: skipping key %s because read from store failed: %v", id_str, err)
 			continue
 		}
 
-		if err = json.Unmarshal(data, &entry); err != nil {
-			log.Printf("AddIndex: skipping key %s because unmarshaling failed: %v", id_str, err)
+		if err = c.codec.Unmarshal(data, &entry); err != nil {
+			c.db.opts.Logger.Printf("AddIndex: skipping key %s because unmarshaling failed: %v", id_str, err)
 			continue
 		}
 
 		if value, exists := entry[field]; exists {
 			entry := indexEntry{deleted: false, value: fmt.Sprintf("%v", value), id: id}
-			fpos, _ := file.Seek(0, os.SEEK_END)
-			if _, err := entry.WriteTo(file); err != nil {
-				log.Printf("AddIndex: writing to index file failed: %v", err)
-				c.RemoveIndex(field)
+			if err := idx.append(entry); err != nil {
+				c.db.opts.Logger.Printf("AddIndex: writing to index file failed: %v", err)
+				file.Close()
+				c.db.fs.Remove(tmppath)
 				return err
 			}
-			file.Sync()
-			entry.fpos = fpos
-			idx.Add(entry)
 		}
 	}
 
+	if err = file.Sync(); err == nil {
+		err = c.db.fs.Rename(tmppath, filepath)
+	}
+	if err != nil {
+		file.Close()
+		c.db.fs.Remove(tmppath)
+		return err
+	}
+
 	c.indexes[field] = idx
 
 	return nil
@@ -210,10 +443,110 @@ func (c *Collection) AddIndex(field string) error {
 // RemoveIndex removes an existing index for a field. It returns a non-nil error if
 // an error occurs.
 func (c *Collection) RemoveIndex(field string) error {
+	if err := c.db.checkWritable(); err != nil {
+		return err
+	}
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	if err := c.removeIndex(field); err != nil {
+		return err
+	}
+	return c.forgetUnique(field)
+}
+
+func (c *Collection) removeIndex(field string) error {
+
 	if idx, exists := c.indexes[field]; exists {
 		idx.file.Close()
 		delete(c.indexes, field)
-		if err := os.Remove(c.indexpath + "/" + field); err != nil {
+		if err := c.db.fs.Remove(c.indexpath + "/" + field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rewriteObjects reads all objects of the collection and writes them again,
+// so that they are stored the way the collection is currently configured.
+// As the objects themselves don't change, an interrupted rewrite leaves the
+// collection consistent.
+func (c *Collection) rewriteObjects() error {
+	ops := []BatchOp{}
+	it := storeRange(c.store, "", "")
+	for it.Next() {
+		if isInternalKey(it.Key()) {
+			continue
+		}
+		ops = append(ops, BatchOp{Key: it.Key(), Value: it.Value()})
+		if len(ops) == rewriteBatchSize {
+			if err := writeBatch(c.store, ops); err != nil {
+				it.Close()
+				return err
+			}
+			ops = ops[:0]
+		}
+	}
+	if err := it.Close(); err != nil {
+		return err
+	}
+	if err := writeBatch(c.store, ops); err != nil {
+		return err
+	}
+
+	if err := c.db.commit(c); err != nil {
+		return err
+	}
+	// all objects have a checksum now, but the collection may only be
+	// marked as checksummed once they are on disk.
+	if !c.meta.Checksummed {
+		if err := c.sync(); err != nil {
+			return err
+		}
+		c.meta.Checksummed = true
+		if err := c.db.writeCollMeta(c.name, c.meta); err != nil {
+			return err
+		}
+		c.checksummed.required = true
+	}
+	if compacter, ok := c.store.(Compacter); ok {
+		return compacter.Compact()
+	}
+	return nil
+}
+
+const rewriteBatchSize = 1000
+
+// copyTo copies all objects and index definitions of the collection to dst,
+// which must use the same codec.
+func (c *Collection) copyTo(dst *Collection) error {
+	if dst.codec.Name() != c.codec.Name() {
+		return fmt.Errorf("can't copy objects encoded with %s to collection using %s", c.codec.Name(), dst.codec.Name())
+	}
+
+	keys := []string{}
+	for key := range c.store.Keys() {
+		keys = append(keys, key)
+	}
+
+	for _, key := range keys {
+		data, err := c.store.Read(key)
+		if err != nil {
+			return err
+		}
+		if err = dst.store.Write(key, data); err != nil {
+			return err
+		}
+	}
+	dst.dirty = true
+
+	if len(c.meta.UniqueIndexes) > 0 {
+		dst.meta.UniqueIndexes = append([]string{}, c.meta.UniqueIndexes...)
+		if err := dst.db.writeCollMeta(dst.name, dst.meta); err != nil {
+			return err
+		}
+	}
+	for field, _ := range c.indexes {
+		if err := dst.reindex(field); err != nil {
 			return err
 		}
 	}
@@ -222,85 +555,225 @@ func (c *Collection) RemoveIndex(field string) error {
 
 // Reindex deletes and recreates the index for a field.
 func (c *Collection) Reindex(field string) error {
-	if err := c.RemoveIndex(field); err != nil {
+	if err := c.db.checkWritable(); err != nil {
 		return err
 	}
-	return c.AddIndex(field)
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	return c.reindex(field)
+}
+
+func (c *Collection) reindex(field string) error {
+	if err := c.removeIndex(field); err != nil {
+		return err
+	}
+	return c.addIndex(field)
 }
 
 func (c *Collection) removeFromIndexes(id Id) {
 	// remove entries from indexes
 	for _, idx := range c.indexes {
-		for key, entries := range idx.data {
-			new_entries := []indexEntry{}
-			for _, e := range entries {
-				if e.id != int64(id) {
-					new_entries = append(new_entries, e)
-				} else {
-					idx.file.Seek(e.fpos, os.SEEK_SET)
-					e.deleted = true
-					e.WriteTo(idx.file)
-					idx.file.Sync()
-				}
-			}
-			if len(new_entries) > 0 {
-				idx.data[key] = new_entries
-			} else {
-				delete(idx.data, key)
-			}
+		idx.remove(int64(id))
+	}
+}
+
+// sync commits all pending changes to the storage backend and the index files
+// to stable storage.
+func (c *Collection) sync() error {
+	if !c.dirty {
+		return nil
+	}
+	if syncer, ok := c.store.(Syncer); ok {
+		if err := syncer.Sync(); err != nil {
+			return err
 		}
 	}
+	c.dirty = false
+	return c.syncIndexes()
+}
+
+// Close commits all pending changes to the collection, and closes its storage
+// backend and index files. The collection must not be used afterwards;
+// Database.Coll opens it again.
+func (c *Collection) Close() error {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	return c.closeAndForget()
+}
+
+// closeAndForget syncs and closes the collection, and removes it from the
+// open collections of the database, so that it is opened again the next
+// time it is requested. The caller must hold db.mu.
+func (c *Collection) closeAndForget() error {
+	var errs MultiError
+	errs.add(c.sync())
+	errs.add(c.close())
+	c.db.colls_mu.Lock()
+	if c.db.colls[c.name] == c {
+		delete(c.db.colls, c.name)
+	}
+	c.db.colls_mu.Unlock()
+	return errs.err()
+}
+
+// close closes the storage backend and all index files.
+func (c *Collection) close() error {
+	var errs MultiError
+	for field, idx := range c.indexes {
+		if err := idx.file.Close(); err != nil {
+			errs.add(fmt.Errorf("closing index %s of collection %s failed: %v", field, c.name, err))
+		}
+	}
+	c.indexes = make(map[string]*index)
+	if err := c.store.Close(); err != nil {
+		errs.add(fmt.Errorf("closing storage of collection %s failed: %v", c.name, err))
+	}
+	return errs.err()
+}
+
+// syncIndexes commits all pending changes to the index files to stable storage.
+func (c *Collection) syncIndexes() error {
+	for _, idx := range c.indexes {
+		if err := idx.sync(); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // Delete deletes an object, identified by its ID, from the collection.
 func (c *Collection) Delete(id Id) error {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	return c.delete(id)
+}
+
+func (c *Collection) delete(id Id) error {
+	if err := c.db.checkWritable(); err != nil {
+		return err
+	}
+
+	id_str := fmt.Sprintf("%d", id)
+	if err := c.db.wal.Log([]walOp{{typ: walDelete, coll: c.name, key: id_str}}); err != nil {
+		return err
+	}
+
 	c.removeFromIndexes(id)
-	return c.store.Erase(fmt.Sprintf("%d", id))
+	ops := append(c.unrevisionOps(id_str), c.unkeyOps(id_str)...)
+	if err := writeBatch(c.store, append(ops, BatchOp{Key: id_str, Erase: true})); err != nil {
+		c.db.abort()
+		return err
+	}
+	return c.db.commit(c)
 }
 
-// Vacuum expunges old entries that refer to deleted objects from all indexes 
-// of a collection.
-func (c *Collection) Vacuum() error {
-	for field, _ := range c.indexes {
-		oldf, err := os.Open(c.indexpath + "/" + field)
-		if err != nil {
-			return err
+// redo applies a change recorded in the write-ahead log. Applying the same
+// change more than once yields the same result.
+func (c *Collection) redo(op walOp) error {
+	// internal keys, like the keys of objects, are written as they are.
+	if strings.HasPrefix(op.key, "_") {
+		if op.typ == walDelete {
+			c.store.Erase(op.key)
+			return nil
 		}
-		defer oldf.Close()
+		return c.store.Write(op.key, op.data)
+	}
 
-		newf, err := os.OpenFile(c.indexpath+"/."+field+".tmp", os.O_WRONLY|os.O_CREATE, 0644)
-		if err != nil {
+	id, err := strconv.ParseInt(op.key, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid key %s in write-ahead log", op.key)
+	}
+
+	switch op.typ {
+	case walInsert, walUpdate:
+		// the revision is logged as an operation of its own.
+		if err = c.store.Write(op.key, op.data); err != nil {
 			return err
 		}
-		defer newf.Close()
-
-		for {
-			var entry indexEntry
-			n, err := entry.ReadFrom(oldf)
-			if err != nil {
-				if err == io.EOF {
-					break
-				}
-				return err
+		c.removeFromIndexes(Id(id))
+		if err = c.addToIndexes(Id(id), op.data); err != nil {
+			return err
+		}
+		if op.typ == walInsert {
+			data, _ := c.store.Read("_next_id")
+			if next_id, _ := binary.Varint(data); next_id <= id {
+				c.setNextId(Id(id + 1))
 			}
+		}
+	case walDelete:
+		c.removeFromIndexes(Id(id))
+		writeBatch(c.store, c.unkeyOps(op.key))
+		c.store.Erase(revKey(op.key))
+		c.store.Erase(op.key) // the object may already be gone.
+	default:
+		return fmt.Errorf("unknown operation %d in write-ahead log", op.typ)
+	}
+	return nil
+}
 
-			// don't write deleted entries
-			if entry.Deleted() {
-				continue
-			}
+// rewriteIndex writes a new index file that only contains the current
+// entries of an index, encrypted with the database's current key, and
+// replaces the old index file with it.
+func (c *Collection) rewriteIndex(field string) error {
+	tmppath := c.indexpath + "/." + field + ".tmp"
+	file, err := c.db.fs.OpenFile(tmppath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, c.db.opts.FileMode)
+	if err != nil {
+		return err
+	}
 
-			m, err := entry.WriteTo(newf)
-			if err != nil {
-				return err
-			}
-			if n != m {
-				os.Remove(c.indexpath + "/." + field + ".tmp")
-				return fmt.Errorf("short write while writing new index for %s", field)
+	idx := newIndex(file, field, c.db.opts.keys)
+	err = idx.writeHeader()
+
+	values := []string{}
+	for value, _ := range c.indexes[field].data {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+
+	for _, value := range values {
+		for _, entry := range c.indexes[field].data[value] {
+			if err == nil {
+				err = idx.append(entry)
 			}
 		}
+	}
+
+	// the new index file must be on disk before it replaces the old one.
+	if err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = c.db.fs.Rename(tmppath, c.indexpath+"/"+field)
+	}
+	if err != nil {
+		file.Close()
+		c.db.fs.Remove(tmppath)
+		return err
+	}
 
-		os.Rename(c.indexpath+"/."+field+".tmp", c.indexpath+"/"+field)
-		newf.Sync()
+	idx.dirty = false
+	c.indexes[field].file.Close()
+	c.indexes[field] = idx
+	return nil
+}
+
+// Vacuum expunges old entries that refer to deleted objects from all indexes 
+// of a collection.
+func (c *Collection) Vacuum() error {
+	if err := c.db.checkWritable(); err != nil {
+		return err
+	}
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	return c.vacuum()
+}
+
+func (c *Collection) vacuum() error {
+
+	for field, _ := range c.indexes {
+		if err := c.rewriteIndex(field); err != nil {
+			return err
+		}
 	}
 	return nil
 }
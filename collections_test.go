@@ -0,0 +1,69 @@
+package epos
+
+import (
+	"testing"
+)
+
+func TestDropRenameCopyCollection(t *testing.T) {
+	for _, typ := range []StorageType{STORAGE_DISKV, STORAGE_GOLEVELDB, STORAGE_MEMORY} {
+		db, err := OpenDatabase("testdb_colls", typ)
+		if err != nil {
+			t.Fatalf("%s: couldn't open testdb_colls: %v", typ, err)
+		}
+		books := db.Coll("books")
+		books.AddIndex("Author")
+		for _, book := range queryData {
+			books.Insert(book)
+		}
+
+		if err = db.CopyCollection("books", "copy"); err != nil {
+			t.Fatalf("%s: CopyCollection failed: %v", typ, err)
+		}
+		if err = db.CopyCollection("books", "copy"); err == nil {
+			t.Errorf("%s: CopyCollection overwrote an existing collection", typ)
+		}
+		copied := db.Coll("copy")
+		result, err := copied.Query(&Equals{Field: "Author", Value: "Aesop"})
+		if err != nil || result.Count() != 1 {
+			t.Errorf("%s: query on copied index failed (error: %v)", typ, err)
+		}
+		if id, _ := copied.Insert(&book{Title: "New"}); id != Id(len(queryData)+1) {
+			t.Errorf("%s: Insert into copy returned ID %d", typ, id)
+		}
+
+		if err = db.RenameCollection("books", "copy"); err == nil {
+			t.Errorf("%s: RenameCollection overwrote an existing collection", typ)
+		}
+		if err = db.RenameCollection("books", "renamed"); err != nil {
+			t.Fatalf("%s: RenameCollection failed: %v", typ, err)
+		}
+		renamed := db.Coll("renamed")
+		result, err = renamed.Query(&Equals{Field: "Author", Value: "Aesop"})
+		if err != nil || result.Count() != 1 {
+			t.Errorf("%s: query on renamed index failed (error: %v)", typ, err)
+		}
+		if result, _ = renamed.QueryAll(); result.Count() != len(queryData) {
+			t.Errorf("%s: renamed collection has %d objects", typ, result.Count())
+		}
+
+		if err = db.DropCollection("copy"); err != nil {
+			t.Fatalf("%s: DropCollection failed: %v", typ, err)
+		}
+		if err = db.DropCollection("copy"); err == nil {
+			t.Errorf("%s: dropping a nonexistent collection succeeded", typ)
+		}
+		if colls, _ := db.Collections(); len(colls) != 1 || colls[0] != "renamed" {
+			t.Errorf("%s: database has collections %v", typ, colls)
+		}
+		// a dropped collection is recreated empty.
+		if result, _ = db.Coll("copy").QueryAll(); result.Count() != 0 {
+			t.Errorf("%s: recreated collection has %d objects", typ, result.Count())
+		}
+		if result, err = db.Coll("copy").Query(&Equals{Field: "Author", Value: "Aesop"}); err == nil {
+			t.Errorf("%s: index of dropped collection still exists", typ)
+		}
+
+		db.Close()
+		db.Remove()
+	}
+}
@@ -0,0 +1,191 @@
+package epos
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+type Compression string
+
+const (
+	COMPRESSION_NONE   Compression = "none"
+	COMPRESSION_SNAPPY Compression = "snappy"
+	COMPRESSION_GZIP   Compression = "gzip"
+	COMPRESSION_ZSTD   Compression = "zstd"
+)
+
+// compressed values start with compressionMagic, followed by a byte that
+// identifies the compression algorithm. All other values are stored
+// uncompressed. JSON documents never start with a 0 byte, and the other
+// codecs encode structs and maps with a non-zero first byte, so they can't be
+// mistaken for compressed values.
+const compressionMagic = "\x00epz"
+
+var compressionIds = map[Compression]byte{
+	COMPRESSION_SNAPPY: 1,
+	COMPRESSION_GZIP:   2,
+	COMPRESSION_ZSTD:   3,
+}
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+)
+
+func initZstd() {
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+}
+
+func compress(comp Compression, data []byte) ([]byte, error) {
+	id, ok := compressionIds[comp]
+	if !ok {
+		return data, nil
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, len(data)/2+len(compressionMagic)+1))
+	buf.WriteString(compressionMagic)
+	buf.WriteByte(id)
+
+	switch comp {
+	case COMPRESSION_SNAPPY:
+		buf.Write(snappy.Encode(nil, data))
+	case COMPRESSION_GZIP:
+		w := gzip.NewWriter(buf)
+		w.Write(data)
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+	case COMPRESSION_ZSTD:
+		zstdOnce.Do(initZstd)
+		return zstdEncoder.EncodeAll(data, buf.Bytes()), nil
+	}
+	return buf.Bytes(), nil
+}
+
+func decompress(data []byte) ([]byte, error) {
+	if len(data) <= len(compressionMagic) || string(data[:len(compressionMagic)]) != compressionMagic {
+		return data, nil
+	}
+
+	id, payload := data[len(compressionMagic)], data[len(compressionMagic)+1:]
+	switch id {
+	case compressionIds[COMPRESSION_SNAPPY]:
+		return snappy.Decode(nil, payload)
+	case compressionIds[COMPRESSION_GZIP]:
+		r, err := gzip.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	case compressionIds[COMPRESSION_ZSTD]:
+		zstdOnce.Do(initZstd)
+		return zstdDecoder.DecodeAll(payload, nil)
+	}
+	return nil, fmt.Errorf("unknown compression algorithm %d", id)
+}
+
+// CompressedStorageBackend wraps another storage backend and compresses all
+// values before they are written to it. Values are tagged with the algorithm
+// they have been compressed with, so values that have been written with a
+// different algorithm or without compression can always be read.
+type CompressedStorageBackend struct {
+	wrappedStore
+	compression Compression
+}
+
+// NewCompressedStorageBackend returns a storage backend that compresses all
+// values with comp and writes them to store.
+func NewCompressedStorageBackend(store StorageBackend, comp Compression) (*CompressedStorageBackend, error) {
+	if err := checkCompression(comp); err != nil {
+		return nil, err
+	}
+	return &CompressedStorageBackend{wrappedStore: wrappedStore{store}, compression: comp}, nil
+}
+
+func checkCompression(comp Compression) error {
+	if _, ok := compressionIds[comp]; !ok && comp != COMPRESSION_NONE {
+		return fmt.Errorf("invalid compression %s", string(comp))
+	}
+	return nil
+}
+
+func (s *CompressedStorageBackend) encode(key string, value []byte) ([]byte, error) {
+	if isInternalKey(key) {
+		return value, nil
+	}
+	return compress(s.compression, value)
+}
+
+func (s *CompressedStorageBackend) decode(key string, data []byte) ([]byte, error) {
+	return decompress(data)
+}
+
+func (s *CompressedStorageBackend) Read(key string) ([]byte, error) {
+	data, err := s.store.Read(key)
+	if err != nil {
+		return nil, err
+	}
+	return decompress(data)
+}
+
+func (s *CompressedStorageBackend) Write(key string, value []byte) error {
+	data, err := s.encode(key, value)
+	if err != nil {
+		return err
+	}
+	return s.store.Write(key, data)
+}
+
+func (s *CompressedStorageBackend) WriteBatch(ops []BatchOp) error {
+	compressed := make([]BatchOp, len(ops))
+	for i, op := range ops {
+		compressed[i] = op
+		if !op.Erase {
+			var err error
+			if compressed[i].Value, err = s.encode(op.Key, op.Value); err != nil {
+				return err
+			}
+		}
+	}
+	return writeBatch(s.store, compressed)
+}
+
+func (s *CompressedStorageBackend) Range(start, end string) Iterator {
+	return &decodingIterator{Iterator: storeRange(s.store, start, end), decode: s.decode}
+}
+
+func (s *CompressedStorageBackend) ReadMany(keys []string) ([][]byte, error) {
+	return decodeMany(s.store, keys, s.decode)
+}
+
+// Recompress rewrites all objects of the collection compressed with comp,
+// which is also used for all objects that are written to the collection
+// afterwards. Values keep being readable while Recompress is running, and if
+// it is interrupted, it can simply be run again.
+func (c *Collection) Recompress(comp Compression) error {
+	if err := c.db.checkWritable(); err != nil {
+		return err
+	}
+	if err := checkCompression(comp); err != nil {
+		return err
+	}
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+
+	c.meta.Compression = comp
+	if err := c.db.writeCollMeta(c.name, c.meta); err != nil {
+		return err
+	}
+	c.compressed.compression = comp
+
+	return c.rewriteObjects()
+}
@@ -0,0 +1,59 @@
+package epos
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCompression(t *testing.T) {
+	for _, comp := range []Compression{COMPRESSION_SNAPPY, COMPRESSION_GZIP, COMPRESSION_ZSTD} {
+		db, err := OpenDatabaseWithOptions("testdb_compression", &Options{Type: STORAGE_DISKV, Compression: comp})
+		if err != nil {
+			t.Fatalf("%s: couldn't open testdb_compression: %v", comp, err)
+		}
+
+		books := db.Coll("books")
+		books.AddIndex("Author")
+		for i, book := range queryData {
+			if _, err := books.Insert(book); err != nil {
+				t.Errorf("%s: %d. Insert failed: %v", comp, i, err)
+			}
+		}
+
+		if raw, err := books.compressed.store.Read("1"); err != nil || !strings.HasPrefix(string(raw), compressionMagic) {
+			t.Errorf("%s: object hasn't been stored compressed: %q (error: %v)", comp, raw, err)
+		}
+		db.Close()
+
+		// the collection keeps its compression, no matter which compression
+		// the database is opened with.
+		db, err = OpenDatabase("testdb_compression", STORAGE_AUTO)
+		if err != nil {
+			t.Fatalf("%s: couldn't reopen testdb_compression: %v", comp, err)
+		}
+		books = db.Coll("books")
+		if books.compressed.compression != comp {
+			t.Errorf("%s: reopened collection uses compression %s", comp, books.compressed.compression)
+		}
+
+		if err = books.Recompress(COMPRESSION_NONE); err != nil {
+			t.Errorf("%s: Recompress failed: %v", comp, err)
+		}
+		if raw, err := books.compressed.store.Read("1"); err != nil || raw[0] != '{' {
+			t.Errorf("%s: object hasn't been decompressed: %q (error: %v)", comp, raw, err)
+		}
+
+		result, err := books.Query(&Equals{Field: "Author", Value: "Aesop"})
+		var b book
+		if err != nil || !result.Next(nil, &b) || b.Title != "Fables" {
+			t.Errorf("%s: query after Recompress returned %#v (error: %v)", comp, b, err)
+		}
+
+		db.Close()
+		db.Remove()
+	}
+
+	if _, err := OpenDatabaseWithOptions("testdb_compression", &Options{Compression: "lzma"}); err == nil {
+		t.Errorf("opening database with invalid compression succeeded")
+	}
+}
@@ -0,0 +1,109 @@
+package epos
+
+import (
+	"fmt"
+	"sort"
+)
+
+// matchIds returns the IDs of all existing objects that match cond, in
+// ascending order. db.mu must be held, at least for reading.
+func (c *Collection) matchIds(cond Condition) ([]Id, error) {
+	for _, field := range getFields(cond) {
+		if _, ok := c.indexes[field]; !ok {
+			return nil, fmt.Errorf("no index on field '%s'", field)
+		}
+	}
+
+	ids := []Id{}
+	for _, id := range cond.match(c.indexes) {
+		// ID conditions match IDs whether the objects exist or not.
+		if c.Exists(id) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Sort(byId(ids))
+	return ids, nil
+}
+
+// Upsert replaces all objects that match cond with value, or inserts value if
+// no object matches cond. It returns the IDs of the updated objects, or the
+// ID of the inserted object. Since other changes to the database wait until
+// Upsert is complete, concurrent Upserts with the same condition never insert
+// more than one object, and unique indexes are checked against the objects as
+// they are while Upsert runs. If value would violate a unique index, Upsert
+// fails with an error that wraps ErrDuplicate and changes nothing.
+func (c *Collection) Upsert(cond Condition, value interface{}) ([]Id, error) {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+
+	ids, err := c.matchIds(cond)
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		id, err := c.insert(value)
+		if err != nil {
+			return nil, err
+		}
+		return []Id{id}, nil
+	}
+	if err = c.updateWhere(ids, value); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// UpdateWhere replaces all objects that match cond with value in a single
+// batch, and returns their IDs. Either all or none of the objects are
+// updated; if the objects would violate a unique index, e.g. because more
+// than one object matches cond and value has a field with a unique index,
+// UpdateWhere fails with an error that wraps ErrDuplicate.
+func (c *Collection) UpdateWhere(cond Condition, value interface{}) ([]Id, error) {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+
+	ids, err := c.matchIds(cond)
+	if err != nil {
+		return nil, err
+	}
+	if err = c.updateWhere(ids, value); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+func (c *Collection) updateWhere(ids []Id, value interface{}) error {
+	if err := c.db.checkWritable(); err != nil {
+		return err
+	}
+	values := make([]interface{}, len(ids))
+	for i := range values {
+		values[i] = value
+	}
+	return c.updateMany(ids, values)
+}
+
+// DeleteWhere deletes all objects that match cond in a single batch, and
+// returns their IDs. Either all or none of the objects are deleted.
+func (c *Collection) DeleteWhere(cond Condition) ([]Id, error) {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+
+	if err := c.db.checkWritable(); err != nil {
+		return nil, err
+	}
+	ids, err := c.matchIds(cond)
+	if err != nil {
+		return nil, err
+	}
+	if err = c.deleteMany(ids); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+type byId []Id
+
+func (s byId) Len() int           { return len(s) }
+func (s byId) Less(i, j int) bool { return s[i] < s[j] }
+func (s byId) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
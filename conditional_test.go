@@ -0,0 +1,99 @@
+package epos
+
+import (
+	"testing"
+)
+
+type account struct {
+	Login string
+	Name  string
+	Group string
+}
+
+func TestUpsert(t *testing.T) {
+	db, err := OpenDatabase("testdb_upsert", STORAGE_AUTO)
+	if err != nil {
+		t.Fatalf("couldn't open testdb_upsert: %v", err)
+	}
+	defer db.Remove()
+	defer db.Close()
+	accounts := db.Coll("accounts")
+
+	if _, err = accounts.Upsert(&Equals{Field: "Login", Value: "alice"}, &account{Login: "alice"}); err == nil {
+		t.Errorf("Upsert without index succeeded")
+	}
+	accounts.AddIndex("Login")
+
+	ids, err := accounts.Upsert(&Equals{Field: "Login", Value: "alice"}, &account{Login: "alice", Name: "Alice"})
+	if err != nil || len(ids) != 1 || ids[0] != 1 {
+		t.Fatalf("Upsert of new object returned %v (error: %v)", ids, err)
+	}
+	ids, err = accounts.Upsert(&Equals{Field: "Login", Value: "alice"}, &account{Login: "alice", Name: "Alice Smith"})
+	if err != nil || len(ids) != 1 || ids[0] != 1 {
+		t.Fatalf("Upsert of existing object returned %v (error: %v)", ids, err)
+	}
+	var a account
+	result, _ := accounts.QueryId(1)
+	if !result.Next(nil, &a) || a.Name != "Alice Smith" {
+		t.Errorf("upserted object is %#v", a)
+	}
+
+	// concurrent Upserts of the same object insert it only once.
+	done := make(chan bool)
+	for i := 0; i < 10; i++ {
+		go func() {
+			if _, err := accounts.Upsert(&Equals{Field: "Login", Value: "bob"}, &account{Login: "bob"}); err != nil {
+				t.Errorf("concurrent Upsert failed: %v", err)
+			}
+			done <- true
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		<-done
+	}
+	if result, _ = accounts.QueryAll(); result.Count() != 2 {
+		t.Errorf("collection contains %d objects, expected 2", result.Count())
+	}
+}
+
+func TestUpdateDeleteWhere(t *testing.T) {
+	db, err := OpenDatabase("testdb_upsert", STORAGE_AUTO)
+	if err != nil {
+		t.Fatalf("couldn't open testdb_upsert: %v", err)
+	}
+	defer db.Remove()
+	defer db.Close()
+	accounts := db.Coll("accounts")
+	accounts.AddIndex("Group")
+	for _, a := range []*account{{"a", "A", "staff"}, {"b", "B", "guests"}, {"c", "C", "staff"}} {
+		accounts.Insert(a)
+	}
+
+	ids, err := accounts.UpdateWhere(&Equals{Field: "Group", Value: "staff"}, &account{Name: "Former", Group: "alumni"})
+	if err != nil || len(ids) != 2 || ids[0] != 1 || ids[1] != 3 {
+		t.Fatalf("UpdateWhere returned %v (error: %v)", ids, err)
+	}
+	if result, _ := accounts.Query(&Equals{Field: "Group", Value: "alumni"}); result.Count() != 2 {
+		t.Errorf("index hasn't been updated")
+	}
+	if ids, err = accounts.UpdateWhere(&Equals{Field: "Group", Value: "staff"}, &account{}); err != nil || len(ids) != 0 {
+		t.Errorf("UpdateWhere without matches returned %v (error: %v)", ids, err)
+	}
+
+	// IDs of objects that don't exist don't match.
+	id := Id(42)
+	if ids, err = accounts.UpdateWhere(&id, &account{}); err != nil || len(ids) != 0 {
+		t.Errorf("UpdateWhere of nonexistent object returned %v (error: %v)", ids, err)
+	}
+	if result, _ := accounts.QueryAll(); result.Count() != 3 {
+		t.Errorf("UpdateWhere of nonexistent object created it")
+	}
+
+	ids, err = accounts.DeleteWhere(&Or{&Equals{Field: "Group", Value: "alumni"}, &Equals{Field: "Group", Value: "guests"}})
+	if err != nil || len(ids) != 3 {
+		t.Fatalf("DeleteWhere returned %v (error: %v)", ids, err)
+	}
+	if result, _ := accounts.QueryAll(); result.Count() != 0 {
+		t.Errorf("collection contains %d objects after DeleteWhere", result.Count())
+	}
+}
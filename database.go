@@ -7,7 +7,7 @@
 // Here is a very basic overview how to use epos:
 //
 //	// open/create database:
-//	db, err := epos.OpenDatabase("foo.db", epos.STORAGE_AUTO) // also available: STORAGE_DISKV, STORAGE_LEVELDB
+//	db, err := epos.OpenDatabase("foo.db", epos.STORAGE_AUTO) // also available: STORAGE_DISKV, STORAGE_LEVELDB, STORAGE_GOLEVELDB, STORAGE_MEMORY, STORAGE_SINGLEFILE
 //	// insert item:
 //	id, err = db.Coll("users").Insert(new_user)
 //	// update item:
@@ -24,57 +24,202 @@ package epos
 
 import (
 	"fmt"
-	"io/ioutil"
+	"io"
 	"os"
+	"sync"
+	"time"
 )
 
 type Database struct {
 	path           string
+	fs             fileSystem
 	colls          map[string]*Collection
-	storageFactory func(path string) StorageBackend
+	storageFactory StorageFactory
+	wal            *wal
+	opts           *Options
+	last_sync      time.Time
+
+	// encrypting is set while an unencrypted database is encrypted by
+	// RotateKey, so that its unencrypted values can still be read.
+	encrypting bool
+
+	// stop_sync stops the goroutine that commits changes periodically.
+	stop_sync chan bool
+	syncer    sync.WaitGroup
+
+	// mu serializes all changes to objects and indexes and all commits,
+	// so that Backup can wait for a consistent state. Queries and reads
+	// that must be consistent with the indexes or the revisions hold it
+	// for reading. colls_mu protects colls.
+	mu       sync.RWMutex
+	colls_mu sync.Mutex
 }
 
 // OpenDatabase opens and if necessary creates a database identified by the
 // provided path. It returns a database object and a non-nil error if an
 // error occured while opening or creating the database.
 func OpenDatabase(path string, typ StorageType) (*Database, error) {
-	db := &Database{path: path, colls: make(map[string]*Collection)}
+	return OpenDatabaseWithOptions(path, &Options{Type: typ})
+}
+
+// OpenDatabaseWithOptions opens and if necessary creates a database identified
+// by the provided path, configured by opts. If opts is nil, the default options
+// are used.
+func OpenDatabaseWithOptions(path string, opts *Options) (*Database, error) {
+	opts = opts.withDefaults()
+	typ := opts.Type
+	if err := checkCompression(opts.Compression); err != nil {
+		return nil, err
+	}
+	if _, err := getCodec(opts.Codec); err != nil {
+		return nil, err
+	}
+	keys, err := newKeyring(opts.EncryptionKey, opts.OldEncryptionKeys)
+	if err != nil {
+		return nil, err
+	}
+	opts.keys = keys
+	db := &Database{path: path, colls: make(map[string]*Collection), opts: opts, last_sync: time.Now()}
+
+	// an in-memory database keeps everything in memory, not just the objects,
+	// and a single-file database keeps everything in its database file.
+	if typ == STORAGE_MEMORY {
+		db.fs = newMemFS()
+	} else if fi, err := os.Stat(path); (err == nil && !fi.IsDir()) || (os.IsNotExist(err) && typ == STORAGE_SINGLEFILE) {
+		pfs, err := openPageFS(path, opts)
+		if err != nil {
+			return nil, err
+		}
+		db.fs = pfs
+	} else {
+		db.fs = osFS{}
+	}
+	opts.fs = db.fs
 
 	for _, p := range []string{path, path + "/colls", path + "/indexes"} {
-		if _, err := os.Stat(p); err != nil {
-			if err := os.Mkdir(p, 0755); err != nil {
+		if _, err := db.fs.Stat(p); err != nil {
+			if opts.ReadOnly {
+				db.closeFS()
+				return nil, err
+			}
+			if err := db.fs.Mkdir(p, opts.DirMode); err != nil {
+				db.closeFS()
 				return nil, err
 			}
 		}
 	}
 
+	// new databases use the pure-Go LevelDB implementation by default.
+	// Existing databases keep using the storage type they were created
+	// with, as recorded in their engine file.
 	if typ == STORAGE_AUTO {
-		typ = STORAGE_LEVELDB
+		typ = STORAGE_GOLEVELDB
 	}
 
 	write_storage := false
-	storage_type, err := ioutil.ReadFile(db.path + "/engine")
+	storage_type, err := readFile(db.fs, db.path+"/engine")
 	if err == nil {
-		db.storageFactory = storageBackends[StorageType(storage_type)]
+		typ = StorageType(storage_type)
+	} else if opts.ReadOnly {
+		db.closeFS()
+		return nil, err
 	} else {
-		db.storageFactory = storageBackends[typ]
 		write_storage = true
 	}
 
+	db.storageFactory = storageBackends[typ]
 	if db.storageFactory == nil {
-		return nil, fmt.Errorf("invalid storage type %s", string(storage_type))
+		db.closeFS()
+		return nil, fmt.Errorf("invalid storage type %s", string(typ))
 	}
 
 	if write_storage {
-		ioutil.WriteFile(db.path+"/engine", []byte(typ), 0644)
+		writeFile(db.fs, db.path+"/engine", []byte(typ), opts.FileMode)
+	}
+
+	if err = db.checkKey(); err != nil {
+		db.closeFS()
+		return nil, err
+	}
+	if _, err = db.fs.Stat(db.path + "/encrypting"); err == nil {
+		db.encrypting = true
+	}
+
+	if db.wal, err = openWAL(db.fs, db.path+"/wal", opts); err != nil {
+		db.closeFS()
+		return nil, err
+	}
+
+	// bring storage and indexes back into a consistent state after a crash.
+	if err = db.recover(); err != nil {
+		db.wal.Close()
+		db.closeFS()
+		return nil, err
+	}
+
+	if opts.Durability == DURABILITY_PERIODIC && !opts.ReadOnly {
+		db.stop_sync = make(chan bool)
+		db.syncer.Add(1)
+		go db.syncPeriodically()
 	}
 
 	return db, nil
 }
 
-// Close closes the database and frees the memory associated with all collections.
+// syncPeriodically commits all changes once per SyncInterval, until Close is
+// called.
+func (db *Database) syncPeriodically() {
+	defer db.syncer.Done()
+	ticker := time.NewTicker(db.opts.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			db.mu.Lock()
+			if err := db.sync(); err != nil {
+				db.opts.Logger.Printf("syncPeriodically: committing database failed: %v", err)
+			}
+			db.mu.Unlock()
+		case <-db.stop_sync:
+			return
+		}
+	}
+}
+
+// Close commits all pending changes, closes all collections and releases all
+// resources associated with the database. If errors occur, Close still
+// releases everything it can, and returns all errors as a MultiError.
 func (db *Database) Close() error {
+	if db.stop_sync != nil {
+		close(db.stop_sync)
+		db.syncer.Wait()
+	}
+
+	var errs MultiError
+	db.mu.Lock()
+	err := db.sync()
+	db.mu.Unlock()
+	if err != nil {
+		errs.add(err)
+	} else if db.opts.Type == STORAGE_MEMORY && db.opts.SnapshotPath != "" {
+		errs.add(db.snapshot())
+	}
+	for _, coll := range db.openColls() {
+		errs.add(coll.Close())
+	}
+	db.colls_mu.Lock()
 	db.colls = nil
+	db.colls_mu.Unlock()
+	errs.add(db.wal.Close())
+	errs.add(db.closeFS())
+	return errs.err()
+}
+
+// closeFS closes the database's fileSystem if it needs to be closed.
+func (db *Database) closeFS() error {
+	if closer, ok := db.fs.(io.Closer); ok {
+		return closer.Close()
+	}
 	return nil
 }
 
@@ -82,32 +227,33 @@ func (db *Database) Close() error {
 // have proper backups or snapshots from your filesystem, this operation is 
 // irreversible and leads to permanent data loss.
 func (db *Database) Remove() error {
-	return os.RemoveAll(db.path)
+	return db.fs.RemoveAll(db.path)
 }
 
 // Coll returns the collection of the specified name. If the collection doesn't
-// exist yet, it is opened and/or created on the fly.
+// exist yet, it is opened and/or created on the fly. If the collection can't
+// be opened, Coll panics; use CollE to handle such errors.
 func (db *Database) Coll(name string) *Collection {
-	coll := db.colls[name]
-	if coll == nil {
-		coll = db.openColl(name)
-		db.colls[name] = coll
+	coll, err := db.CollE(name)
+	if err != nil {
+		panic(err)
 	}
 	return coll
 }
 
+// CollE returns the collection of the specified name. If the collection doesn't
+// exist yet, it is opened and/or created on the fly. It returns a non-nil error
+// if the collection's storage backend or indexes couldn't be opened.
+func (db *Database) CollE(name string) (*Collection, error) {
+	return db.CollWithOptions(name, nil)
+}
+
 // Collections returns a list of collection names that are currently in
 // the database.
 func (db *Database) Collections() ([]string, error) {
-	dir, err := os.Open(db.path + "/colls")
-	if err != nil {
-		return nil, err
-	}
-	defer dir.Close()
-
 	colls := []string{}
 
-	fi, err := dir.Readdir(0)
+	fi, err := db.fs.ReadDir(db.path + "/colls")
 
 	if err != nil {
 		return nil, err
@@ -122,10 +268,214 @@ func (db *Database) Collections() ([]string, error) {
 	return colls, nil
 }
 
+// openColls returns all collections that are currently open.
+func (db *Database) openColls() []*Collection {
+	db.colls_mu.Lock()
+	defer db.colls_mu.Unlock()
+	colls := make([]*Collection, 0, len(db.colls))
+	for _, coll := range db.colls {
+		colls = append(colls, coll)
+	}
+	return colls
+}
+
+// collExists returns true if a collection of the specified name exists.
+func (db *Database) collExists(name string) bool {
+	_, err := db.fs.Stat(db.path + "/colls/" + name)
+	return err == nil
+}
+
+// closeColl commits all pending changes to the collection of the specified
+// name and closes it, if it is open. db.colls_mu must be held.
+func (db *Database) closeColl(name string) error {
+	coll := db.colls[name]
+	if coll == nil {
+		return nil
+	}
+	var errs MultiError
+	errs.add(coll.sync())
+	errs.add(coll.close())
+	delete(db.colls, name)
+	return errs.err()
+}
+
+// DropCollection removes a collection with all its objects and indexes from
+// the database. If the collection is open, it is closed first, and it must not
+// be used afterwards.
+func (db *Database) DropCollection(name string) error {
+	if err := db.checkWritable(); err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	// the write-ahead log must not refer to the collection anymore.
+	if err := db.sync(); err != nil {
+		return err
+	}
+	db.colls_mu.Lock()
+	defer db.colls_mu.Unlock()
+
+	if !db.collExists(name) {
+		return fmt.Errorf("collection %s doesn't exist", name)
+	}
+	if err := db.closeColl(name); err != nil {
+		return err
+	}
+	// the metadata is removed last, so that a collection whose removal
+	// failed half-way is still opened with the right codec.
+	for _, dir := range []string{"/colls/", "/indexes/", "/meta/"} {
+		if err := db.fs.RemoveAll(db.path + dir + name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RenameCollection renames a collection. The collection newname must not
+// exist yet. If the collection is open, it is closed first, and it must not be
+// used afterwards; Coll(newname) opens it under its new name.
+func (db *Database) RenameCollection(oldname, newname string) error {
+	if err := db.checkWritable(); err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	// the write-ahead log must not refer to the collection anymore.
+	if err := db.sync(); err != nil {
+		return err
+	}
+	db.colls_mu.Lock()
+	defer db.colls_mu.Unlock()
+
+	if !db.collExists(oldname) {
+		return fmt.Errorf("collection %s doesn't exist", oldname)
+	}
+	if db.collExists(newname) {
+		return fmt.Errorf("collection %s already exists", newname)
+	}
+	if err := db.closeColl(oldname); err != nil {
+		return err
+	}
+	// the objects are renamed last, and if anything fails, everything
+	// that has already been renamed is renamed back.
+	renamed := []string{}
+	for _, dir := range []string{"/meta/", "/indexes/", "/colls/"} {
+		err := db.fs.Rename(db.path+dir+oldname, db.path+dir+newname)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			for _, dir := range renamed {
+				db.fs.Rename(db.path+dir+newname, db.path+dir+oldname)
+			}
+			return err
+		}
+		renamed = append(renamed, dir)
+	}
+	return nil
+}
+
+// CopyCollection copies a collection with all its objects and indexes to a
+// new collection dst, which is created with the same options. The copy is
+// consistent: changes to the database wait until it is complete. If copying
+// fails, dst is removed again.
+func (db *Database) CopyCollection(src, dst string) error {
+	if err := db.checkWritable(); err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if !db.collExists(src) {
+		return fmt.Errorf("collection %s doesn't exist", src)
+	}
+	if db.collExists(dst) {
+		return fmt.Errorf("collection %s already exists", dst)
+	}
+	from, err := db.CollE(src)
+	if err != nil {
+		return err
+	}
+	to, err := db.CollWithOptions(dst, from.Options())
+	if err != nil {
+		return err
+	}
+	if err = from.copyTo(to); err == nil {
+		err = to.sync()
+	}
+	if err != nil {
+		db.colls_mu.Lock()
+		db.closeColl(dst)
+		for _, dir := range []string{"/colls/", "/indexes/", "/meta/"} {
+			db.fs.RemoveAll(db.path + dir + dst)
+		}
+		db.colls_mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// checkWritable returns ErrReadOnly if the database has been opened read-only.
+func (db *Database) checkWritable() error {
+	if db.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	return nil
+}
+
+// commit makes the changes to c durable, as configured by the database's
+// durability. Until then, the changes are kept in the write-ahead log.
+func (db *Database) commit(c *Collection) error {
+	c.dirty = true
+
+	switch db.opts.Durability {
+	case DURABILITY_SYNC:
+		return db.sync()
+	case DURABILITY_PERIODIC:
+		if time.Since(db.last_sync) >= db.opts.SyncInterval {
+			return db.sync()
+		}
+	}
+	if db.wal.size >= walCheckpointSize {
+		return db.sync()
+	}
+	return nil
+}
+
+// sync commits all changes to all open collections to stable storage, and
+// clears the write-ahead log afterwards. db.mu must be held, unless no other
+// goroutine can use the database.
+func (db *Database) sync() error {
+	if err := db.wal.Sync(); err != nil {
+		return err
+	}
+	for _, coll := range db.openColls() {
+		if err := coll.sync(); err != nil {
+			return err
+		}
+	}
+	db.last_sync = time.Now()
+	return db.wal.Clear()
+}
+
+// abort is called when a logged change has failed, and has been undone as far
+// as possible. The change must not be replayed, so the current state is
+// committed and the write-ahead log is cleared.
+func (db *Database) abort() {
+	if err := db.sync(); err != nil {
+		db.opts.Logger.Printf("abort: committing database failed: %v", err)
+	}
+}
+
 // Vacuum calls Vacuum on all open collections.
 func (db *Database) Vacuum() error {
-	for _, coll := range db.colls {
-		if err := coll.Vacuum(); err != nil {
+	if err := db.checkWritable(); err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for _, coll := range db.openColls() {
+		if err := coll.vacuum(); err != nil {
 			return err
 		}
 	}
@@ -3,10 +3,14 @@ package epos
 import (
 	"fmt"
 	"github.com/peterbourgon/diskv"
+	"os"
+	"path/filepath"
 )
 
 type DiskvStorageBackend struct {
 	store *diskv.Diskv
+	path  string
+	dirty map[string]bool
 }
 
 func transformFunc(s string) []string {
@@ -25,30 +29,96 @@ func transformFunc(s string) []string {
 	return []string{data[2:4], data[0:2]}
 }
 
-func NewDiskvStorageBackend(path string) StorageBackend {
+func NewDiskvStorageBackend(path string, opts *Options) (StorageBackend, error) {
 	diskv := &DiskvStorageBackend{
+		path:  path,
+		dirty: make(map[string]bool),
 		store: diskv.New(diskv.Options{
 			BasePath:     path,
 			Transform:    transformFunc,
-			CacheSizeMax: 0, // no cache
+			CacheSizeMax: opts.DiskvCacheSize,
 		}),
 	}
 
-	return diskv
+	return diskv, nil
 }
 
 func (s *DiskvStorageBackend) Read(key string) ([]byte, error) {
-	return s.store.Read(key)
+	data, err := s.store.Read(key)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return data, err
 }
 
 func (s *DiskvStorageBackend) Write(key string, value []byte) error {
+	s.dirty[key] = true
 	return s.store.Write(key, value)
 }
 
 func (s *DiskvStorageBackend) Erase(key string) error {
+	s.dirty[key] = true
 	return s.store.Erase(key)
 }
 
+// Sync commits all files that have been written or erased since the last
+// Sync, as well as their directories, to stable storage.
+func (s *DiskvStorageBackend) Sync() error {
+	dirs := make(map[string]bool)
+	for key, _ := range s.dirty {
+		file := filepath.Join(append(append([]string{s.path}, transformFunc(key)...), key)...)
+		if err := syncPath(file); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		dirs[filepath.Dir(file)] = true
+	}
+	for dir, _ := range dirs {
+		if err := syncPath(dir); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	s.dirty = make(map[string]bool)
+	return nil
+}
+
+func syncPath(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// WriteBatch applies all operations of the batch in order. diskv has no
+// native batches, so atomicity is only provided by the write-ahead log.
+func (s *DiskvStorageBackend) WriteBatch(ops []BatchOp) error {
+	for _, op := range ops {
+		var err error
+		s.dirty[op.Key] = true
+		if op.Erase {
+			err = s.store.Erase(op.Key)
+		} else {
+			err = s.store.Write(op.Key, op.Value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close does nothing, as diskv keeps no open files.
+func (s *DiskvStorageBackend) Close() error {
+	return nil
+}
+
 func (s *DiskvStorageBackend) Keys() <-chan string {
 	return s.store.Keys()
 }
+
+// Range iterates over a range of keys. diskv doesn't keep its keys in order,
+// so all keys are sorted first.
+func (s *DiskvStorageBackend) Range(start, end string) Iterator {
+	return newSortedIterator(s, start, end)
+}
@@ -0,0 +1,339 @@
+package epos
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+// ErrWrongKey is returned when an encrypted database is opened without the
+// key it has been encrypted with.
+var ErrWrongKey = errors.New("wrong or missing encryption key")
+
+// encrypted values start with encryptionMagic, followed by the ID of the key
+// they have been encrypted with, the nonce and the ciphertext. All other
+// values are stored unencrypted.
+const (
+	encryptionMagic = "\x00epe"
+	keyIdLen        = 4
+	keyCheckText    = "epos"
+)
+
+// keyring holds the key that is used for encryption, and all keys that can
+// be used for decryption, identified by their key IDs. For each key, it also
+// holds a secret derived from the key, which is used to compute MACs.
+type keyring struct {
+	current string
+	keys    map[string]cipher.AEAD
+	secrets map[string][]byte
+}
+
+// newKeyring returns a keyring that encrypts with key. It returns nil if key
+// is nil, i.e. if encryption is disabled.
+func newKeyring(key []byte, oldKeys [][]byte) (*keyring, error) {
+	if key == nil {
+		return nil, nil
+	}
+	k := &keyring{current: keyId(key), keys: make(map[string]cipher.AEAD), secrets: make(map[string][]byte)}
+	for _, key := range append([][]byte{key}, oldKeys...) {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		k.keys[keyId(key)] = aead
+		secret := sha256.Sum256(append([]byte("epos mac secret:"), key...))
+		k.secrets[keyId(key)] = secret[:]
+	}
+	return k, nil
+}
+
+// keyId derives the ID of a key, which only serves to find the right key for
+// decryption and reveals nothing about the key itself.
+func keyId(key []byte) string {
+	sum := sha256.Sum256(append([]byte("epos key id:"), key...))
+	return string(sum[:keyIdLen])
+}
+
+// seal encrypts and authenticates plaintext and additional data with the
+// current key.
+func (k *keyring) seal(plaintext, data []byte) []byte {
+	aead := k.keys[k.current]
+	nonce := make([]byte, aead.NonceSize())
+	rand.Read(nonce)
+
+	sealed := make([]byte, 0, keyIdLen+len(nonce)+len(plaintext)+aead.Overhead())
+	sealed = append(sealed, k.current...)
+	sealed = append(sealed, nonce...)
+	return aead.Seal(sealed, nonce, plaintext, data)
+}
+
+// open decrypts what has been sealed with any of the keys in the keyring.
+func (k *keyring) open(sealed, data []byte) ([]byte, error) {
+	if len(sealed) < keyIdLen {
+		return nil, errors.New("encrypted data is too short")
+	}
+	aead, ok := k.keys[string(sealed[:keyIdLen])]
+	if !ok {
+		return nil, ErrWrongKey
+	}
+	sealed = sealed[keyIdLen:]
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("encrypted data is too short")
+	}
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], data)
+	if err != nil {
+		return nil, fmt.Errorf("decryption failed: %v", err)
+	}
+	return plaintext, nil
+}
+
+// mac returns the HMAC-SHA256 of data with the secret of the key with the
+// specified key ID.
+func (k *keyring) mac(id string, data []byte) []byte {
+	h := hmac.New(sha256.New, k.secrets[id])
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// ids returns the IDs of all keys in the keyring, starting with the current
+// key.
+func (k *keyring) ids() []string {
+	ids := []string{k.current}
+	for id := range k.keys {
+		if id != k.current {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// merge adds all keys of other that k doesn't know yet.
+func (k *keyring) merge(other *keyring) {
+	if other == nil {
+		return
+	}
+	for id, aead := range other.keys {
+		if _, exists := k.keys[id]; !exists {
+			k.keys[id] = aead
+			k.secrets[id] = other.secrets[id]
+		}
+	}
+}
+
+func isEncrypted(data []byte) bool {
+	return len(data) >= len(encryptionMagic) && string(data[:len(encryptionMagic)]) == encryptionMagic
+}
+
+// EncryptedStorageBackend wraps another storage backend and encrypts all
+// values with AES-GCM before they are written to it. Every value is bound to
+// its key, so values can't be swapped undetected, and values that aren't
+// encrypted are rejected with a CorruptError, so they can't be replaced by
+// unencrypted values either.
+type EncryptedStorageBackend struct {
+	wrappedStore
+	keys *keyring
+	name string // the name of the collection, for error messages.
+
+	// plaintext allows reading unencrypted values while RotateKey
+	// encrypts a database for the first time.
+	plaintext bool
+}
+
+// NewEncryptedStorageBackend returns a storage backend that encrypts all
+// values with key, which must be 16, 24 or 32 bytes long, and writes them to
+// store. Values that have been encrypted with one of oldKeys can still be
+// read.
+func NewEncryptedStorageBackend(store StorageBackend, key []byte, oldKeys ...[]byte) (*EncryptedStorageBackend, error) {
+	if key == nil {
+		return nil, errors.New("no encryption key")
+	}
+	keys, err := newKeyring(key, oldKeys)
+	if err != nil {
+		return nil, err
+	}
+	return &EncryptedStorageBackend{wrappedStore: wrappedStore{store}, keys: keys}, nil
+}
+
+func (s *EncryptedStorageBackend) encode(key string, value []byte) []byte {
+	if isInternalKey(key) {
+		return value
+	}
+	return append([]byte(encryptionMagic), s.keys.seal(value, []byte(key))...)
+}
+
+func (s *EncryptedStorageBackend) decode(key string, data []byte) ([]byte, error) {
+	if !isEncrypted(data) {
+		if s.plaintext || isInternalKey(key) {
+			return data, nil
+		}
+		return nil, &CorruptError{Collection: s.name, Key: key, Reason: "value is not encrypted"}
+	}
+	value, err := s.keys.open(data[len(encryptionMagic):], []byte(key))
+	if err != nil {
+		return nil, fmt.Errorf("reading %s failed: %v", key, err)
+	}
+	return value, nil
+}
+
+func (s *EncryptedStorageBackend) Read(key string) ([]byte, error) {
+	data, err := s.store.Read(key)
+	if err != nil {
+		return nil, err
+	}
+	return s.decode(key, data)
+}
+
+func (s *EncryptedStorageBackend) Write(key string, value []byte) error {
+	return s.store.Write(key, s.encode(key, value))
+}
+
+func (s *EncryptedStorageBackend) WriteBatch(ops []BatchOp) error {
+	encrypted := make([]BatchOp, len(ops))
+	for i, op := range ops {
+		encrypted[i] = op
+		if !op.Erase {
+			encrypted[i].Value = s.encode(op.Key, op.Value)
+		}
+	}
+	return writeBatch(s.store, encrypted)
+}
+
+func (s *EncryptedStorageBackend) Range(start, end string) Iterator {
+	return &decodingIterator{Iterator: storeRange(s.store, start, end), decode: s.decode}
+}
+
+func (s *EncryptedStorageBackend) ReadMany(keys []string) ([][]byte, error) {
+	return decodeMany(s.store, keys, s.decode)
+}
+
+// checkKey verifies that the database can be decrypted with the configured
+// keys. The key check record is a known text encrypted with the current key;
+// it is created when a key is configured for the first time.
+func (db *Database) checkKey() error {
+	data, err := readFile(db.fs, db.path+"/keycheck")
+	if err != nil {
+		if db.opts.keys == nil || db.opts.ReadOnly {
+			return nil
+		}
+		return db.writeKeyCheck()
+	}
+
+	if db.opts.keys == nil || !isEncrypted(data) {
+		return ErrWrongKey
+	}
+	if text, err := db.opts.keys.open(data[len(encryptionMagic):], nil); err != nil || string(text) != keyCheckText {
+		return ErrWrongKey
+	}
+	return nil
+}
+
+func (db *Database) writeKeyCheck() error {
+	data := append([]byte(encryptionMagic), db.opts.keys.seal([]byte(keyCheckText), nil)...)
+	tmppath := db.path + "/.keycheck.tmp"
+	if err := writeFile(db.fs, tmppath, data, db.opts.FileMode); err != nil {
+		return err
+	}
+	return db.fs.Rename(tmppath, db.path+"/keycheck")
+}
+
+// RotateKey re-encrypts all objects and indexes of the database with a new
+// key, which must then be used to open the database. If the database isn't
+// encrypted yet, RotateKey encrypts it.
+//
+// If RotateKey is interrupted, the database must be opened with the new key
+// and the previous key in OldEncryptionKeys, and RotateKey must be run again.
+// Until then, unencrypted values of a database that is encrypted for the first
+// time can still be read.
+// LevelDB only removes the files that contain the data encrypted with the
+// previous key when the database is opened the next time.
+func (db *Database) RotateKey(key []byte) error {
+	if err := db.checkWritable(); err != nil {
+		return err
+	}
+
+	keys, err := newKeyring(key, nil)
+	if err != nil {
+		return err
+	}
+	if keys == nil {
+		return errors.New("no encryption key")
+	}
+	keys.merge(db.opts.keys)
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// the write-ahead log is cleared before its key changes.
+	if err = db.sync(); err != nil {
+		return err
+	}
+
+	// a database that is encrypted for the first time is marked, so that
+	// its unencrypted values stay readable until they have all been
+	// encrypted, even if RotateKey is interrupted.
+	if db.opts.keys == nil {
+		if err = writeFile(db.fs, db.path+"/encrypting", nil, db.opts.FileMode); err != nil {
+			return err
+		}
+		db.encrypting = true
+	}
+
+	// all collections are opened again, so that they use the new key.
+	var errs MultiError
+	for _, coll := range db.openColls() {
+		errs.add(coll.closeAndForget())
+	}
+	if err = errs.err(); err != nil {
+		return err
+	}
+	db.opts.EncryptionKey = key
+	db.opts.keys = keys
+	db.wal.keys = keys
+
+	colls, err := db.Collections()
+	if err != nil {
+		return err
+	}
+	for _, name := range colls {
+		coll, err := db.CollE(name)
+		if err != nil {
+			return err
+		}
+		if err = coll.rewriteKeys(); err != nil {
+			return err
+		}
+		if err = coll.rewriteObjects(); err != nil {
+			return err
+		}
+		for field, _ := range coll.indexes {
+			if err = coll.rewriteIndex(field); err != nil {
+				return err
+			}
+		}
+		if err = coll.sync(); err != nil {
+			return err
+		}
+	}
+
+	if err = db.writeKeyCheck(); err != nil {
+		return err
+	}
+	if db.encrypting {
+		if err = db.fs.Remove(db.path + "/encrypting"); err != nil {
+			return err
+		}
+		db.encrypting = false
+		for _, coll := range db.openColls() {
+			coll.encrypted.plaintext = false
+		}
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+package epos
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// containsPlaintext returns whether any file of the database at path
+// contains text.
+func containsPlaintext(t *testing.T, path, text string) bool {
+	found := false
+	filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatalf("couldn't read %s: %v", path, err)
+		}
+		if bytes.Contains(data, []byte(text)) {
+			t.Logf("%s contains %q", path, text)
+			found = true
+		}
+		return nil
+	})
+	return found
+}
+
+func TestEncryption(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	newkey := []byte("fedcba9876543210")
+
+	db, err := OpenDatabaseWithOptions("testdb_encryption", &Options{Type: STORAGE_DISKV, EncryptionKey: key})
+	if err != nil {
+		t.Fatalf("couldn't open testdb_encryption: %v", err)
+	}
+	persons := db.Coll("persons")
+	persons.AddIndex("X")
+	persons.Insert(entry{X: "john.doe@example.com", Y: 23})
+	persons.Insert(entry{X: "jan.maier@example.com", Y: 42})
+	persons.Delete(2)
+	db.Close()
+
+	if containsPlaintext(t, "testdb_encryption", "example.com") {
+		t.Errorf("database contains plaintext")
+	}
+
+	for _, wrongkey := range [][]byte{nil, newkey} {
+		if _, err = OpenDatabaseWithOptions("testdb_encryption", &Options{EncryptionKey: wrongkey}); err != ErrWrongKey {
+			t.Errorf("opening database with key %q returned %v, expected ErrWrongKey", wrongkey, err)
+		}
+	}
+
+	db, err = OpenDatabaseWithOptions("testdb_encryption", &Options{EncryptionKey: key})
+	if err != nil {
+		t.Fatalf("couldn't reopen testdb_encryption: %v", err)
+	}
+	result, err := db.Coll("persons").Query(&Equals{Field: "X", Value: "john.doe@example.com"})
+	var e entry
+	if err != nil || !result.Next(nil, &e) || e.Y != 23 {
+		t.Errorf("query on encrypted database returned %#v (error: %v)", e, err)
+	}
+
+	if err = db.RotateKey(newkey); err != nil {
+		t.Errorf("RotateKey failed: %v", err)
+	}
+	db.Coll("persons").Insert(entry{X: "jane.doe@example.com", Y: 31})
+	db.Close()
+
+	if _, err = OpenDatabaseWithOptions("testdb_encryption", &Options{EncryptionKey: key}); err != ErrWrongKey {
+		t.Errorf("opening database with the old key returned %v, expected ErrWrongKey", err)
+	}
+
+	db, err = OpenDatabaseWithOptions("testdb_encryption", &Options{EncryptionKey: newkey})
+	if err != nil {
+		t.Fatalf("couldn't open testdb_encryption with the new key: %v", err)
+	}
+	for _, x := range []string{"john.doe@example.com", "jane.doe@example.com"} {
+		result, err := db.Coll("persons").Query(&Equals{Field: "X", Value: x})
+		if err != nil || result.Count() != 1 {
+			t.Errorf("query for %s after RotateKey failed (error: %v)", x, err)
+		}
+	}
+	db.Close()
+
+	// the objects that have been encrypted with the old key must be
+	// unreadable with the new key alone.
+	store, _ := NewDiskvStorageBackend("testdb_encryption/colls/persons", (&Options{}).withDefaults())
+	encrypted, _ := NewEncryptedStorageBackend(NewChecksummedStorageBackend(store), key)
+	if _, err = encrypted.Read("1"); err == nil {
+		t.Errorf("object can still be read with the old key")
+	}
+
+	db.Remove()
+}
+
+func TestEncryptUnencryptedDatabase(t *testing.T) {
+	db, err := OpenDatabase("testdb_encryption", STORAGE_AUTO)
+	if err != nil {
+		t.Fatalf("couldn't open testdb_encryption: %v", err)
+	}
+	db.Coll("persons").AddIndex("X")
+	db.Coll("persons").Insert(entry{X: "john.doe@example.com", Y: 23})
+
+	if err = db.RotateKey([]byte("0123456789abcdef")); err != nil {
+		t.Errorf("RotateKey failed: %v", err)
+	}
+	db.Close()
+
+	db, err = OpenDatabaseWithOptions("testdb_encryption", &Options{EncryptionKey: []byte("0123456789abcdef")})
+	if err != nil {
+		t.Fatalf("couldn't open encrypted testdb_encryption: %v", err)
+	}
+	result, err := db.Coll("persons").Query(&Equals{Field: "X", Value: "john.doe@example.com"})
+	var e entry
+	if err != nil || !result.Next(nil, &e) || e.Y != 23 {
+		t.Errorf("query on encrypted database returned %#v (error: %v)", e, err)
+	}
+	db.Close()
+
+	// LevelDB removes the files with the unencrypted objects when the
+	// database is opened again.
+	if containsPlaintext(t, "testdb_encryption", "example.com") {
+		t.Errorf("database contains plaintext after encrypting it")
+	}
+	db.Remove()
+}
+
+func TestEncryptedKeys(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	newkey := []byte("fedcba9876543210")
+	hexkey := hex.EncodeToString([]byte("example.com"))
+
+	db, err := OpenDatabase("testdb_encryption", STORAGE_DISKV)
+	if err != nil {
+		t.Fatalf("couldn't open testdb_encryption: %v", err)
+	}
+	persons, _ := db.CollWithOptions("persons", &CollectionOptions{IdStrategy: ID_KEY})
+	persons.InsertWithKey("john.doe@example.com", entry{X: "John", Y: 23})
+	if err = db.RotateKey(key); err != nil {
+		t.Errorf("RotateKey failed: %v", err)
+	}
+	persons = db.Coll("persons")
+	id, _ := persons.InsertWithKey("jan.maier@example.com", entry{X: "Jan", Y: 42})
+	persons.Delete(id)
+	db.Close()
+
+	if containsPlaintext(t, "testdb_encryption", "example.com") || containsPlaintext(t, "testdb_encryption", hexkey) {
+		t.Errorf("database contains plaintext keys")
+	}
+	// diskv stores each value in a file named after its key.
+	filepath.Walk("testdb_encryption", func(path string, info os.FileInfo, err error) error {
+		if err == nil && strings.Contains(info.Name(), hexkey) {
+			t.Errorf("database contains file %s named after a plaintext key", path)
+		}
+		return err
+	})
+
+	for _, k := range [][]byte{key, newkey} {
+		db, err = OpenDatabaseWithOptions("testdb_encryption", &Options{EncryptionKey: k})
+		if err != nil {
+			t.Fatalf("couldn't open testdb_encryption: %v", err)
+		}
+		persons = db.Coll("persons")
+		if id, err = persons.Lookup("john.doe@example.com"); err != nil || id != 1 {
+			t.Errorf("Lookup returned %d (error: %v)", id, err)
+		}
+		if key, err := persons.Key(1); err != nil || key != "john.doe@example.com" {
+			t.Errorf("Key returned %q (error: %v)", key, err)
+		}
+		if _, err = persons.Lookup("jan.maier@example.com"); err != ErrNotFound {
+			t.Errorf("Lookup of deleted object returned %v", err)
+		}
+		if bytes.Equal(k, key) {
+			if err = db.RotateKey(newkey); err != nil {
+				t.Errorf("RotateKey failed: %v", err)
+			}
+		}
+		db.Close()
+	}
+
+	db.Remove()
+}
+
+func TestUnencryptedValueRejected(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	db, err := OpenDatabase("testdb_encryption", STORAGE_DISKV)
+	if err != nil {
+		t.Fatalf("couldn't open testdb_encryption: %v", err)
+	}
+	defer db.Remove()
+	db.Coll("persons").Insert(entry{X: "john.doe@example.com", Y: 23})
+	if err = db.RotateKey(key); err != nil {
+		t.Errorf("RotateKey failed: %v", err)
+	}
+	db.Close()
+	if _, err = os.Stat("testdb_encryption/encrypting"); err == nil {
+		t.Errorf("database is still marked as being encrypted")
+	}
+
+	// replace the encrypted object with an unencrypted one.
+	store, _ := NewDiskvStorageBackend("testdb_encryption/colls/persons", (&Options{}).withDefaults())
+	NewChecksummedStorageBackend(store).Write("1", []byte(`{"X":"jan.maier@example.com","Y":42}`))
+	store.Close()
+
+	db, err = OpenDatabaseWithOptions("testdb_encryption", &Options{EncryptionKey: key})
+	if err != nil {
+		t.Fatalf("couldn't open testdb_encryption: %v", err)
+	}
+	defer db.Close()
+	var e entry
+	if err = db.Coll("persons").Get(1, &e); err == nil {
+		t.Errorf("unencrypted object has been read: %#v", e)
+	} else if !errors.As(err, new(*CorruptError)) {
+		t.Errorf("reading unencrypted object returned %v, expected CorruptError", err)
+	}
+}
@@ -6,8 +6,10 @@ import (
 	"fmt"
 	"github.com/akrennmair/epos"
 	"github.com/voxelbrain/goptions"
+	"io/ioutil"
 	"os"
 	"runtime/pprof"
+	"strings"
 )
 
 func main() {
@@ -16,11 +18,12 @@ func main() {
 	options := struct {
 		Database string `goptions:"-d, --database, obligatory, description='Database to work on'"`
 		CPUProfile string `goptions:"--cpuprofile, description='Record CPU profile for use with pprof.'"`
+		KeyFile string `goptions:"-k, --keyfile, description='File containing the encryption key of the database'"`
 		goptions.Help   `goptions:"-h, --help, description='Show this help'"`
 
 		goptions.Verbs
 		Create struct {
-			Type string `goptions:"-t, --type, description='Create database with the specified storage type (diskv, leveldb)'"`
+			Type string `goptions:"-t, --type, description='Create database with the specified storage type (diskv, leveldb, goleveldb, singlefile)'"`
 		} `goptions:"create"`
 		Collections struct { } `goptions:"collections"`
 		Dump struct {
@@ -33,10 +36,25 @@ func main() {
 			Collection string `goptions:"-c, --collection, obligatory, description='Collection to work on'"`
 			Id         int    `goptions:"-i, --id, obligatory, description='ID of entry to update'"`
 		} `goptions:"update"`
+		Patch struct {
+			Collection string `goptions:"-c, --collection, obligatory, description='Collection to work on'"`
+			Id         int    `goptions:"-i, --id, obligatory, description='ID of entry to patch'"`
+		} `goptions:"patch"`
 		Delete struct {
 			Collection string `goptions:"-c, --collection, obligatory, description='Collection to work on'"`
 			Id         int    `goptions:"-i, --id, obligatory, description='ID of entry to delete'"`
 		} `goptions:"delete"`
+		Drop struct {
+			Collection string `goptions:"-c, --collection, obligatory, description='Collection to drop'"`
+		} `goptions:"drop"`
+		Rename struct {
+			Collection string `goptions:"-c, --collection, obligatory, description='Collection to rename'"`
+			Name       string `goptions:"-n, --name, obligatory, description='New name of the collection'"`
+		} `goptions:"rename"`
+		Copy struct {
+			Collection string `goptions:"-c, --collection, obligatory, description='Collection to copy'"`
+			Name       string `goptions:"-n, --name, obligatory, description='Name of the copy'"`
+		} `goptions:"copy"`
 		Vacuum struct { } `goptions:"vacuum"`
 		AddIndex struct {
 			Collection string `goptions:"-c, --collection, obligatory, description='Collection to work on'"`
@@ -50,6 +68,39 @@ func main() {
 			Collection string `goptions:"-c, --collection, obligatory, description='Collection to work on'"`
 			Expression goptions.Remainder `goptions:"description='query expression'"`
 		} `goptions:"query"`
+		RotateKey struct {
+			KeyFile string `goptions:"-n, --newkeyfile, obligatory, description='File containing the new encryption key'"`
+		} `goptions:"rotatekey"`
+		Recompress struct {
+			Collection  string `goptions:"-c, --collection, obligatory, description='Collection to work on'"`
+			Compression string `goptions:"-z, --compression, obligatory, description='Compression algorithm (none, snappy, gzip, zstd)'"`
+		} `goptions:"recompress"`
+		Check struct { } `goptions:"check"`
+		Repair struct { } `goptions:"repair"`
+		Backup struct {
+			Output string `goptions:"-o, --output, description='File to write the backup to (default: standard output)'"`
+			Dir    string `goptions:"--dir, description='Write the backup as a new database to this directory'"`
+		} `goptions:"backup"`
+		Export struct {
+			Collection string `goptions:"-c, --collection, obligatory, description='Collection to export'"`
+			Format     string `goptions:"-f, --format, description='Export format (jsonl, csv, archive; default: jsonl)'"`
+			Output     string `goptions:"-o, --output, description='File to write to (default: standard output)'"`
+			Columns    string `goptions:"-m, --columns, description='CSV columns as comma-separated list of column=field'"`
+		} `goptions:"export"`
+		Import struct {
+			Collection string `goptions:"-c, --collection, description='Collection to import into (default for archives: the exported collection)'"`
+			Format     string `goptions:"-f, --format, description='Import format (jsonl, csv, archive; default: jsonl)'"`
+			Input      string `goptions:"-i, --input, description='File to read from (default: standard input)'"`
+			Columns    string `goptions:"-m, --columns, description='CSV columns as comma-separated list of column=field'"`
+		} `goptions:"import"`
+		Migrate struct {
+			Target string `goptions:"--to, obligatory, description='Directory of the migrated database'"`
+			Type   string `goptions:"-t, --type, obligatory, description='Storage type of the migrated database'"`
+		} `goptions:"migrate"`
+		Restore struct {
+			Input string `goptions:"-i, --input, description='File to read the backup from (default: standard input)'"`
+			Type  string `goptions:"-t, --type, description='Storage type of the restored database (default: as backed up)'"`
+		} `goptions:"restore"`
 	}{ }
 
 	goptions.ParseAndFail(&options)
@@ -61,16 +112,8 @@ func main() {
 	}
 
 	if options.Verbs == "create" {
-		typ := epos.STORAGE_AUTO
-		switch options.Create.Type {
-		case "leveldb":
-			typ = epos.STORAGE_LEVELDB
-		case "diskv":
-			typ = epos.STORAGE_DISKV
-		default:
-			fmt.Fprintf(os.Stderr, "Error: invalid storage type %s.\n", options.Create.Type)
-		}
-		db, err := epos.OpenDatabase(options.Database, typ)
+		typ := storageType(options.Create.Type)
+		db, err := epos.OpenDatabaseWithOptions(options.Database, &epos.Options{Type: typ, EncryptionKey: readKey(options.KeyFile)})
 		if err != nil {
 			panic(err)
 		}
@@ -78,7 +121,27 @@ func main() {
 		return
 	}
 
-	db, err := epos.OpenDatabase(options.Database, epos.STORAGE_AUTO)
+	// restore creates a new database from a backup.
+	if options.Verbs == "restore" {
+		input := os.Stdin
+		if options.Restore.Input != "" && options.Restore.Input != "-" {
+			f, err := os.Open(options.Restore.Input)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error while opening backup: %v\n", err)
+				os.Exit(1)
+			}
+			defer f.Close()
+			input = f
+		}
+		opts := &epos.Options{Type: storageType(options.Restore.Type), EncryptionKey: readKey(options.KeyFile)}
+		if err := epos.Restore(input, options.Database, opts); err != nil {
+			fmt.Fprintf(os.Stderr, "Error while restoring database: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	db, err := epos.OpenDatabaseWithOptions(options.Database, &epos.Options{EncryptionKey: readKey(options.KeyFile)})
 	if err != nil {
 		panic(err)
 	}
@@ -90,7 +153,7 @@ func main() {
 				fmt.Fprintf(os.Stderr, "Error: missing query expression")
 				break
 			}
-			coll := db.Coll(options.Query.Collection)
+			coll := openColl(db, options.Query.Collection)
 			cond, err := epos.Expression([]string(options.Query.Expression)[0])
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "Invalid query expression: %v\n", err)
@@ -103,7 +166,7 @@ func main() {
 			}
 			dumpData(result)
 		case "dump":
-			coll := db.Coll(options.Dump.Collection)
+			coll := openColl(db, options.Dump.Collection)
 			result, _ := coll.QueryAll()
 			dumpData(result)
 		case "insert":
@@ -114,7 +177,7 @@ func main() {
 				if err != nil {
 					break
 				}
-				coll := db.Coll(options.Insert.Collection)
+				coll := openColl(db, options.Insert.Collection)
 				id, err := coll.Insert(data)
 				if err != nil {
 					fmt.Fprintf(os.Stderr, "Error while inserting item: %v\n", err)
@@ -129,12 +192,12 @@ func main() {
 				os.Exit(1)
 			}
 		case "addindex":
-			coll := db.Coll(options.AddIndex.Collection)
+			coll := openColl(db, options.AddIndex.Collection)
 			if err := coll.AddIndex(options.AddIndex.Field); err != nil {
 				fmt.Fprintf(os.Stderr, "Error while adding index: %v\n", err)
 			}
 		case "rmindex":
-			coll := db.Coll(options.RemoveIndex.Collection)
+			coll := openColl(db, options.RemoveIndex.Collection)
 			if err := coll.RemoveIndex(options.RemoveIndex.Field); err != nil {
 				fmt.Fprintf(os.Stderr, "Error while removing index: %v\n", err)
 			}
@@ -146,6 +209,21 @@ func main() {
 					fmt.Printf("%s\n", collname)
 				}
 			}
+		case "drop":
+			if err := db.DropCollection(options.Drop.Collection); err != nil {
+				fmt.Fprintf(os.Stderr, "Error while dropping collection %s: %v\n", options.Drop.Collection, err)
+				os.Exit(1)
+			}
+		case "rename":
+			if err := db.RenameCollection(options.Rename.Collection, options.Rename.Name); err != nil {
+				fmt.Fprintf(os.Stderr, "Error while renaming collection %s: %v\n", options.Rename.Collection, err)
+				os.Exit(1)
+			}
+		case "copy":
+			if err := db.CopyCollection(options.Copy.Collection, options.Copy.Name); err != nil {
+				fmt.Fprintf(os.Stderr, "Error while copying collection %s: %v\n", options.Copy.Collection, err)
+				os.Exit(1)
+			}
 		case "update":
 			decoder := json.NewDecoder(os.Stdin)
 			var data interface{}
@@ -154,24 +232,250 @@ func main() {
 				 fmt.Fprintf(os.Stderr, "Error while decoding JSON document: %v\n", err)
 				 return
 			}
-			coll := db.Coll(options.Update.Collection)
+			coll := openColl(db, options.Update.Collection)
 			if err := coll.Update(epos.Id(options.Update.Id), data); err != nil {
 				fmt.Fprintf(os.Stderr, "Error while updating item %d: %v\n", options.Update.Id, err)
 				return
 			}
 			fmt.Printf("Item %d updated successfully.\n", options.Update.Id)
+		case "patch":
+			patch, err := ioutil.ReadAll(os.Stdin)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error while reading patch: %v\n", err)
+				return
+			}
+			coll := openColl(db, options.Patch.Collection)
+			if err := coll.Patch(epos.Id(options.Patch.Id), patch); err != nil {
+				fmt.Fprintf(os.Stderr, "Error while patching item %d: %v\n", options.Patch.Id, err)
+				return
+			}
+			fmt.Printf("Item %d patched successfully.\n", options.Patch.Id)
 		case "delete":
-			coll := db.Coll(options.Delete.Collection)
+			coll := openColl(db, options.Delete.Collection)
 			if err := coll.Delete(epos.Id(options.Delete.Id)); err != nil {
 				fmt.Fprintf(os.Stderr, "Error while deleeting item %d: %v\n", options.Delete.Id, err)
 				return
 			}
 			fmt.Printf("Item %d deleted.\n", options.Delete.Id)
+		case "rotatekey":
+			if err := db.RotateKey(readKey(options.RotateKey.KeyFile)); err != nil {
+				fmt.Fprintf(os.Stderr, "Error while rotating encryption key: %v\n", err)
+				os.Exit(1)
+			}
+		case "recompress":
+			coll := openColl(db, options.Recompress.Collection)
+			if err := coll.Recompress(epos.Compression(options.Recompress.Compression)); err != nil {
+				fmt.Fprintf(os.Stderr, "Error while recompressing collection %s: %v\n", options.Recompress.Collection, err)
+				os.Exit(1)
+			}
+		case "check":
+			report, err := db.Check()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error while checking database: %v\n", err)
+				os.Exit(1)
+			}
+			printReport(report)
+			if !report.OK() {
+				os.Exit(1)
+			}
+		case "repair":
+			report, err := db.Repair()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error while repairing database: %v\n", err)
+				os.Exit(1)
+			}
+			printReport(report)
+			if report.OK() {
+				fmt.Printf("No problems found.\n")
+			} else {
+				fmt.Printf("Indexes and ID counters have been repaired.\n")
+			}
+		case "export":
+			coll := openColl(db, options.Export.Collection)
+			output := os.Stdout
+			if options.Export.Output != "" && options.Export.Output != "-" {
+				f, err := os.Create(options.Export.Output)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error while creating %s: %v\n", options.Export.Output, err)
+					os.Exit(1)
+				}
+				defer f.Close()
+				output = f
+			}
+			switch options.Export.Format {
+			case "", "jsonl":
+				err = coll.ExportJSONL(output)
+			case "csv":
+				err = coll.ExportCSV(output, csvColumns(options.Export.Columns))
+			case "archive":
+				err = coll.ExportArchive(output)
+			default:
+				err = fmt.Errorf("unknown format %s", options.Export.Format)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error while exporting collection %s: %v\n", options.Export.Collection, err)
+				os.Exit(1)
+			}
+		case "import":
+			input := os.Stdin
+			if options.Import.Input != "" && options.Import.Input != "-" {
+				f, err := os.Open(options.Import.Input)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error while opening %s: %v\n", options.Import.Input, err)
+					os.Exit(1)
+				}
+				defer f.Close()
+				input = f
+			}
+			if options.Import.Collection == "" && options.Import.Format != "archive" {
+				fmt.Fprintf(os.Stderr, "Error: missing collection\n")
+				os.Exit(1)
+			}
+			var count int
+			switch options.Import.Format {
+			case "", "jsonl":
+				count, err = openColl(db, options.Import.Collection).ImportJSONL(input)
+			case "csv":
+				count, err = openColl(db, options.Import.Collection).ImportCSV(input, csvColumns(options.Import.Columns))
+			case "archive":
+				count, err = db.ImportArchive(input, options.Import.Collection)
+			default:
+				err = fmt.Errorf("unknown format %s", options.Import.Format)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error after importing %d objects: %v\n", count, err)
+				os.Exit(1)
+			}
+			fmt.Printf("%d objects imported.\n", count)
+		case "backup":
+			if options.Backup.Dir != "" {
+				err = db.BackupTo(options.Backup.Dir)
+			} else if options.Backup.Output == "" || options.Backup.Output == "-" {
+				err = db.Backup(os.Stdout)
+			} else {
+				err = backupToFile(db, options.Backup.Output)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error while backing up database: %v\n", err)
+				os.Exit(1)
+			}
+		case "migrate":
+			if err = db.MigrateTo(options.Migrate.Target, storageType(options.Migrate.Type)); err != nil {
+				fmt.Fprintf(os.Stderr, "Error while migrating database: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Printf("Database migrated to %s.\n", options.Migrate.Target)
 		default:
 			fmt.Fprintf(os.Stderr, "Error: unknown operation %s\n", options.Verbs)
 	}
 }
 
+// storageType returns the storage type for the -t/--type option.
+func storageType(typ string) epos.StorageType {
+	switch typ {
+	case "", "auto":
+		return epos.STORAGE_AUTO
+	case "leveldb":
+		return epos.STORAGE_LEVELDB
+	case "goleveldb":
+		return epos.STORAGE_GOLEVELDB
+	case "diskv":
+		return epos.STORAGE_DISKV
+	case "singlefile":
+		return epos.STORAGE_SINGLEFILE
+	}
+	fmt.Fprintf(os.Stderr, "Error: invalid storage type %s.\n", typ)
+	os.Exit(1)
+	return epos.STORAGE_AUTO
+}
+
+// csvColumns parses a list of CSV column mappings like "name=field,...". It
+// returns nil if columns is empty.
+func csvColumns(columns string) []epos.CSVColumn {
+	if columns == "" {
+		return nil
+	}
+	mapping := []epos.CSVColumn{}
+	for _, col := range strings.Split(columns, ",") {
+		parts := strings.SplitN(col, "=", 2)
+		if len(parts) == 1 {
+			parts = append(parts, parts[0])
+		}
+		mapping = append(mapping, epos.CSVColumn{Name: parts[0], Field: parts[1]})
+	}
+	return mapping
+}
+
+// backupToFile writes a backup of db to a new file, which is removed again if
+// the backup fails.
+func backupToFile(db *epos.Database, filename string) error {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if err = db.Backup(f); err == nil {
+		err = f.Sync()
+	}
+	if close_err := f.Close(); err == nil {
+		err = close_err
+	}
+	if err != nil {
+		os.Remove(filename)
+	}
+	return err
+}
+
+// readKey returns the content of keyfile, or nil if no key file has been
+// specified.
+func readKey(keyfile string) []byte {
+	if keyfile == "" {
+		return nil
+	}
+	key, err := ioutil.ReadFile(keyfile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error while reading key file: %v\n", err)
+		os.Exit(1)
+	}
+	return key
+}
+
+func openColl(db *epos.Database, name string) *epos.Collection {
+	coll, err := db.CollE(name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error while opening collection %s: %v\n", name, err)
+		os.Exit(1)
+	}
+	return coll
+}
+
+func printReport(report *epos.CheckReport) {
+	for _, coll := range report.Collections {
+		status := "OK"
+		if !coll.OK() {
+			status = "BROKEN"
+		}
+		fmt.Printf("%s: %s (%d objects)\n", coll.Name, status, coll.Objects)
+		if coll.NextId <= coll.MaxId {
+			fmt.Printf("  next ID %d is not greater than highest ID %d\n", coll.NextId, coll.MaxId)
+		}
+		for _, cerr := range coll.Corrupt {
+			fmt.Printf("  %v\n", cerr)
+		}
+		for _, idx := range coll.Indexes {
+			if idx.Err != nil {
+				fmt.Printf("  index %s can't be read: %v\n", idx.Field, idx.Err)
+				continue
+			}
+			if idx.Missing > 0 || idx.Stale > 0 {
+				fmt.Printf("  index %s: %d entries, %d missing, %d stale\n", idx.Field, idx.Entries, idx.Missing, idx.Stale)
+			}
+			for _, cerr := range idx.Corrupt {
+				fmt.Printf("  %v\n", cerr)
+			}
+		}
+	}
+}
+
 func dumpData(result *epos.Result) {
 	var id epos.Id
 	var data interface{}
@@ -0,0 +1,81 @@
+package epos
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrCorrupt is returned when stored data fails its checksum or can't be
+// decoded. errors.Is(err, ErrCorrupt) reports whether err is a CorruptError.
+var ErrCorrupt = errors.New("data is corrupt")
+
+// ErrNotFound is returned when an object or a key doesn't exist.
+var ErrNotFound = errors.New("not found")
+
+// ErrConflict is returned by UpdateIfRevision and DeleteIfRevision if the
+// object has been changed or deleted in the meantime.
+var ErrConflict = errors.New("object has been changed concurrently")
+
+// ErrDuplicate is returned when a change would give two objects the same
+// value of a field that has a unique index.
+var ErrDuplicate = errors.New("duplicate value in unique index")
+
+// CorruptError describes a corrupt object or index entry.
+type CorruptError struct {
+	Collection string
+	// Key is the key of the corrupt object. It is empty for index entries.
+	Key string
+	// Index is the field of the index that contains the corrupt entry, and
+	// Offset is the position of the entry in the index file.
+	Index  string
+	Offset int64
+	Reason string
+}
+
+func (e *CorruptError) Error() string {
+	if e.Index != "" {
+		return fmt.Sprintf("collection %s: index %s: entry at offset %d is corrupt: %s", e.Collection, e.Index, e.Offset, e.Reason)
+	}
+	return fmt.Sprintf("collection %s: object %s is corrupt: %s", e.Collection, e.Key, e.Reason)
+}
+
+func (e *CorruptError) Unwrap() error {
+	return ErrCorrupt
+}
+
+// MultiError is returned by operations that can fail in several places at
+// once, e.g. when closing a database, and contains all errors that occured.
+type MultiError []error
+
+func (e MultiError) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Unwrap returns the contained errors, so that errors.Is and errors.As look
+// at all of them.
+func (e MultiError) Unwrap() []error {
+	return e
+}
+
+func (e *MultiError) add(err error) {
+	if err != nil {
+		*e = append(*e, err)
+	}
+}
+
+// err returns nil if no error occured, the error itself if exactly one error
+// occured, and the MultiError otherwise.
+func (e MultiError) err() error {
+	switch len(e) {
+	case 0:
+		return nil
+	case 1:
+		return e[0]
+	}
+	return e
+}
@@ -0,0 +1,593 @@
+package epos
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// IDs and keys are exported and imported in these fields of objects.
+const (
+	idField  = "_id"
+	keyField = "_key"
+)
+
+// archives have the same format as backups, but contain the objects of a
+// single collection as they have been encoded by the collection's codec, so
+// they are independent of compression and encryption.
+const archiveMagic = "EPOSARC1"
+
+// CSVColumn maps a column of a CSV file to a top-level field of the objects.
+// The field "_id" is the ID of the objects.
+type CSVColumn struct {
+	Name  string
+	Field string
+}
+
+// eachObject calls fn with the ID and the encoded data of all objects of the
+// collection, in ascending order of their IDs.
+func (c *Collection) eachObject(fn func(id Id, data []byte) error) error {
+	ids, err := c.idRange(0, 0, 0)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		data, err := c.store.Read(fmt.Sprintf("%d", id))
+		if err != nil {
+			return fmt.Errorf("reading object %d failed: %w", id, err)
+		}
+		if err = fn(id, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeMap decodes an object into a map that can be encoded as JSON. Objects
+// that are encoded as JSON are decoded without converting their numbers, so
+// that no precision is lost.
+func (c *Collection) decodeMap(id Id, data []byte) (map[string]interface{}, error) {
+	object := make(map[string]interface{})
+	var err error
+	if c.codec.Name() == CODEC_JSON {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		err = dec.Decode(&object)
+	} else {
+		err = c.codec.Unmarshal(data, &object)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("object %d can't be decoded as a map: %v", id, err)
+	}
+	for field, value := range object {
+		object[field] = jsonCompatible(value)
+	}
+	return object, nil
+}
+
+// jsonCompatible converts maps with non-string keys, which some codecs decode
+// nested maps into, into maps with string keys.
+func jsonCompatible(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			m[fmt.Sprintf("%v", key)] = jsonCompatible(value)
+		}
+		return m
+	case map[string]interface{}:
+		for key, value := range v {
+			v[key] = jsonCompatible(value)
+		}
+	case []interface{}:
+		for i, value := range v {
+			v[i] = jsonCompatible(value)
+		}
+	}
+	return v
+}
+
+// fromJSONNumbers replaces all json.Numbers by int64 or float64 values, so
+// that codecs other than JSON encode them as numbers.
+func fromJSONNumbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for key, value := range v {
+			v[key] = fromJSONNumbers(value)
+		}
+	case []interface{}:
+		for i, value := range v {
+			v[i] = fromJSONNumbers(value)
+		}
+	}
+	return v
+}
+
+// importIds removes the ID and the key from an imported object and returns
+// them. Objects without ID have ID 0, objects without key have key "".
+func importIds(object map[string]interface{}) (Id, string, error) {
+	id, err := parseImportId(object[idField])
+	if err != nil {
+		return 0, "", err
+	}
+	key := ""
+	if v, ok := object[keyField]; ok {
+		key = fmt.Sprintf("%v", v)
+		if err = validateKey(key); err != nil {
+			return 0, "", err
+		}
+	}
+	delete(object, idField)
+	delete(object, keyField)
+	return id, key, nil
+}
+
+// parseImportId returns the ID in the _id field of an imported object, or 0
+// if the object has none.
+func parseImportId(v interface{}) (Id, error) {
+	var id int64
+	var err error
+	switch v := v.(type) {
+	case nil:
+		return 0, nil
+	case json.Number:
+		id, err = v.Int64()
+	case string:
+		id, err = strconv.ParseInt(v, 10, 64)
+	default:
+		err = fmt.Errorf("unsupported type %T", v)
+	}
+	if err == nil && id <= 0 {
+		err = errors.New("IDs must be positive")
+	}
+	if err != nil {
+		return 0, fmt.Errorf("invalid ID %v: %v", v, err)
+	}
+	return Id(id), nil
+}
+
+// importer imports objects in batches, keeping their IDs if they have one.
+type importer struct {
+	c       *Collection
+	ids     []Id
+	keys    []string
+	values  [][]byte
+	next_id Id // the minimum value of the ID counter after the import.
+	count   int
+}
+
+func (c *Collection) newImporter() *importer {
+	return &importer{c: c}
+}
+
+// add imports an object. Objects with ID 0 get a new ID. Existing objects
+// with the same ID are replaced. Objects with a key replace the object with
+// the same key, or get a new ID, since IDs are only meaningful in the
+// database that the object has been exported from.
+func (imp *importer) add(id Id, key string, value interface{}) error {
+	data, err := imp.c.codec.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return imp.addEncoded(id, key, data)
+}
+
+// addEncoded imports an object that has already been encoded by the
+// collection's codec.
+func (imp *importer) addEncoded(id Id, key string, data []byte) error {
+	imp.ids = append(imp.ids, id)
+	imp.keys = append(imp.keys, key)
+	imp.values = append(imp.values, data)
+	if len(imp.ids) >= rewriteBatchSize {
+		return imp.flush()
+	}
+	return nil
+}
+
+func (imp *importer) flush() error {
+	if len(imp.ids) == 0 && imp.next_id == 0 {
+		return nil
+	}
+	c := imp.c
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+
+	data, _ := c.store.Read("_next_id")
+	next, _ := binary.Varint(data)
+	next_id := Id(next)
+	if imp.next_id > next_id {
+		next_id = imp.next_id
+	}
+
+	ops := make([]walOp, 0, len(imp.ids))
+	keys := make(map[string]Id)    // the keys that are new in this batch.
+	id_keys := make(map[Id]string) // the same keys by ID.
+	seen := make(map[Id]bool)      // the IDs that are written in this batch.
+	unkeyed := make(map[Id]bool)   // the IDs whose stored key is erased.
+	for i, id := range imp.ids {
+		key := imp.keys[i]
+		if key != "" {
+			if id = keys[key]; id == 0 {
+				id = c.lookup(key)
+			}
+		} else if id == 0 {
+			key = c.newKey()
+		}
+
+		typ := walInsert
+		if id == 0 {
+			id = c.allocId(next_id)
+		} else if seen[id] || c.Exists(id) {
+			typ = walUpdate
+		}
+		seen[id] = true
+		if id >= next_id {
+			next_id = id + 1
+		}
+		id_str := fmt.Sprintf("%d", id)
+		ops = append(ops, walOp{typ: typ, coll: c.name, key: id_str, data: imp.values[i]})
+
+		// an object that is replaced by an object without key loses
+		// its key.
+		if typ == walUpdate && key == "" {
+			if old_key := id_keys[id]; old_key != "" {
+				ops = append(ops, walOp{typ: walDelete, coll: c.name, key: idOfKey(c.db.opts.keys, old_key)}, walOp{typ: walDelete, coll: c.name, key: keyOf(id_str)})
+				delete(keys, old_key)
+				delete(id_keys, id)
+			} else if !unkeyed[id] {
+				for _, op := range c.unkeyOps(id_str) {
+					ops = append(ops, walOp{typ: walDelete, coll: c.name, key: op.Key})
+				}
+				unkeyed[id] = true
+			}
+		}
+		if key != "" && typ == walInsert {
+			ops = append(ops, c.keyOps(key, id_str)...)
+			keys[key] = id
+			id_keys[id] = key
+		}
+	}
+
+	if err := c.commitBatch(append(ops, c.nextIdOp(next_id))); err != nil {
+		return err
+	}
+	imp.count += len(imp.ids)
+	imp.ids, imp.keys, imp.values = imp.ids[:0], imp.keys[:0], imp.values[:0]
+	return nil
+}
+
+// ExportJSONL writes all objects of the collection to w in the JSON Lines
+// format, one JSON object per line, with the object's ID in the field "_id",
+// and its key, if it has one, in the field "_key". Objects that aren't maps
+// or structs can't be exported.
+func (c *Collection) ExportJSONL(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	err := c.eachObject(func(id Id, data []byte) error {
+		object, err := c.decodeMap(id, data)
+		if err != nil {
+			return err
+		}
+		c.addIds(object, id)
+		return enc.Encode(object)
+	})
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// ImportJSONL imports objects in the JSON Lines format, as written by
+// ExportJSONL. Objects keep the ID in their field "_id" and replace existing
+// objects with the same ID; objects without ID get a new one. Objects with a
+// key in their field "_key" replace the object with the same key instead, or
+// get a new ID. It returns the number of imported objects.
+func (c *Collection) ImportJSONL(r io.Reader) (int, error) {
+	if err := c.db.checkWritable(); err != nil {
+		return 0, err
+	}
+
+	imp := c.newImporter()
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	for line := 1; ; line++ {
+		var object map[string]interface{}
+		if err := dec.Decode(&object); err == io.EOF {
+			break
+		} else if err != nil {
+			return imp.count, fmt.Errorf("object %d: %v", line, err)
+		}
+		id, key, err := importIds(object)
+		if err != nil {
+			return imp.count, fmt.Errorf("object %d: %v", line, err)
+		}
+		if err = imp.add(id, key, c.importValue(object)); err != nil {
+			return imp.count, err
+		}
+	}
+	return imp.count, imp.flush()
+}
+
+// addIds adds the ID and the key of an exported object to it.
+func (c *Collection) addIds(object map[string]interface{}, id Id) {
+	object[idField] = id
+	if key := storedKey(c.raw, c.db.opts.keys, fmt.Sprintf("%d", id)); key != "" {
+		object[keyField] = key
+	}
+}
+
+// importValue prepares an object that has been decoded from JSON for the
+// collection's codec.
+func (c *Collection) importValue(object map[string]interface{}) interface{} {
+	if c.codec.Name() == CODEC_JSON {
+		return object
+	}
+	return fromJSONNumbers(object)
+}
+
+// ExportCSV writes all objects of the collection to w as CSV. The first row
+// contains the names of the columns. If columns is nil, there is a column for
+// the ID, for the key if any object has one, and for every top-level field of
+// the objects. Nested values are written as JSON.
+func (c *Collection) ExportCSV(w io.Writer, columns []CSVColumn) error {
+	if columns == nil {
+		fields := make(map[string]bool)
+		err := c.eachObject(func(id Id, data []byte) error {
+			object, err := c.decodeMap(id, data)
+			if err != nil {
+				return err
+			}
+			c.addIds(object, id)
+			for field := range object {
+				fields[field] = true
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		columns = []CSVColumn{{Name: idField, Field: idField}}
+		if fields[keyField] {
+			columns = append(columns, CSVColumn{Name: keyField, Field: keyField})
+		}
+		delete(fields, idField)
+		delete(fields, keyField)
+		names := []string{}
+		for field := range fields {
+			names = append(names, field)
+		}
+		sort.Strings(names)
+		for _, field := range names {
+			columns = append(columns, CSVColumn{Name: field, Field: field})
+		}
+	}
+
+	cw := csv.NewWriter(w)
+	row := make([]string, len(columns))
+	for i, col := range columns {
+		row[i] = col.Name
+	}
+	if err := cw.Write(row); err != nil {
+		return err
+	}
+
+	err := c.eachObject(func(id Id, data []byte) error {
+		object, err := c.decodeMap(id, data)
+		if err != nil {
+			return err
+		}
+		c.addIds(object, id)
+		for i, col := range columns {
+			row[i] = ""
+			switch value := object[col.Field].(type) {
+			case nil:
+			case string:
+				row[i] = value
+			case map[string]interface{}, []interface{}, []byte:
+				data, err := json.Marshal(value)
+				if err != nil {
+					return err
+				}
+				row[i] = string(data)
+			default:
+				row[i] = fmt.Sprintf("%v", value)
+			}
+		}
+		return cw.Write(row)
+	})
+	if err != nil {
+		return err
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// ImportCSV imports objects from CSV. The first row must contain the names of
+// the columns, which are mapped to fields by columns; columns that aren't
+// mapped are skipped. If columns is nil, every column is imported into the
+// field of the same name. The columns mapped to "_id" and "_key" contain the
+// IDs and keys of the objects, like in ImportJSONL. Values that are valid JSON, like numbers,
+// booleans, objects and arrays, are imported as such; all other values are
+// imported as strings, and empty values are left out.
+func (c *Collection) ImportCSV(r io.Reader, columns []CSVColumn) (int, error) {
+	if err := c.db.checkWritable(); err != nil {
+		return 0, err
+	}
+
+	cr := csv.NewReader(r)
+	header, err := cr.Read()
+	if err != nil {
+		return 0, fmt.Errorf("reading CSV header failed: %v", err)
+	}
+	fields := make([]string, len(header))
+	for i, name := range header {
+		if columns == nil {
+			fields[i] = name
+		}
+		for _, col := range columns {
+			if col.Name == name {
+				fields[i] = col.Field
+			}
+		}
+	}
+
+	imp := c.newImporter()
+	for line := 2; ; line++ {
+		row, err := cr.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return imp.count, err
+		}
+
+		object := make(map[string]interface{})
+		for i, cell := range row {
+			if fields[i] == "" || cell == "" {
+				continue
+			}
+			dec := json.NewDecoder(strings.NewReader(cell))
+			dec.UseNumber()
+			var value interface{}
+			if dec.Decode(&value) != nil || dec.More() {
+				value = cell
+			}
+			object[fields[i]] = value
+		}
+		id, key, err := importIds(object)
+		if err != nil {
+			return imp.count, fmt.Errorf("line %d: %v", line, err)
+		}
+		if err = imp.add(id, key, c.importValue(object)); err != nil {
+			return imp.count, err
+		}
+	}
+	return imp.count, imp.flush()
+}
+
+// ExportArchive writes the collection to w in epos' native archive format,
+// which contains the objects exactly as they have been encoded, their IDs and
+// keys, the ID counter and the index definitions. Unlike a backup, an archive
+// doesn't depend on the compression or encryption of the database.
+func (c *Collection) ExportArchive(w io.Writer) error {
+	bw := newBackupWriter(w, archiveMagic)
+	meta, err := json.Marshal(&collMeta{Codec: c.codec.Name(), IdStrategy: c.meta.IdStrategy})
+	if err != nil {
+		return err
+	}
+	bw.record(backupMeta, c.name, "", meta)
+
+	fields := []string{}
+	for field := range c.indexes {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		bw.record(backupIndex, c.name, field, nil)
+	}
+
+	data, _ := c.store.Read("_next_id")
+	bw.record(backupObject, c.name, "_next_id", data)
+	err = c.eachObject(func(id Id, data []byte) error {
+		id_str := fmt.Sprintf("%d", id)
+		if key := storedKey(c.raw, c.db.opts.keys, id_str); key != "" {
+			bw.record(backupKey, c.name, id_str, []byte(key))
+		}
+		bw.record(backupObject, c.name, id_str, data)
+		return bw.err
+	})
+	if err != nil {
+		return err
+	}
+	return bw.close()
+}
+
+// ImportArchive imports a collection from an archive that has been written
+// by ExportArchive, into the collection of the specified name, or the name of
+// the exported collection if name is empty. The collection is created if it
+// doesn't exist, and otherwise must use the same codec and ID strategy.
+// Objects are imported like by ImportJSONL, and the indexes of the archive
+// are created. If the archive is damaged, the objects before the
+// damage have been imported. It returns the number of imported objects.
+func (db *Database) ImportArchive(r io.Reader, name string) (int, error) {
+	if err := db.checkWritable(); err != nil {
+		return 0, err
+	}
+
+	br, err := newBackupReader(r, archiveMagic)
+	if err != nil {
+		return 0, err
+	}
+	rec, err := br.next()
+	if err != nil {
+		return 0, err
+	}
+	meta := &collMeta{}
+	if rec.kind != backupMeta || json.Unmarshal(rec.value, meta) != nil {
+		return 0, errInvalidBackup
+	}
+	if name == "" {
+		name = rec.coll
+	}
+	coll, err := db.CollWithOptions(name, &CollectionOptions{Codec: meta.Codec, IdStrategy: meta.IdStrategy})
+	if err != nil {
+		return 0, err
+	}
+
+	imp := coll.newImporter()
+	fields := []string{}
+	key := "" // the key of the next object.
+	for {
+		rec, err := br.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return imp.count, err
+		}
+
+		switch {
+		case rec.kind == backupIndex:
+			fields = append(fields, rec.key)
+		case rec.kind == backupObject && rec.key == "_next_id":
+			next_id, _ := binary.Varint(rec.value)
+			imp.next_id = Id(next_id)
+		case rec.kind == backupKey:
+			key = string(rec.value)
+		case rec.kind == backupObject:
+			id, err := strconv.ParseInt(rec.key, 10, 64)
+			if err != nil {
+				return imp.count, errInvalidBackup
+			}
+			if err = imp.addEncoded(Id(id), key, rec.value); err != nil {
+				return imp.count, err
+			}
+			key = ""
+		default:
+			return imp.count, errInvalidBackup
+		}
+	}
+	if err = imp.flush(); err != nil {
+		return imp.count, err
+	}
+
+	for _, field := range fields {
+		if err = coll.AddIndex(field); err != nil {
+			return imp.count, err
+		}
+	}
+	return imp.count, nil
+}
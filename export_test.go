@@ -0,0 +1,189 @@
+package epos
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+type measurement struct {
+	Name  string
+	Value int64
+}
+
+func TestExportImportJSONL(t *testing.T) {
+	db, err := OpenDatabase("testdb_export", STORAGE_AUTO)
+	if err != nil {
+		t.Fatalf("couldn't open testdb_export: %v", err)
+	}
+	defer db.Remove()
+	defer db.Close()
+
+	src := db.Coll("src")
+	src.Insert(&measurement{Name: "small", Value: 1})
+	src.Insert(&measurement{Name: "large", Value: 1<<60 + 1})
+	src.Delete(1)
+
+	buf := bytes.NewBuffer([]byte{})
+	if err = src.ExportJSONL(buf); err != nil {
+		t.Fatalf("ExportJSONL failed: %v", err)
+	}
+	if !strings.Contains(buf.String(), `"_id":2`) {
+		t.Errorf("export doesn't contain the ID of the object: %s", buf.String())
+	}
+
+	dst := db.Coll("dst")
+	if n, err := dst.ImportJSONL(bytes.NewReader(buf.Bytes())); err != nil || n != 1 {
+		t.Fatalf("ImportJSONL returned %d (error: %v)", n, err)
+	}
+	var m measurement
+	result, _ := dst.QueryId(2)
+	if !result.Next(nil, &m) || m.Value != 1<<60+1 {
+		t.Errorf("imported object is %#v", m)
+	}
+	if id, _ := dst.Insert(&measurement{Name: "next"}); id != 3 {
+		t.Errorf("Insert after import returned ID %d", id)
+	}
+
+	// objects without ID are inserted, and objects with ID replace them.
+	input := `{"Name":"new","Value":5}` + "\n" + `{"_id":3,"Name":"replaced","Value":7}` + "\n"
+	if n, err := dst.ImportJSONL(strings.NewReader(input)); err != nil || n != 2 {
+		t.Fatalf("ImportJSONL returned %d (error: %v)", n, err)
+	}
+	result, _ = dst.QueryId(3)
+	if !result.Next(nil, &m) || m.Name != "replaced" {
+		t.Errorf("object 3 is %#v", m)
+	}
+	if result, _ = dst.QueryAll(); result.Count() != 3 {
+		t.Errorf("collection contains %d objects, expected 3", result.Count())
+	}
+
+	if _, err = dst.ImportJSONL(strings.NewReader("{\"Name\":\n")); err == nil {
+		t.Errorf("importing broken JSON succeeded")
+	}
+}
+
+func TestExportImportCSV(t *testing.T) {
+	db, err := OpenDatabase("testdb_export", STORAGE_AUTO)
+	if err != nil {
+		t.Fatalf("couldn't open testdb_export: %v", err)
+	}
+	defer db.Remove()
+	defer db.Close()
+
+	books := db.Coll("books")
+	for _, book := range queryData[:3] {
+		books.Insert(book)
+	}
+	columns := []CSVColumn{{"id", "_id"}, {"author", "Author"}, {"title", "Title"}}
+	buf := bytes.NewBuffer([]byte{})
+	if err = books.ExportCSV(buf, columns); err != nil {
+		t.Fatalf("ExportCSV failed: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 4 || lines[0] != "id,author,title" || !strings.HasPrefix(lines[1], "1,") {
+		t.Errorf("unexpected CSV export:\n%s", buf.String())
+	}
+
+	copied := db.Coll("copied")
+	if n, err := copied.ImportCSV(bytes.NewReader(buf.Bytes()), columns); err != nil || n != 3 {
+		t.Fatalf("ImportCSV returned %d (error: %v)", n, err)
+	}
+	var b book
+	result, _ := copied.QueryId(2)
+	if !result.Next(nil, &b) || b.Title != queryData[1].Title || b.Author != queryData[1].Author {
+		t.Errorf("imported object is %#v", b)
+	}
+
+	input := "Name,Value\nanswer,42\n"
+	if n, err := copied.ImportCSV(strings.NewReader(input), nil); err != nil || n != 1 {
+		t.Fatalf("ImportCSV without columns returned %d (error: %v)", n, err)
+	}
+	var m measurement
+	result, _ = copied.QueryId(4)
+	if !result.Next(nil, &m) || m.Name != "answer" || m.Value != 42 {
+		t.Errorf("imported object is %#v", m)
+	}
+}
+
+func TestExportImportArchive(t *testing.T) {
+	db, err := OpenDatabaseWithOptions("testdb_export", &Options{Codec: CODEC_MSGPACK})
+	if err != nil {
+		t.Fatalf("couldn't open testdb_export: %v", err)
+	}
+	defer db.Remove()
+	defer db.Close()
+
+	books := db.Coll("books")
+	books.AddIndex("Author")
+	for _, book := range queryData {
+		books.Insert(book)
+	}
+	books.Delete(Id(len(queryData)))
+
+	buf := bytes.NewBuffer([]byte{})
+	if err = books.ExportArchive(buf); err != nil {
+		t.Fatalf("ExportArchive failed: %v", err)
+	}
+
+	other, err := OpenDatabase("testdb_import", STORAGE_DISKV)
+	if err != nil {
+		t.Fatalf("couldn't open testdb_import: %v", err)
+	}
+	defer other.Remove()
+	defer other.Close()
+
+	if n, err := other.ImportArchive(bytes.NewReader(buf.Bytes()), ""); err != nil || n != len(queryData)-1 {
+		t.Fatalf("ImportArchive returned %d (error: %v)", n, err)
+	}
+	imported := other.Coll("books")
+	if codec := imported.Options().Codec; codec != CODEC_MSGPACK {
+		t.Errorf("imported collection uses codec %s", codec)
+	}
+	result, err := imported.Query(&Equals{Field: "Author", Value: "Aesop"})
+	if err != nil || result.Count() != 1 {
+		t.Errorf("query on imported index failed (error: %v)", err)
+	}
+	if id, _ := imported.Insert(&book{Title: "New"}); id != Id(len(queryData)+1) {
+		t.Errorf("Insert after import returned ID %d", id)
+	}
+
+	data := buf.Bytes()
+	data[len(data)-1] ^= 0xff
+	if _, err = other.ImportArchive(bytes.NewReader(data), "damaged"); err == nil {
+		t.Errorf("importing damaged archive succeeded")
+	}
+}
+
+func TestImportReplacedIds(t *testing.T) {
+	db, err := OpenDatabase("testdb_export", STORAGE_AUTO)
+	if err != nil {
+		t.Fatalf("couldn't open testdb_export: %v", err)
+	}
+	defer db.Remove()
+	defer db.Close()
+	notes, _ := db.CollWithOptions("notes", &CollectionOptions{IdStrategy: ID_UUID4})
+	notes.AddIndex("Name")
+	key, _ := notes.InsertKey(&measurement{Name: "keyed", Value: 1})
+
+	// the same ID twice in one batch, and an ID that belongs to a keyed
+	// object.
+	lines := `{"_id": 5, "Name": "first", "Value": 1}
+{"_id": 5, "Name": "second", "Value": 2}
+{"_id": 1, "Name": "unkeyed", "Value": 3}
+`
+	if n, err := notes.ImportJSONL(strings.NewReader(lines)); err != nil || n != 3 {
+		t.Fatalf("ImportJSONL returned %d (error: %v)", n, err)
+	}
+	for name, count := range map[string]int{"first": 0, "second": 1, "keyed": 0, "unkeyed": 1} {
+		if result, _ := notes.Query(&Equals{Field: "Name", Value: name}); result.Count() != count {
+			t.Errorf("%d objects named %s, expected %d", result.Count(), name, count)
+		}
+	}
+	if _, err = notes.Lookup(key); err != ErrNotFound {
+		t.Errorf("key of replaced object still exists (error: %v)", err)
+	}
+	if k, _ := notes.Key(1); k != "1" {
+		t.Errorf("replaced object has key %s", k)
+	}
+}
@@ -0,0 +1,360 @@
+package epos
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fileSystem abstracts the files that epos manages itself (metadata, index
+// files and the write-ahead log), so that a database can either live on disk
+// or completely in memory.
+type fileSystem interface {
+	OpenFile(name string, flag int, perm os.FileMode) (file, error)
+	Stat(name string) (os.FileInfo, error)
+	Mkdir(name string, perm os.FileMode) error
+	ReadDir(name string) ([]os.FileInfo, error)
+	Rename(oldname, newname string) error
+	Remove(name string) error
+	RemoveAll(name string) error
+}
+
+type file interface {
+	io.Reader
+	io.Writer
+	io.Seeker
+	io.Closer
+	Sync() error
+	Truncate(size int64) error
+}
+
+func readFile(fs fileSystem, name string) ([]byte, error) {
+	f, err := fs.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+func writeFile(fs fileSystem, name string, data []byte, perm os.FileMode) error {
+	f, err := fs.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if close_err := f.Close(); err == nil {
+		err = close_err
+	}
+	return err
+}
+
+// osFS is the fileSystem of the operating system.
+type osFS struct{}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (file, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (osFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFS) Mkdir(name string, perm os.FileMode) error {
+	return os.Mkdir(name, perm)
+}
+
+func (osFS) ReadDir(name string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(name)
+}
+
+func (osFS) Rename(oldname, newname string) error {
+	return os.Rename(oldname, newname)
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFS) RemoveAll(name string) error {
+	return os.RemoveAll(name)
+}
+
+// memFS is a fileSystem that keeps all files in memory.
+type memFS struct {
+	mu    sync.Mutex
+	files map[string]*memFileData
+	dirs  map[string]os.FileMode
+}
+
+type memFileData struct {
+	data    []byte
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func newMemFS() *memFS {
+	return &memFS{files: make(map[string]*memFileData), dirs: make(map[string]os.FileMode)}
+}
+
+func (fs *memFS) OpenFile(name string, flag int, perm os.FileMode) (file, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	name = filepath.Clean(name)
+	data, exists := fs.files[name]
+	if !exists {
+		if flag&os.O_CREATE == 0 {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+		if _, isdir := fs.dirs[name]; isdir {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+		}
+		data = &memFileData{mode: perm, modTime: time.Now()}
+		fs.files[name] = data
+	} else if flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	}
+
+	if flag&os.O_TRUNC != 0 {
+		data.data = nil
+	}
+
+	return &memFile{fs: fs, data: data, flag: flag}, nil
+}
+
+func (fs *memFS) Stat(name string) (os.FileInfo, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	name = filepath.Clean(name)
+	if data, exists := fs.files[name]; exists {
+		return &memFileInfo{name: filepath.Base(name), size: int64(len(data.data)), mode: data.mode, modTime: data.modTime}, nil
+	}
+	if mode, exists := fs.dirs[name]; exists {
+		return &memFileInfo{name: filepath.Base(name), mode: mode | os.ModeDir}, nil
+	}
+	return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+}
+
+func (fs *memFS) Mkdir(name string, perm os.FileMode) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	name = filepath.Clean(name)
+	_, isfile := fs.files[name]
+	_, isdir := fs.dirs[name]
+	if isfile || isdir {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	}
+	fs.dirs[name] = perm
+	return nil
+}
+
+func (fs *memFS) ReadDir(name string) ([]os.FileInfo, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	name = filepath.Clean(name)
+	if _, isdir := fs.dirs[name]; !isdir {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+
+	entries := []os.FileInfo{}
+	for path, data := range fs.files {
+		if filepath.Dir(path) == name {
+			entries = append(entries, &memFileInfo{name: filepath.Base(path), size: int64(len(data.data)), mode: data.mode, modTime: data.modTime})
+		}
+	}
+	for path, mode := range fs.dirs {
+		if path != name && filepath.Dir(path) == name {
+			entries = append(entries, &memFileInfo{name: filepath.Base(path), mode: mode | os.ModeDir})
+		}
+	}
+	sort.Sort(byName(entries))
+	return entries, nil
+}
+
+func (fs *memFS) Rename(oldname, newname string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	oldname, newname = filepath.Clean(oldname), filepath.Clean(newname)
+	if data, exists := fs.files[oldname]; exists {
+		delete(fs.files, oldname)
+		fs.files[newname] = data
+		return nil
+	}
+	if _, exists := fs.dirs[oldname]; !exists {
+		return &os.PathError{Op: "rename", Path: oldname, Err: os.ErrNotExist}
+	}
+	if _, exists := fs.dirs[newname]; exists {
+		return &os.PathError{Op: "rename", Path: newname, Err: os.ErrExist}
+	}
+	for path, data := range fs.files {
+		if rel, inside := relPath(oldname, path); inside {
+			delete(fs.files, path)
+			fs.files[filepath.Join(newname, rel)] = data
+		}
+	}
+	for path, mode := range fs.dirs {
+		if rel, inside := relPath(oldname, path); inside {
+			delete(fs.dirs, path)
+			fs.dirs[filepath.Join(newname, rel)] = mode
+		}
+	}
+	return nil
+}
+
+func (fs *memFS) Remove(name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	name = filepath.Clean(name)
+	if _, exists := fs.files[name]; exists {
+		delete(fs.files, name)
+		return nil
+	}
+	if _, exists := fs.dirs[name]; !exists {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	for path, _ := range fs.files {
+		if filepath.Dir(path) == name {
+			return &os.PathError{Op: "remove", Path: name, Err: os.ErrInvalid}
+		}
+	}
+	delete(fs.dirs, name)
+	return nil
+}
+
+func (fs *memFS) RemoveAll(name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	name = filepath.Clean(name)
+	for path, _ := range fs.files {
+		if _, inside := relPath(name, path); inside {
+			delete(fs.files, path)
+		}
+	}
+	for path, _ := range fs.dirs {
+		if _, inside := relPath(name, path); inside {
+			delete(fs.dirs, path)
+		}
+	}
+	return nil
+}
+
+// relPath returns path relative to dir, and whether path is dir itself or
+// located within dir.
+func relPath(dir, path string) (string, bool) {
+	if path == dir {
+		return ".", true
+	}
+	if strings.HasPrefix(path, dir+string(filepath.Separator)) {
+		return path[len(dir)+1:], true
+	}
+	return "", false
+}
+
+type memFile struct {
+	fs   *memFS
+	data *memFileData
+	flag int
+	pos  int64
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.pos >= int64(len(f.data.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.data.data[f.pos:])
+	f.pos += int64(n)
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return 0, &os.PathError{Op: "write", Err: os.ErrPermission}
+	}
+	if f.flag&os.O_APPEND != 0 {
+		f.pos = int64(len(f.data.data))
+	}
+	if end := f.pos + int64(len(p)); end > int64(len(f.data.data)) {
+		f.data.data = append(f.data.data, make([]byte, int(end)-len(f.data.data))...)
+	}
+	copy(f.data.data[f.pos:], p)
+	f.pos += int64(len(p))
+	f.data.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	switch whence {
+	case os.SEEK_SET:
+		f.pos = offset
+	case os.SEEK_CUR:
+		f.pos += offset
+	case os.SEEK_END:
+		f.pos = int64(len(f.data.data)) + offset
+	}
+	return f.pos, nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if size < int64(len(f.data.data)) {
+		f.data.data = f.data.data[:size]
+	} else {
+		f.data.data = append(f.data.data, make([]byte, int(size)-len(f.data.data))...)
+	}
+	return nil
+}
+
+func (f *memFile) Sync() error {
+	return nil
+}
+
+func (f *memFile) Close() error {
+	return nil
+}
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (fi *memFileInfo) Name() string       { return fi.name }
+func (fi *memFileInfo) Size() int64        { return fi.size }
+func (fi *memFileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi *memFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *memFileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *memFileInfo) Sys() interface{}   { return nil }
+
+type byName []os.FileInfo
+
+func (s byName) Len() int           { return len(s) }
+func (s byName) Less(i, j int) bool { return s[i].Name() < s[j].Name() }
+func (s byName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,116 @@
+package epos
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// Get decodes the object with the specified ID into out. It returns
+// ErrNotFound if the object doesn't exist. To update the object with
+// UpdateIfRevision, use GetWithRevision instead.
+func (c *Collection) Get(id Id, out interface{}) error {
+	data, err := c.read(id)
+	if err != nil {
+		return err
+	}
+	return c.decode(id, data, out)
+}
+
+// GetWithRevision decodes the object with the specified ID into out, like
+// Get, and returns the revision of the object as it has been read, which can
+// be passed to UpdateIfRevision and DeleteIfRevision.
+func (c *Collection) GetWithRevision(id Id, out interface{}) (Rev, error) {
+	c.db.mu.RLock()
+	rev := readRev(c.raw, fmt.Sprintf("%d", id))
+	data, err := c.read(id)
+	c.db.mu.RUnlock()
+	if err != nil {
+		return 0, err
+	}
+	if err = c.decode(id, data, out); err != nil {
+		return 0, err
+	}
+	return rev, nil
+}
+
+func (c *Collection) decode(id Id, data []byte, out interface{}) error {
+	if err := c.codec.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("decoding object %d failed: %w", id, err)
+	}
+	return nil
+}
+
+// Exists returns true if an object with the specified ID exists.
+func (c *Collection) Exists(id Id) bool {
+	// the object doesn't need to be decrypted or decompressed.
+	data, err := c.raw.Read(fmt.Sprintf("%d", id))
+	return err == nil && len(data) > 0
+}
+
+// GetMany decodes the objects with the specified IDs into out, which must be
+// a pointer to a slice of structs, maps or pointers to them. The objects are
+// appended to the slice in the order of ids. Storage backends that implement
+// MultiReader, like LevelDB, read all of them at once from a single snapshot;
+// with all others, they are read one after another, but changes wait until
+// GetMany has read all of them, so the objects are consistent with each
+// other. If any of the objects doesn't exist, GetMany returns an error that
+// wraps ErrNotFound, and out is left unchanged.
+func (c *Collection) GetMany(ids []Id, out interface{}) error {
+	slice := reflect.ValueOf(out)
+	if slice.Kind() != reflect.Ptr || slice.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("GetMany needs a pointer to a slice, not %T", out)
+	}
+	slice = slice.Elem()
+	elem_type := slice.Type().Elem()
+
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = fmt.Sprintf("%d", id)
+	}
+	c.db.mu.RLock()
+	objects, err := readMany(c.store, keys)
+	c.db.mu.RUnlock()
+	if err != nil {
+		return fmt.Errorf("reading objects failed: %w", err)
+	}
+	for i, data := range objects {
+		// storage backends may return no data instead of ErrNotFound.
+		if len(data) == 0 {
+			return fmt.Errorf("object %d: %w", ids[i], ErrNotFound)
+		}
+	}
+
+	values := slice
+	for i, data := range objects {
+		var value reflect.Value
+		if elem_type.Kind() == reflect.Ptr {
+			value = reflect.New(elem_type.Elem())
+		} else {
+			value = reflect.New(elem_type)
+		}
+		if err := c.codec.Unmarshal(data, value.Interface()); err != nil {
+			return fmt.Errorf("decoding object %d failed: %w", ids[i], err)
+		}
+		if elem_type.Kind() != reflect.Ptr {
+			value = value.Elem()
+		}
+		values = reflect.Append(values, value)
+	}
+	slice.Set(values)
+	return nil
+}
+
+// read returns the encoded object with the specified ID, or ErrNotFound if it
+// doesn't exist.
+func (c *Collection) read(id Id) ([]byte, error) {
+	data, err := c.store.Read(fmt.Sprintf("%d", id))
+	// storage backends that don't follow the StorageBackend interface
+	// may return no data instead of ErrNotFound.
+	if err == ErrNotFound || (err == nil && len(data) == 0) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading object %d failed: %w", id, err)
+	}
+	return data, nil
+}
@@ -0,0 +1,99 @@
+package epos
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestGet(t *testing.T) {
+	for _, typ := range availableStorageTypes(STORAGE_DISKV, STORAGE_LEVELDB, STORAGE_GOLEVELDB, STORAGE_MEMORY) {
+		db, err := OpenDatabase("testdb_get", typ)
+		if err != nil {
+			t.Fatalf("%s: couldn't open testdb_get: %v", typ, err)
+		}
+		books := db.Coll("books")
+		for _, book := range queryData[:3] {
+			books.Insert(book)
+		}
+
+		var b book
+		if err = books.Get(2, &b); err != nil || b.Title != queryData[1].Title {
+			t.Errorf("%s: Get returned %#v (error: %v)", typ, b, err)
+		}
+		if err = books.Get(42, &b); err != ErrNotFound {
+			t.Errorf("%s: Get of nonexistent object returned %v", typ, err)
+		}
+		if err = books.Get(1, new(int)); err == nil || err == ErrNotFound {
+			t.Errorf("%s: Get into wrong type returned %v", typ, err)
+		}
+		if !books.Exists(1) || books.Exists(42) {
+			t.Errorf("%s: Exists returned wrong results", typ)
+		}
+		books.Delete(1)
+		if books.Exists(1) {
+			t.Errorf("%s: deleted object still exists", typ)
+		}
+		if _, err = books.Revision(1); err != ErrNotFound {
+			t.Errorf("%s: Revision of deleted object returned %v", typ, err)
+		}
+
+		list := []book{}
+		if err = books.GetMany([]Id{3, 2}, &list); err != nil || len(list) != 2 || list[0].Title != queryData[2].Title || list[1].Title != queryData[1].Title {
+			t.Errorf("%s: GetMany returned %#v (error: %v)", typ, list, err)
+		}
+		pointers := []*book{}
+		if err = books.GetMany([]Id{2}, &pointers); err != nil || len(pointers) != 1 || pointers[0].Title != queryData[1].Title {
+			t.Errorf("%s: GetMany into pointers returned %#v (error: %v)", typ, pointers, err)
+		}
+		list = []book{}
+		if err = books.GetMany([]Id{2, 1}, &list); !errors.Is(err, ErrNotFound) || len(list) != 0 {
+			t.Errorf("%s: GetMany with deleted object returned %d objects (error: %v)", typ, len(list), err)
+		}
+		if err = books.GetMany([]Id{2}, list); err == nil {
+			t.Errorf("%s: GetMany without pointer succeeded", typ)
+		}
+
+		db.Close()
+		db.Remove()
+	}
+}
+
+func TestGetManyBatched(t *testing.T) {
+	for _, typ := range availableStorageTypes(STORAGE_LEVELDB, STORAGE_GOLEVELDB) {
+		db, err := OpenDatabaseWithOptions("testdb_get", &Options{Type: typ, EncryptionKey: make([]byte, 32), Compression: COMPRESSION_SNAPPY, CacheSize: 1 << 20})
+		if err != nil {
+			t.Fatalf("%s: couldn't open testdb_get: %v", typ, err)
+		}
+		books := db.Coll("books")
+		if _, ok := books.store.(MultiReader); !ok {
+			t.Errorf("%s: collection can't read objects at once", typ)
+		}
+		for i := 0; i < 12; i++ {
+			books.Insert(&book{Title: fmt.Sprintf("Book %d", i+1)})
+		}
+		var b book
+		books.Get(10, &b) // cached
+
+		// the IDs aren't in the order of their keys.
+		ids := []Id{12, 2, 10, 1, 2}
+		list := []book{}
+		if err = books.GetMany(ids, &list); err != nil || len(list) != len(ids) {
+			t.Fatalf("%s: GetMany returned %d objects (error: %v)", typ, len(list), err)
+		}
+		for i, id := range ids {
+			if list[i].Title != fmt.Sprintf("Book %d", id) {
+				t.Errorf("%s: GetMany returned %q for object %d", typ, list[i].Title, id)
+			}
+		}
+		if stats := books.CacheStats(); stats.Hits != 1 {
+			t.Errorf("%s: expected 1 cache hit, got %d", typ, stats.Hits)
+		}
+		if err = books.GetMany([]Id{3, 42}, &list); !errors.Is(err, ErrNotFound) {
+			t.Errorf("%s: GetMany with nonexistent object returned %v", typ, err)
+		}
+
+		db.Close()
+		db.Remove()
+	}
+}
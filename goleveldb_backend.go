@@ -0,0 +1,193 @@
+package epos
+
+import (
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// GoLevelDBStorageBackend is a storage backend based on goleveldb, a pure-Go
+// implementation of LevelDB. Unlike LevelDBStorageBackend, it doesn't
+// require cgo or a system installation of LevelDB.
+type GoLevelDBStorageBackend struct {
+	store    *leveldb.DB
+	ro       *opt.ReadOptions
+	wo       *opt.WriteOptions
+	unsynced *BatchOp
+}
+
+func NewGoLevelDBStorageBackend(path string, options *Options) (StorageBackend, error) {
+	opts := &opt.Options{
+		ErrorIfMissing: options.ReadOnly,
+		ReadOnly:       options.ReadOnly,
+	}
+	if options.LevelDBCacheSize > 0 {
+		opts.BlockCacheCapacity = options.LevelDBCacheSize
+	}
+
+	store, err := leveldb.OpenFile(path, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &GoLevelDBStorageBackend{
+		store: store,
+		ro:    &opt.ReadOptions{DontFillCache: options.LevelDBCacheSize == 0},
+		wo:    &opt.WriteOptions{Sync: options.Durability == DURABILITY_SYNC},
+	}, nil
+}
+
+func (s *GoLevelDBStorageBackend) Read(key string) ([]byte, error) {
+	data, err := s.store.Get([]byte(key), s.ro)
+	if err == leveldb.ErrNotFound {
+		return nil, ErrNotFound
+	}
+	return data, err
+}
+
+func (s *GoLevelDBStorageBackend) Write(key string, value []byte) error {
+	s.track(BatchOp{Key: key, Value: value})
+	return s.store.Put([]byte(key), value, s.wo)
+}
+
+func (s *GoLevelDBStorageBackend) Erase(key string) error {
+	s.track(BatchOp{Key: key, Erase: true})
+	return s.store.Delete([]byte(key), s.wo)
+}
+
+func (s *GoLevelDBStorageBackend) WriteBatch(ops []BatchOp) error {
+	batch := new(leveldb.Batch)
+	for _, op := range ops {
+		if op.Erase {
+			batch.Delete([]byte(op.Key))
+		} else {
+			batch.Put([]byte(op.Key), op.Value)
+		}
+	}
+
+	if len(ops) > 0 {
+		s.track(ops[len(ops)-1])
+	}
+
+	return s.store.Write(batch, s.wo)
+}
+
+// track remembers the most recent operation if writes aren't synced.
+func (s *GoLevelDBStorageBackend) track(op BatchOp) {
+	if !s.wo.Sync {
+		s.unsynced = &op
+	}
+}
+
+// Sync commits all previous writes to stable storage. goleveldb has no
+// explicit sync operation, so the most recent operation is repeated as a
+// synchronous write, which syncs the journal including all earlier writes.
+func (s *GoLevelDBStorageBackend) Sync() error {
+	if s.unsynced == nil {
+		return nil
+	}
+
+	batch := new(leveldb.Batch)
+	if s.unsynced.Erase {
+		batch.Delete([]byte(s.unsynced.Key))
+	} else {
+		batch.Put([]byte(s.unsynced.Key), s.unsynced.Value)
+	}
+	s.unsynced = nil
+
+	return s.store.Write(batch, &opt.WriteOptions{Sync: true})
+}
+
+func (s *GoLevelDBStorageBackend) Compact() error {
+	return s.store.CompactRange(util.Range{})
+}
+
+func (s *GoLevelDBStorageBackend) Close() error {
+	return s.store.Close()
+}
+
+func (s *GoLevelDBStorageBackend) Keys() <-chan string {
+	ch := make(chan string)
+
+	go func() {
+		it := s.store.NewIterator(nil, s.ro)
+		defer it.Release()
+
+		for it.Next() {
+			ch <- string(it.Key())
+		}
+
+		close(ch)
+	}()
+
+	return ch
+}
+
+func (s *GoLevelDBStorageBackend) Range(start, end string) Iterator {
+	r := &util.Range{Start: []byte(start)}
+	if end != "" {
+		r.Limit = []byte(end)
+	}
+	return &goLevelDBIterator{it: s.store.NewIterator(r, s.ro)}
+}
+
+func (s *GoLevelDBStorageBackend) Snapshot() (Iterator, error) {
+	snap, err := s.store.GetSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	return &goLevelDBIterator{it: snap.NewIterator(nil, s.ro), snap: snap}, nil
+}
+
+// ReadMany reads keys from a snapshot in a single pass of an iterator over
+// the sorted keys.
+func (s *GoLevelDBStorageBackend) ReadMany(keys []string) ([][]byte, error) {
+	values := make([][]byte, len(keys))
+	if len(keys) == 0 {
+		return values, nil
+	}
+	order := sortedKeys(keys)
+
+	snap, err := s.store.GetSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer snap.Release()
+	r := &util.Range{Start: []byte(keys[order[0]]), Limit: []byte(keys[order[len(order)-1]] + "\x00")}
+	it := snap.NewIterator(r, s.ro)
+	defer it.Release()
+
+	for _, i := range order {
+		if it.Seek([]byte(keys[i])) && string(it.Key()) == keys[i] {
+			values[i] = append([]byte{}, it.Value()...)
+		}
+	}
+	return values, it.Error()
+}
+
+type goLevelDBIterator struct {
+	it   iterator.Iterator
+	snap *leveldb.Snapshot // released when the iterator is closed, if set.
+}
+
+func (i *goLevelDBIterator) Next() bool {
+	return i.it.Next()
+}
+
+func (i *goLevelDBIterator) Key() string {
+	return string(i.it.Key())
+}
+
+// Value returns a copy of the current value, as goleveldb reuses its buffer.
+func (i *goLevelDBIterator) Value() []byte {
+	return append([]byte{}, i.it.Value()...)
+}
+
+func (i *goLevelDBIterator) Close() error {
+	i.it.Release()
+	if i.snap != nil {
+		i.snap.Release()
+	}
+	return i.it.Error()
+}
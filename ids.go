@@ -0,0 +1,447 @@
+package epos
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ID strategies determine how a collection generates the IDs of new objects.
+//
+// The UUID, ULID and key strategies give objects a key, which identifies them
+// across databases: GetByKey, QueryKey, UpdateByKey, DeleteByKey and
+// UpsertWithKey address objects by their key, Result.Key returns it, and
+// Import matches objects by their key, so collections of different databases
+// are merged by exporting the objects of one and importing them into the
+// other. Within a database, every object also has an ID that is allocated
+// from the ID counter of its collection and mapped to its key; indexes and
+// conditions refer to objects by that ID. IDs differ between databases,
+// except with ID_SNOWFLAKE.
+const (
+	// ID_SEQUENCE numbers objects 1, 2, 3, ... This is the default.
+	ID_SEQUENCE = "sequence"
+	// ID_SNOWFLAKE generates IDs from the time of the insert, the NodeId of
+	// the database and a sequence number, so that databases with
+	// different node IDs never generate the same ID.
+	ID_SNOWFLAKE = "snowflake"
+	// ID_UUID4 gives objects a random UUID as key.
+	ID_UUID4 = "uuid4"
+	// ID_UUID7 gives objects a UUID that starts with the time of the
+	// insert as key.
+	ID_UUID7 = "uuid7"
+	// ID_ULID gives objects a ULID as key.
+	ID_ULID = "ulid"
+	// ID_KEY requires the caller to supply the key of each object with
+	// InsertWithKey.
+	ID_KEY = "key"
+)
+
+// MAX_KEY_LENGTH is the maximum length of a key in bytes.
+const MAX_KEY_LENGTH = 100
+
+// Snowflake IDs consist of the milliseconds since SNOWFLAKE_EPOCH, the node
+// ID and a sequence number.
+const (
+	SNOWFLAKE_EPOCH   = 1356998400000 // 2013-01-01 00:00:00 UTC, in milliseconds.
+	snowflakeNodeBits = 10
+	snowflakeSeqBits  = 12
+)
+
+// ErrKeyExists is returned by InsertWithKey if the collection already
+// contains an object with the key.
+var ErrKeyExists = errors.New("key already exists")
+
+func checkIdStrategy(strategy string) error {
+	switch strategy {
+	case ID_SEQUENCE, ID_SNOWFLAKE, ID_UUID4, ID_UUID7, ID_ULID, ID_KEY:
+		return nil
+	}
+	return fmt.Errorf("unknown ID strategy %s", strategy)
+}
+
+// snowflakeId returns the snowflake ID for an object inserted at now, which
+// is at least next_id, so that IDs keep increasing even if the clock goes
+// backwards.
+func snowflakeId(next_id Id, node int, now time.Time) Id {
+	ms := now.UnixNano()/int64(time.Millisecond) - SNOWFLAKE_EPOCH
+	id := Id(ms<<(snowflakeNodeBits+snowflakeSeqBits) | int64(node)<<snowflakeSeqBits)
+	if id >= next_id {
+		return id
+	}
+	// once the sequence number overflows, or if next_id belongs to a
+	// different node, the IDs of the next millisecond are used.
+	id = next_id
+	if int(id>>snowflakeSeqBits)&(1<<snowflakeNodeBits-1) != node {
+		ms = int64(id)>>(snowflakeNodeBits+snowflakeSeqBits) + 1
+		id = Id(ms<<(snowflakeNodeBits+snowflakeSeqBits) | int64(node)<<snowflakeSeqBits)
+	}
+	return id
+}
+
+// allocId returns the ID of a new object, given the current value of the ID
+// counter. The counter must be set to the returned ID + 1.
+func (c *Collection) allocId(next_id Id) Id {
+	if c.meta.IdStrategy == ID_SNOWFLAKE {
+		return snowflakeId(next_id, c.db.opts.NodeId, time.Now())
+	}
+	return next_id
+}
+
+// newUUID returns a version 4 UUID, or a version 7 UUID if version is 7.
+func newUUID(version int) string {
+	u := make([]byte, 16)
+	rand.Read(u)
+	if version == 7 {
+		ms := make([]byte, 8)
+		binary.BigEndian.PutUint64(ms, uint64(time.Now().UnixNano()/int64(time.Millisecond)))
+		copy(u, ms[2:])
+	}
+	u[6] = u[6]&0x0f | byte(version)<<4
+	u[8] = u[8]&0x3f | 0x80
+	s := hex.EncodeToString(u)
+	return s[0:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:32]
+}
+
+const crockfordAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// newULID returns a ULID: 48 bits of milliseconds and 80 random bits, encoded
+// in 26 characters of Crockford's base32.
+func newULID() string {
+	u := make([]byte, 16)
+	ms := make([]byte, 8)
+	binary.BigEndian.PutUint64(ms, uint64(time.Now().UnixNano()/int64(time.Millisecond)))
+	copy(u, ms[2:])
+	rand.Read(u[6:])
+
+	// the 128 bits are encoded 5 bits at a time, starting with the 3 bits
+	// that are left over at the top.
+	hi, lo := binary.BigEndian.Uint64(u[:8]), binary.BigEndian.Uint64(u[8:])
+	s := make([]byte, 26)
+	for i := 25; i >= 0; i-- {
+		s[i] = crockfordAlphabet[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(s)
+}
+
+// newKey returns a new key according to the collection's ID strategy, or ""
+// if the collection doesn't generate keys.
+func (c *Collection) newKey() string {
+	switch c.meta.IdStrategy {
+	case ID_UUID4:
+		return newUUID(4)
+	case ID_UUID7:
+		return newUUID(7)
+	case ID_ULID:
+		return newULID()
+	}
+	return ""
+}
+
+// keyOf and idOfKey return the internal keys under which the mapping between
+// the key of an object and its ID is stored. Keys are stored hex-encoded, so
+// that any key can be stored by any storage backend. Internal keys bypass the
+// encryption of the storage backend, so encrypted databases encrypt the
+// mapping themselves, and store the ID of a key under an HMAC of the key, so
+// that keys never appear in plaintext.
+func keyOf(id_str string) string {
+	return "_keyof_" + id_str
+}
+
+func idOfKey(keys *keyring, key string) string {
+	if keys == nil {
+		return "_key_" + hex.EncodeToString([]byte(key))
+	}
+	return "_keymac_" + hex.EncodeToString(keys.mac(keys.current, []byte(key)))
+}
+
+// keyNames returns all internal keys under which the ID of the object with
+// the specified key may be stored, starting with idOfKey. Mappings are only
+// moved to the current encryption key by RotateKey, so in encrypted databases,
+// they may also be stored under the HMAC of a previous key, or unencrypted.
+func keyNames(keys *keyring, key string) []string {
+	names := []string{}
+	if keys != nil {
+		for _, id := range keys.ids() {
+			names = append(names, "_keymac_"+hex.EncodeToString(keys.mac(id, []byte(key))))
+		}
+	}
+	return append(names, idOfKey(nil, key))
+}
+
+// sealKey encrypts a value of the key mapping that is stored under name, if
+// the database is encrypted, and openKey decrypts it again.
+func sealKey(keys *keyring, name string, value []byte) []byte {
+	if keys == nil {
+		return value
+	}
+	return append([]byte(encryptionMagic), keys.seal(value, []byte(name))...)
+}
+
+func openKey(keys *keyring, name string, data []byte) ([]byte, error) {
+	if keys == nil || !isEncrypted(data) {
+		return data, nil
+	}
+	return keys.open(data[len(encryptionMagic):], []byte(name))
+}
+
+// keyOps returns the write-ahead log operations that map key to the ID id_str.
+func (c *Collection) keyOps(key, id_str string) []walOp {
+	keys := c.db.opts.keys
+	name := idOfKey(keys, key)
+	return []walOp{
+		{typ: walUpdate, coll: c.name, key: name, data: sealKey(keys, name, []byte(id_str))},
+		{typ: walUpdate, coll: c.name, key: keyOf(id_str), data: sealKey(keys, keyOf(id_str), []byte(key))},
+	}
+}
+
+// unkeyOps returns the storage operations that remove the key of the object
+// with the ID id_str, if it has one.
+func (c *Collection) unkeyOps(id_str string) []BatchOp {
+	key := storedKey(c.raw, c.db.opts.keys, id_str)
+	if key == "" {
+		return nil
+	}
+	ops := []BatchOp{}
+	for _, name := range keyNames(c.db.opts.keys, key) {
+		if _, err := c.raw.Read(name); err == nil {
+			ops = append(ops, BatchOp{Key: name, Erase: true})
+		}
+	}
+	return append(ops, BatchOp{Key: keyOf(id_str), Erase: true})
+}
+
+// lookup returns the ID of the object with the specified key, or 0 if there
+// is no such object.
+func (c *Collection) lookup(key string) Id {
+	for _, name := range keyNames(c.db.opts.keys, key) {
+		data, err := c.raw.Read(name)
+		if err == nil {
+			data, err = openKey(c.db.opts.keys, name, data)
+		}
+		if err != nil {
+			continue
+		}
+		if id, err := strconv.ParseInt(string(data), 10, 64); err == nil && c.Exists(Id(id)) {
+			return Id(id)
+		}
+	}
+	return 0
+}
+
+// Lookup returns the ID of the object with the specified key, which can be
+// used with all other operations of the collection. The key of objects
+// without a key is their ID. It returns ErrNotFound if there is no object
+// with the key.
+func (c *Collection) Lookup(key string) (Id, error) {
+	if id := c.lookup(key); id != 0 {
+		return id, nil
+	}
+	if id, err := strconv.ParseInt(key, 10, 64); err == nil && c.Exists(Id(id)) && storedKey(c.raw, c.db.opts.keys, key) == "" {
+		return Id(id), nil
+	}
+	return 0, ErrNotFound
+}
+
+// Key returns the key of an object, or its ID as decimal string if it
+// doesn't have a key. It returns ErrNotFound if the object doesn't exist.
+func (c *Collection) Key(id Id) (string, error) {
+	if !c.Exists(id) {
+		return "", ErrNotFound
+	}
+	return readKey(c.raw, c.db.opts.keys, id), nil
+}
+
+// readKey returns the key of the object with the specified ID, as stored in
+// store, or its ID if it doesn't have a key.
+func readKey(store StorageBackend, keys *keyring, id Id) string {
+	id_str := fmt.Sprintf("%d", id)
+	if key := storedKey(store, keys, id_str); key != "" {
+		return key
+	}
+	return id_str
+}
+
+// storedKey returns the key of the object with the ID id_str, or "" if it
+// doesn't have a key.
+func storedKey(store StorageBackend, keys *keyring, id_str string) string {
+	data, err := store.Read(keyOf(id_str))
+	if err != nil {
+		return ""
+	}
+	key, err := openKey(keys, keyOf(id_str), data)
+	if err != nil {
+		return ""
+	}
+	return string(key)
+}
+
+// rewriteKeys stores the keys of all objects again, so that they are
+// encrypted with the current encryption key of the database.
+func (c *Collection) rewriteKeys() error {
+	id_strs := []string{}
+	for key := range c.raw.Keys() {
+		if strings.HasPrefix(key, keyOf("")) {
+			id_strs = append(id_strs, strings.TrimPrefix(key, keyOf("")))
+		}
+	}
+
+	ops := []BatchOp{}
+	for _, id_str := range id_strs {
+		key := storedKey(c.raw, c.db.opts.keys, id_str)
+		if key == "" {
+			continue
+		}
+		ops = append(ops, c.unkeyOps(id_str)...)
+		for _, op := range c.keyOps(key, id_str) {
+			ops = append(ops, BatchOp{Key: op.key, Value: op.data})
+		}
+		if len(ops) >= rewriteBatchSize {
+			if err := writeBatch(c.store, ops); err != nil {
+				return err
+			}
+			ops = ops[:0]
+		}
+	}
+	c.dirty = true
+	return writeBatch(c.store, ops)
+}
+
+func validateKey(key string) error {
+	if key == "" || len(key) > MAX_KEY_LENGTH {
+		return fmt.Errorf("keys must be 1 to %d bytes long", MAX_KEY_LENGTH)
+	}
+	return nil
+}
+
+// InsertKey inserts an object into the collection, and returns its key. The
+// key is generated according to the collection's ID strategy; collections
+// without keys return the ID of the object as decimal string.
+func (c *Collection) InsertKey(value interface{}) (string, error) {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+
+	id, err := c.insert(value)
+	if err != nil {
+		return "", err
+	}
+	return readKey(c.raw, c.db.opts.keys, id), nil
+}
+
+// InsertWithKey inserts an object with a key chosen by the caller, e.g. a
+// natural key or a key that has been generated by another node, into the
+// collection, and returns its ID. It returns ErrKeyExists if the collection
+// already contains an object with the same key.
+func (c *Collection) InsertWithKey(key string, value interface{}) (Id, error) {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	return c.insertWithKey(key, value)
+}
+
+func (c *Collection) insertWithKey(key string, value interface{}) (Id, error) {
+	if err := c.db.checkWritable(); err != nil {
+		return Id(0), err
+	}
+	if err := validateKey(key); err != nil {
+		return Id(0), err
+	}
+	if c.lookup(key) != 0 {
+		return Id(0), ErrKeyExists
+	}
+
+	data, err := c.codec.Marshal(value)
+	if err != nil {
+		return Id(0), err
+	}
+
+	next, _ := c.store.Read("_next_id")
+	next_id, _ := binary.Varint(next)
+	id := c.allocId(Id(next_id))
+	id_str := fmt.Sprintf("%d", id)
+	ops := append([]walOp{{typ: walInsert, coll: c.name, key: id_str, data: data}}, c.keyOps(key, id_str)...)
+	if err = c.commitBatch(append(ops, c.nextIdOp(id+1))); err != nil {
+		return Id(0), err
+	}
+	return id, nil
+}
+
+// GetByKey decodes the object with the specified key into out, like Get. It
+// returns ErrNotFound if there is no object with the key.
+func (c *Collection) GetByKey(key string, out interface{}) error {
+	c.db.mu.RLock()
+	id, err := c.Lookup(key)
+	var data []byte
+	if err == nil {
+		data, err = c.read(id)
+	}
+	c.db.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	return c.decode(id, data, out)
+}
+
+// QueryKey returns a Result object that will deliver the object with the
+// specified key, or no object if there is no object with the key.
+func (c *Collection) QueryKey(key string) (*Result, error) {
+	c.db.mu.RLock()
+	id, err := c.Lookup(key)
+	c.db.mu.RUnlock()
+	if err == ErrNotFound {
+		return newResult(c, []Id{}), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c.QueryId(id)
+}
+
+// UpdateByKey replaces the object with the specified key with a new object,
+// which keeps the key. It returns ErrNotFound if there is no object with the
+// key.
+func (c *Collection) UpdateByKey(key string, value interface{}) error {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+
+	id, err := c.Lookup(key)
+	if err != nil {
+		return err
+	}
+	return c.update(id, value)
+}
+
+// DeleteByKey deletes the object with the specified key. It returns
+// ErrNotFound if there is no object with the key.
+func (c *Collection) DeleteByKey(key string) error {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+
+	id, err := c.Lookup(key)
+	if err != nil {
+		return err
+	}
+	return c.delete(id)
+}
+
+// UpsertWithKey replaces the object with the specified key with value, or
+// inserts value with the key if there is no object with the key, and returns
+// the ID of the object.
+func (c *Collection) UpsertWithKey(key string, value interface{}) (Id, error) {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+
+	id, err := c.Lookup(key)
+	if err == ErrNotFound {
+		return c.insertWithKey(key, value)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return id, c.update(id, value)
+}
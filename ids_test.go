@@ -0,0 +1,255 @@
+package epos
+
+import (
+	"bytes"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestKeyStrategies(t *testing.T) {
+	db, err := OpenDatabase("testdb_ids", STORAGE_DISKV)
+	if err != nil {
+		t.Fatalf("couldn't open testdb_ids: %v", err)
+	}
+	defer db.Remove()
+	defer db.Close()
+
+	formats := map[string]*regexp.Regexp{
+		ID_UUID4: regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`),
+		ID_UUID7: regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`),
+		ID_ULID:  regexp.MustCompile(`^[0-7][0-9A-HJKMNP-TV-Z]{25}$`),
+	}
+	for strategy, format := range formats {
+		coll, err := db.CollWithOptions("coll_"+strategy, &CollectionOptions{IdStrategy: strategy})
+		if err != nil {
+			t.Fatalf("%s: CollWithOptions failed: %v", strategy, err)
+		}
+		coll.AddIndex("Author")
+
+		key, err := coll.InsertKey(&book{Title: "First", Author: "Someone"})
+		if err != nil || !format.MatchString(key) {
+			t.Errorf("%s: InsertKey returned key %q (error: %v)", strategy, key, err)
+		}
+		ids, _ := coll.InsertMany([]interface{}{&book{Title: "Second"}, &book{Title: "Third"}})
+		other, _ := coll.Key(ids[1])
+		if !format.MatchString(other) || other == key {
+			t.Errorf("%s: object inserted with InsertMany has key %q", strategy, other)
+		}
+
+		id, err := coll.Lookup(key)
+		var b book
+		if err != nil || coll.Get(id, &b) != nil || b.Title != "First" {
+			t.Errorf("%s: Lookup returned %d (error: %v)", strategy, id, err)
+		}
+		result, _ := coll.Query(&Equals{Field: "Author", Value: "Someone"})
+		if !result.Next(nil, &b) || result.Key() != key {
+			t.Errorf("%s: Result.Key returned %q", strategy, result.Key())
+		}
+
+		coll.Delete(id)
+		if _, err = coll.Lookup(key); err != ErrNotFound {
+			t.Errorf("%s: Lookup of deleted object returned %v", strategy, err)
+		}
+		coll.DeleteMany(ids)
+		if _, err = coll.Lookup(other); err != ErrNotFound {
+			t.Errorf("%s: Lookup of object deleted with DeleteMany returned %v", strategy, err)
+		}
+	}
+
+	if _, err = db.CollWithOptions("coll_"+ID_ULID, &CollectionOptions{IdStrategy: ID_UUID4}); err == nil {
+		t.Errorf("opening collection with different ID strategy succeeded")
+	}
+	if _, err = db.CollWithOptions("invalid", &CollectionOptions{IdStrategy: "random"}); err == nil {
+		t.Errorf("creating collection with invalid ID strategy succeeded")
+	}
+	if key, err := db.Coll("sequence").InsertKey(&book{}); err != nil || key != "1" {
+		t.Errorf("InsertKey into sequence collection returned %q (error: %v)", key, err)
+	}
+}
+
+func TestInsertWithKey(t *testing.T) {
+	db, err := OpenDatabase("testdb_ids", STORAGE_AUTO)
+	if err != nil {
+		t.Fatalf("couldn't open testdb_ids: %v", err)
+	}
+	defer db.Remove()
+	defer db.Close()
+	users, _ := db.CollWithOptions("users", &CollectionOptions{IdStrategy: ID_KEY})
+
+	if _, err = users.Insert(&account{Login: "nokey"}); err == nil {
+		t.Errorf("Insert without key succeeded")
+	}
+	id, err := users.InsertWithKey("alice", &account{Login: "alice"})
+	if err != nil {
+		t.Fatalf("InsertWithKey failed: %v", err)
+	}
+	if _, err = users.InsertWithKey("alice", &account{Login: "other"}); err != ErrKeyExists {
+		t.Errorf("InsertWithKey of existing key returned %v", err)
+	}
+	if _, err = users.InsertWithKey("", &account{}); err == nil {
+		t.Errorf("InsertWithKey of empty key succeeded")
+	}
+	if key, err := users.Key(id); err != nil || key != "alice" {
+		t.Errorf("Key returned %q (error: %v)", key, err)
+	}
+	if found, err := users.Lookup("alice"); err != nil || found != id {
+		t.Errorf("Lookup returned %d (error: %v)", found, err)
+	}
+	// the ID of an object with a key isn't its key.
+	if _, err = users.Lookup("1"); err != ErrNotFound {
+		t.Errorf("Lookup of ID of object with key returned %v", err)
+	}
+
+	users.Delete(id)
+	if _, err = users.InsertWithKey("alice", &account{Login: "alice"}); err != nil {
+		t.Errorf("InsertWithKey of key of deleted object failed: %v", err)
+	}
+	if report, err := db.Check(); err != nil || !report.OK() {
+		t.Errorf("database with keys is inconsistent: %#v (error: %v)", report.Collections[0], err)
+	}
+}
+
+func TestKeyOperations(t *testing.T) {
+	db, err := OpenDatabase("testdb_ids", STORAGE_AUTO)
+	if err != nil {
+		t.Fatalf("couldn't open testdb_ids: %v", err)
+	}
+	defer db.Remove()
+	defer db.Close()
+	users, _ := db.CollWithOptions("users", &CollectionOptions{IdStrategy: ID_KEY})
+
+	id, err := users.UpsertWithKey("alice", &account{Login: "alice"})
+	if err != nil {
+		t.Fatalf("UpsertWithKey of new key failed: %v", err)
+	}
+	if upserted, err := users.UpsertWithKey("alice", &account{Login: "alice", Name: "Alice"}); err != nil || upserted != id {
+		t.Errorf("UpsertWithKey of existing key returned %d (error: %v)", upserted, err)
+	}
+	var a account
+	if err = users.GetByKey("alice", &a); err != nil || a.Name != "Alice" {
+		t.Errorf("GetByKey returned %#v (error: %v)", a, err)
+	}
+	if err = users.GetByKey("bob", &a); err != ErrNotFound {
+		t.Errorf("GetByKey of nonexistent key returned %v", err)
+	}
+
+	if err = users.UpdateByKey("alice", &account{Login: "alice", Name: "Alice Smith"}); err != nil {
+		t.Errorf("UpdateByKey failed: %v", err)
+	}
+	result, _ := users.QueryKey("alice")
+	if !result.Next(nil, &a) || a.Name != "Alice Smith" || result.Key() != "alice" {
+		t.Errorf("QueryKey returned %#v with key %q", a, result.Key())
+	}
+	if result, _ = users.QueryKey("bob"); result.Count() != 0 {
+		t.Errorf("QueryKey of nonexistent key returned %d objects", result.Count())
+	}
+	if err = users.UpdateByKey("bob", &account{}); err != ErrNotFound {
+		t.Errorf("UpdateByKey of nonexistent key returned %v", err)
+	}
+
+	if err = users.DeleteByKey("alice"); err != nil {
+		t.Errorf("DeleteByKey failed: %v", err)
+	}
+	if users.Exists(id) {
+		t.Errorf("object deleted by key still exists")
+	}
+	if err = users.DeleteByKey("alice"); err != ErrNotFound {
+		t.Errorf("DeleteByKey of deleted key returned %v", err)
+	}
+}
+
+func TestSnowflakeIds(t *testing.T) {
+	db, err := OpenDatabaseWithOptions("testdb_ids", &Options{NodeId: 5})
+	if err != nil {
+		t.Fatalf("couldn't open testdb_ids: %v", err)
+	}
+	defer db.Remove()
+	defer db.Close()
+	events, _ := db.CollWithOptions("events", &CollectionOptions{IdStrategy: ID_SNOWFLAKE})
+
+	last := Id(0)
+	for i := 0; i < 100; i++ {
+		id, err := events.Insert(&book{Title: "Event"})
+		if err != nil || id <= last || (id>>snowflakeSeqBits)&(1<<snowflakeNodeBits-1) != 5 {
+			t.Fatalf("Insert returned ID %x after %x (error: %v)", id, last, err)
+		}
+		last = id
+	}
+	if report, err := db.Check(); err != nil || !report.OK() {
+		t.Errorf("database with snowflake IDs is inconsistent (error: %v)", err)
+	}
+	if result, _ := events.QueryAll(); result.Count() != 100 {
+		t.Errorf("QueryAll returned %d objects", result.Count())
+	}
+
+	// IDs keep increasing if the clock goes backwards or the sequence
+	// number overflows.
+	now := time.Now()
+	id := snowflakeId(0, 5, now)
+	if next := snowflakeId(id+1, 5, now.Add(-time.Second)); next != id+1 {
+		t.Errorf("ID after clock went backwards is %x, expected %x", next, id+1)
+	}
+	full := id | (1<<snowflakeSeqBits - 1)
+	if next := snowflakeId(full+1, 5, now); next <= full || (next>>snowflakeSeqBits)&(1<<snowflakeNodeBits-1) != 5 {
+		t.Errorf("ID after overflow is %x", next)
+	}
+
+	if _, err = db.CollWithOptions("other", &CollectionOptions{IdStrategy: ID_SNOWFLAKE}); err != nil {
+		t.Errorf("creating second snowflake collection failed: %v", err)
+	}
+	db2, err := OpenDatabaseWithOptions("testdb_ids_node", &Options{NodeId: 1024})
+	if err != nil {
+		t.Fatalf("couldn't open testdb_ids_node: %v", err)
+	}
+	defer db2.Remove()
+	defer db2.Close()
+	if _, err = db2.CollWithOptions("events", &CollectionOptions{IdStrategy: ID_SNOWFLAKE}); err == nil {
+		t.Errorf("snowflake collection with invalid node ID succeeded")
+	}
+}
+
+func TestMergeKeys(t *testing.T) {
+	opts := &CollectionOptions{IdStrategy: ID_UUID7}
+	a, _ := OpenDatabase("testdb_ids", STORAGE_AUTO)
+	defer a.Remove()
+	defer a.Close()
+	b, _ := OpenDatabase("testdb_ids_b", STORAGE_AUTO)
+	defer b.Remove()
+	defer b.Close()
+	notes_a, _ := a.CollWithOptions("notes", opts)
+	notes_b, _ := b.CollWithOptions("notes", opts)
+
+	key_a, _ := notes_a.InsertKey(&book{Title: "From A"})
+	notes_b.InsertKey(&book{Title: "From B"})
+
+	// both objects have ID 1, but different keys.
+	buf := bytes.NewBuffer([]byte{})
+	if err := notes_a.ExportJSONL(buf); err != nil {
+		t.Fatalf("ExportJSONL failed: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if n, err := notes_b.ImportJSONL(bytes.NewReader(buf.Bytes())); err != nil || n != 1 {
+			t.Fatalf("ImportJSONL returned %d (error: %v)", n, err)
+		}
+	}
+	if result, _ := notes_b.QueryAll(); result.Count() != 2 {
+		t.Errorf("merged collection has %d objects, expected 2", result.Count())
+	}
+	id, err := notes_b.Lookup(key_a)
+	var note book
+	if err != nil || notes_b.Get(id, &note) != nil || note.Title != "From A" {
+		t.Errorf("merged object %d is %#v (error: %v)", id, note, err)
+	}
+
+	buf.Reset()
+	if err = notes_b.ExportArchive(buf); err != nil {
+		t.Fatalf("ExportArchive failed: %v", err)
+	}
+	if n, err := a.ImportArchive(bytes.NewReader(buf.Bytes()), ""); err != nil || n != 2 {
+		t.Fatalf("ImportArchive returned %d (error: %v)", n, err)
+	}
+	if result, _ := notes_a.QueryAll(); result.Count() != 2 {
+		t.Errorf("collection has %d objects after importing archive, expected 2", result.Count())
+	}
+}
@@ -1,15 +1,36 @@
 package epos
 
 import (
+	"bytes"
 	"encoding/binary"
+	"fmt"
 	"io"
 	"os"
 )
 
+// Index files start with a header that consists of indexMagic, the version
+// of the file format and a byte of flags. Index files that have been written
+// by earlier versions have no header; they start with the deleted flag of the
+// first entry, which is never indexMagic's first byte.
+//
+// Since version 2, every entry is followed by the CRC-32C of the entry
+// without its deleted flag, which is overwritten when the entry is removed.
+const (
+	indexMagic   = "EPIX"
+	indexVersion = 2
+
+	// the values of all entries are encrypted.
+	indexFlagEncrypted = 1 << 0
+)
+
 type index struct {
-	file  *os.File
-	field string
-	data  map[string][]indexEntry
+	file      file
+	field     string
+	data      map[string][]indexEntry
+	dirty     bool
+	keys      *keyring // encrypts the values in the index file if not nil
+	checksums bool     // entries are followed by a checksum
+	corrupt   []*CorruptError
 }
 
 type indexEntry struct {
@@ -19,11 +40,85 @@ type indexEntry struct {
 	fpos    int64
 }
 
-func newIndex(file *os.File, field string) *index {
-	idx := &index{file: file, field: field, data: make(map[string][]indexEntry)}
+func newIndex(file file, field string, keys *keyring) *index {
+	idx := &index{file: file, field: field, data: make(map[string][]indexEntry), keys: keys, checksums: true}
 	return idx
 }
 
+// writeHeader writes the header of a new index file.
+func (idx *index) writeHeader() error {
+	flags := byte(0)
+	if idx.keys != nil {
+		flags |= indexFlagEncrypted
+	}
+	_, err := idx.file.Write(append([]byte(indexMagic), indexVersion, flags))
+	return err
+}
+
+// readHeader reads the header of an index file, and leaves the file at the
+// first entry. keys are used if the index file is encrypted.
+func (idx *index) readHeader(keys *keyring) error {
+	hdr := make([]byte, len(indexMagic)+2)
+	if _, err := io.ReadFull(idx.file, hdr); err != nil || string(hdr[:len(indexMagic)]) != indexMagic {
+		idx.checksums = false
+		_, err = idx.file.Seek(0, os.SEEK_SET)
+		return err
+	}
+	version := hdr[len(indexMagic)]
+	if version < 1 || version > indexVersion {
+		return fmt.Errorf("unsupported index file version %d", version)
+	}
+	idx.checksums = version >= 2
+	if hdr[len(indexMagic)+1]&indexFlagEncrypted != 0 {
+		if keys == nil {
+			return ErrWrongKey
+		}
+		idx.keys = keys
+	}
+	return nil
+}
+
+// readEntry reads the next entry from the index file, verifies its checksum
+// and decrypts its value if necessary. It returns io.EOF at the end of the
+// file, io.ErrUnexpectedEOF if the last entry is incomplete and a
+// CorruptError if the entry fails its checksum.
+func (idx *index) readEntry() (indexEntry, error) {
+	var e indexEntry
+	fpos, err := idx.file.Seek(0, os.SEEK_CUR)
+	if err != nil {
+		return e, err
+	}
+	e.fpos = fpos
+	if !idx.checksums {
+		if _, err = e.ReadFrom(idx.file); err != nil {
+			return e, err
+		}
+	} else {
+		buf := bytes.NewBuffer([]byte{})
+		if _, err = e.ReadFrom(io.TeeReader(idx.file, buf)); err != nil {
+			return e, err
+		}
+		var sum uint32
+		if err = binary.Read(idx.file, binary.BigEndian, &sum); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return e, err
+		}
+		if checksum(buf.Bytes()[1:]) != sum {
+			return e, &CorruptError{Index: idx.field, Offset: fpos, Reason: "checksum mismatch"}
+		}
+	}
+	if idx.keys != nil {
+		value, err := idx.keys.open([]byte(e.value), []byte(idx.field))
+		if err != nil {
+			return e, err
+		}
+		e.value = string(value)
+	}
+	return e, nil
+}
+
 func (idx *index) Add(e indexEntry) {
 	if entry_list, contains := idx.data[e.value]; contains {
 		entry_list = append(entry_list, e)
@@ -33,6 +128,66 @@ func (idx *index) Add(e indexEntry) {
 	}
 }
 
+// append writes an entry to the end of the index file and adds it to the
+// index. The index file isn't synced; use sync for that.
+func (idx *index) append(e indexEntry) error {
+	fpos, err := idx.file.Seek(0, os.SEEK_END)
+	if err != nil {
+		return err
+	}
+	idx.dirty = true
+	stored := e
+	if idx.keys != nil {
+		stored.value = string(idx.keys.seal([]byte(e.value), []byte(idx.field)))
+	}
+	// the entry is written at once, so that it is either complete or
+	// truncated, but never interleaved.
+	buf := bytes.NewBuffer([]byte{})
+	stored.WriteTo(buf)
+	if idx.checksums {
+		binary.Write(buf, binary.BigEndian, checksum(buf.Bytes()[1:]))
+	}
+	if _, err = idx.file.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	e.fpos = fpos
+	idx.Add(e)
+	return nil
+}
+
+// remove marks all entries that refer to id as deleted in the index file and
+// removes them from the index.
+func (idx *index) remove(id int64) {
+	for key, entries := range idx.data {
+		new_entries := []indexEntry{}
+		for _, e := range entries {
+			if e.id != id {
+				new_entries = append(new_entries, e)
+			} else {
+				// only the deleted flag at the start of the entry
+				// is overwritten.
+				idx.file.Seek(e.fpos, os.SEEK_SET)
+				idx.file.Write([]byte{1})
+				idx.dirty = true
+			}
+		}
+		if len(new_entries) > 0 {
+			idx.data[key] = new_entries
+		} else {
+			delete(idx.data, key)
+		}
+	}
+}
+
+// sync commits all changes to the index file to stable storage.
+func (idx *index) sync() error {
+	if !idx.dirty {
+		return nil
+	}
+	idx.dirty = false
+	return idx.file.Sync()
+}
+
 func (e *indexEntry) Deleted() bool {
 	return e.deleted
 }
@@ -44,19 +199,25 @@ func (e *indexEntry) ReadFrom(r io.Reader) (n int64, err error) {
 	}
 	e.deleted = (deleted != 0)
 
+	// an entry that ends after its deleted flag is incomplete.
+	defer func() {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+	}()
+
 	var value_len uint32
 	if err = binary.Read(r, binary.BigEndian, &value_len); err != nil {
 		return 0, err
 	}
 
-	value := make([]byte, int(value_len))
-	for i := 0; i < int(value_len); i++ {
-		var b byte
-		if err = binary.Read(r, binary.BigEndian, &b); err != nil {
-			return 0, err
-		}
-		value[i] = b
+	// the value is copied instead of allocated up front, so that a damaged
+	// length doesn't allocate more memory than the file has.
+	buf := bytes.NewBuffer([]byte{})
+	if _, err = io.CopyN(buf, r, int64(value_len)); err != nil {
+		return 0, err
 	}
+	value := buf.Bytes()
 	e.value = string(value)
 
 	var id int64
@@ -0,0 +1,116 @@
+package epos
+
+import (
+	"sort"
+)
+
+// storeRange returns an iterator over the keys of store from start up to, but
+// not including, end, using the store's own implementation if it is an
+// OrderedBackend.
+func storeRange(store StorageBackend, start, end string) Iterator {
+	if ordered, ok := store.(OrderedBackend); ok {
+		return ordered.Range(start, end)
+	}
+	return newSortedIterator(store, start, end)
+}
+
+// sortedIterator emulates ordered iteration by sorting all keys of a store
+// that are within the range. Values are read when they are accessed.
+type sortedIterator struct {
+	store StorageBackend
+	keys  []string
+	i     int
+	value []byte
+	err   error
+}
+
+func newSortedIterator(store StorageBackend, start, end string) *sortedIterator {
+	keys := []string{}
+	for key := range store.Keys() {
+		if key >= start && (end == "" || key < end) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return &sortedIterator{store: store, keys: keys, i: -1}
+}
+
+func (it *sortedIterator) Next() bool {
+	if it.err != nil || it.i >= len(it.keys) {
+		return false
+	}
+	it.i++
+	it.value = nil
+	return it.i < len(it.keys)
+}
+
+func (it *sortedIterator) Key() string {
+	return it.keys[it.i]
+}
+
+func (it *sortedIterator) Value() []byte {
+	if it.value == nil && it.err == nil {
+		it.value, it.err = it.store.Read(it.keys[it.i])
+	}
+	return it.value
+}
+
+func (it *sortedIterator) Close() error {
+	it.keys = nil
+	return it.err
+}
+
+// decodingIterator decodes the values of another iterator, e.g. for storage
+// backends that wrap other storage backends. The first error that occurs
+// while decoding is returned by Close.
+type decodingIterator struct {
+	Iterator
+	decode func(key string, data []byte) ([]byte, error)
+	err    error
+}
+
+func (it *decodingIterator) Value() []byte {
+	data, err := it.decode(it.Key(), it.Iterator.Value())
+	if err != nil && it.err == nil {
+		it.err = err
+	}
+	return data
+}
+
+func (it *decodingIterator) Close() error {
+	if err := it.Iterator.Close(); err != nil {
+		return err
+	}
+	return it.err
+}
+
+// needsScan reports whether store has no ordered ranges of its own, i.e.
+// whether each range is emulated by a complete scan of its keys.
+func needsScan(store StorageBackend) bool {
+	switch store.(type) {
+	case *DiskvStorageBackend, *fileStorageBackend:
+		return true
+	}
+	_, ok := store.(OrderedBackend)
+	return !ok
+}
+
+// sortedKeys returns the indexes of keys in ascending order of the keys, so
+// that they can be read in a single pass of an iterator.
+func sortedKeys(keys []string) []int {
+	order := byKey{keys: keys, order: make([]int, len(keys))}
+	for i := range keys {
+		order.order[i] = i
+	}
+	sort.Sort(order)
+	return order.order
+}
+
+type byKey struct {
+	keys  []string
+	order []int
+}
+
+func (k byKey) Len() int           { return len(k.order) }
+func (k byKey) Less(i, j int) bool { return k.keys[k.order[i]] < k.keys[k.order[j]] }
+func (k byKey) Swap(i, j int)      { k.order[i], k.order[j] = k.order[j], k.order[i] }
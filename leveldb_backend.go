@@ -1,37 +1,63 @@
+//go:build cgo
+// +build cgo
+
 package epos
 
 import (
 	levigo "github.com/jmhodges/levigo_leveldb_1.4"
 )
 
+// The LevelDB storage backend requires cgo and a system installation of
+// LevelDB, so it is only available when building with cgo.
+func init() {
+	RegisterStorageBackend(string(STORAGE_LEVELDB), NewLevelDBStorageBackend)
+}
+
 type LevelDBStorageBackend struct {
 	store *levigo.DB
 	ro    *levigo.ReadOptions
 	wo    *levigo.WriteOptions
+	cache *levigo.Cache
 }
 
-func NewLevelDBStorageBackend(path string) StorageBackend {
+func NewLevelDBStorageBackend(path string, options *Options) (StorageBackend, error) {
 	opts := levigo.NewOptions()
-	opts.SetCreateIfMissing(true)
+	defer opts.Close()
+	opts.SetCreateIfMissing(!options.ReadOnly)
 
 	leveldb := &LevelDBStorageBackend{
 		ro: levigo.NewReadOptions(),
 		wo: levigo.NewWriteOptions(),
 	}
 
+	if options.LevelDBCacheSize > 0 {
+		leveldb.cache = levigo.NewLRUCache(options.LevelDBCacheSize)
+		opts.SetCache(leveldb.cache)
+	}
+
 	store, err := levigo.Open(path, opts)
 	if err != nil {
-		panic(err) // TODO: improve this
+		leveldb.ro.Close()
+		leveldb.wo.Close()
+		if leveldb.cache != nil {
+			leveldb.cache.Close()
+		}
+		return nil, err
 	}
 	leveldb.store = store
 
-	leveldb.ro.SetFillCache(false)
+	leveldb.ro.SetFillCache(leveldb.cache != nil)
 
-	return leveldb
+	return leveldb, nil
 }
 
 func (s *LevelDBStorageBackend) Read(key string) ([]byte, error) {
-	return s.store.Get(s.ro, []byte(key))
+	data, err := s.store.Get(s.ro, []byte(key))
+	// LevelDB returns no data for keys that don't exist.
+	if err == nil && data == nil {
+		return nil, ErrNotFound
+	}
+	return data, err
 }
 
 func (s *LevelDBStorageBackend) Write(key string, value []byte) error {
@@ -42,6 +68,51 @@ func (s *LevelDBStorageBackend) Erase(key string) error {
 	return s.store.Delete(s.wo, []byte(key))
 }
 
+func (s *LevelDBStorageBackend) WriteBatch(ops []BatchOp) error {
+	wb := levigo.NewWriteBatch()
+	defer wb.Close()
+
+	for _, op := range ops {
+		if op.Erase {
+			wb.Delete([]byte(op.Key))
+		} else {
+			wb.Put([]byte(op.Key), op.Value)
+		}
+	}
+
+	return s.store.Write(s.wo, wb)
+}
+
+// Sync commits all previous writes to stable storage by issuing an empty
+// synchronous write, which forces LevelDB to sync its log.
+func (s *LevelDBStorageBackend) Sync() error {
+	wo := levigo.NewWriteOptions()
+	defer wo.Close()
+	wo.SetSync(true)
+
+	wb := levigo.NewWriteBatch()
+	defer wb.Close()
+
+	return s.store.Write(wo, wb)
+}
+
+func (s *LevelDBStorageBackend) Compact() error {
+	s.store.CompactRange(levigo.Range{})
+	return nil
+}
+
+// Close closes the database and frees all memory that has been allocated
+// for it.
+func (s *LevelDBStorageBackend) Close() error {
+	s.store.Close()
+	s.ro.Close()
+	s.wo.Close()
+	if s.cache != nil {
+		s.cache.Close()
+	}
+	return nil
+}
+
 func (s *LevelDBStorageBackend) Keys() <-chan string {
 	ch := make(chan string)
 
@@ -58,3 +129,80 @@ func (s *LevelDBStorageBackend) Keys() <-chan string {
 
 	return ch
 }
+
+func (s *LevelDBStorageBackend) Range(start, end string) Iterator {
+	it := s.store.NewIterator(s.ro)
+	it.Seek([]byte(start))
+	return &levelDBIterator{it: it, end: end}
+}
+
+func (s *LevelDBStorageBackend) Snapshot() (Iterator, error) {
+	snap := s.store.NewSnapshot()
+	ro := levigo.NewReadOptions()
+	ro.SetFillCache(false)
+	ro.SetSnapshot(snap)
+	it := s.store.NewIterator(ro)
+	it.SeekToFirst()
+	return &levelDBIterator{it: it, release: func() {
+		ro.Close()
+		s.store.ReleaseSnapshot(snap)
+	}}, nil
+}
+
+// ReadMany reads keys from a snapshot in a single pass of an iterator over
+// the sorted keys.
+func (s *LevelDBStorageBackend) ReadMany(keys []string) ([][]byte, error) {
+	values := make([][]byte, len(keys))
+	if len(keys) == 0 {
+		return values, nil
+	}
+
+	snap := s.store.NewSnapshot()
+	defer s.store.ReleaseSnapshot(snap)
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+	ro.SetFillCache(false)
+	ro.SetSnapshot(snap)
+	it := s.store.NewIterator(ro)
+	defer it.Close()
+
+	for _, i := range sortedKeys(keys) {
+		it.Seek([]byte(keys[i]))
+		if it.Valid() && string(it.Key()) == keys[i] {
+			values[i] = it.Value()
+		}
+	}
+	return values, it.GetError()
+}
+
+type levelDBIterator struct {
+	it      *levigo.Iterator
+	end     string
+	started bool
+	release func() // releases the snapshot the iterator reads, if set.
+}
+
+func (i *levelDBIterator) Next() bool {
+	if i.started {
+		i.it.Next()
+	}
+	i.started = true
+	return i.it.Valid() && (i.end == "" || string(i.it.Key()) < i.end)
+}
+
+func (i *levelDBIterator) Key() string {
+	return string(i.it.Key())
+}
+
+func (i *levelDBIterator) Value() []byte {
+	return i.it.Value()
+}
+
+func (i *levelDBIterator) Close() error {
+	err := i.it.GetError()
+	i.it.Close()
+	if i.release != nil {
+		i.release()
+	}
+	return err
+}
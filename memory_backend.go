@@ -0,0 +1,159 @@
+package epos
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// fileStorageBackend stores every value in a file of its own, within a
+// directory of a fileSystem.
+type fileStorageBackend struct {
+	fs   fileSystem
+	path string
+	perm os.FileMode
+}
+
+// NewMemoryStorageBackend returns a storage backend that keeps all data in
+// memory. Within a database of type STORAGE_MEMORY, the data lives in the
+// database's in-memory file system together with indexes and metadata.
+func NewMemoryStorageBackend(path string, opts *Options) (StorageBackend, error) {
+	fs, ok := opts.fs.(*memFS)
+	if !ok {
+		fs = newMemFS()
+	}
+	return newFileStorageBackend(fs, path, opts)
+}
+
+// NewSingleFileStorageBackend returns a storage backend that stores all data
+// within the database file of a single-file database (STORAGE_SINGLEFILE).
+func NewSingleFileStorageBackend(path string, opts *Options) (StorageBackend, error) {
+	fs, ok := opts.fs.(*pageFS)
+	if !ok {
+		return nil, fmt.Errorf("storage type %s can only be used in single-file databases", string(STORAGE_SINGLEFILE))
+	}
+	return newFileStorageBackend(fs, path, opts)
+}
+
+func newFileStorageBackend(fs fileSystem, path string, opts *Options) (*fileStorageBackend, error) {
+	if !opts.ReadOnly {
+		if err := fs.Mkdir(path, opts.DirMode); err != nil && !os.IsExist(err) {
+			return nil, err
+		}
+	}
+	return &fileStorageBackend{fs: fs, path: path, perm: opts.FileMode}, nil
+}
+
+// keys are escaped so that any key can be used as file name.
+func escapeKey(key string) string {
+	return strings.Replace(url.QueryEscape(key), ".", "%2E", -1)
+}
+
+func (s *fileStorageBackend) Read(key string) ([]byte, error) {
+	data, err := readFile(s.fs, s.path+"/"+escapeKey(key))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return data, err
+}
+
+func (s *fileStorageBackend) Write(key string, value []byte) error {
+	return writeFile(s.fs, s.path+"/"+escapeKey(key), value, s.perm)
+}
+
+func (s *fileStorageBackend) Erase(key string) error {
+	return s.fs.Remove(s.path + "/" + escapeKey(key))
+}
+
+// Sync commits written data if the underlying fileSystem supports it.
+func (s *fileStorageBackend) Sync() error {
+	if syncer, ok := s.fs.(Syncer); ok {
+		return syncer.Sync()
+	}
+	return nil
+}
+
+func (s *fileStorageBackend) Close() error {
+	return nil
+}
+
+func (s *fileStorageBackend) Keys() <-chan string {
+	ch := make(chan string)
+
+	entries, _ := s.fs.ReadDir(s.path)
+
+	go func() {
+		for _, e := range entries {
+			if e.IsDir() {
+				continue
+			}
+			if key, err := url.QueryUnescape(e.Name()); err == nil {
+				ch <- key
+			}
+		}
+		close(ch)
+	}()
+
+	return ch
+}
+
+func (s *fileStorageBackend) Range(start, end string) Iterator {
+	return newSortedIterator(s, start, end)
+}
+
+// snapshot writes the complete database to a regular database at the
+// configured snapshot path. The snapshot is first written to a temporary
+// database, which then replaces the previous snapshot.
+func (db *Database) snapshot() error {
+	tmppath := db.opts.SnapshotPath + ".tmp"
+	if err := os.RemoveAll(tmppath); err != nil {
+		return err
+	}
+
+	snap, err := OpenDatabaseWithOptions(tmppath, &Options{
+		Type:          db.opts.SnapshotType,
+		Durability:    DURABILITY_NONE,
+		Compression:   db.opts.Compression,
+		EncryptionKey: db.opts.EncryptionKey,
+		FileMode:      db.opts.FileMode,
+		DirMode:       db.opts.DirMode,
+		Logger:        db.opts.Logger,
+	})
+	if err != nil {
+		return err
+	}
+
+	colls, err := db.Collections()
+	if err != nil {
+		snap.Close()
+		return err
+	}
+
+	for _, name := range colls {
+		src, err := db.CollE(name)
+		if err != nil {
+			snap.Close()
+			return err
+		}
+		dst, err := snap.CollWithOptions(name, src.Options())
+		if err != nil {
+			snap.Close()
+			return err
+		}
+		if err = src.copyTo(dst); err != nil {
+			snap.Close()
+			return err
+		}
+	}
+
+	// Close commits everything to disk.
+	if err = snap.Close(); err != nil {
+		return err
+	}
+
+	if err = os.RemoveAll(db.opts.SnapshotPath); err != nil {
+		return err
+	}
+	return os.Rename(tmppath, db.opts.SnapshotPath)
+}
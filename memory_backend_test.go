@@ -0,0 +1,64 @@
+package epos
+
+import (
+	"os"
+	"testing"
+)
+
+func TestMemoryDatabase(t *testing.T) {
+	db, err := OpenDatabaseWithOptions("testdb_memory", &Options{Type: STORAGE_MEMORY, SnapshotPath: "testdb_memory_snapshot", SnapshotType: STORAGE_DISKV})
+	if err != nil {
+		t.Fatalf("couldn't open testdb_memory: %v", err)
+	}
+
+	books := db.Coll("books")
+	books.AddIndex("Author")
+
+	for i, book := range queryData {
+		if _, err := books.Insert(book); err != nil {
+			t.Errorf("%d. Insert failed: %v", i, err)
+		}
+	}
+
+	if err = books.Delete(2); err != nil {
+		t.Errorf("Delete failed: %v", err)
+	}
+	if err = db.Vacuum(); err != nil {
+		t.Errorf("Vacuum failed: %v", err)
+	}
+
+	result, err := books.Query(&Equals{Field: "Author", Value: "Mark Twain"})
+	if err != nil || result.Count() != 1 {
+		t.Errorf("expected 1 Mark Twain book, got %d instead (error: %v)", result.Count(), err)
+	}
+
+	if colls, err := db.Collections(); err != nil || len(colls) != 1 || colls[0] != "books" {
+		t.Errorf("Collections returned %v (error: %v), expected [books]", colls, err)
+	}
+
+	if _, err = os.Stat("testdb_memory"); err == nil {
+		t.Errorf("in-memory database has been written to disk")
+	}
+
+	if err = db.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	snap, err := OpenDatabase("testdb_memory_snapshot", STORAGE_AUTO)
+	if err != nil {
+		t.Fatalf("couldn't open snapshot: %v", err)
+	}
+	defer snap.Close()
+
+	result, err = snap.Coll("books").Query(&Equals{Field: "Author", Value: "Aesop"})
+	var b book
+	if err != nil || !result.Next(nil, &b) || b.Title != "Fables" {
+		t.Errorf("snapshot doesn't contain indexed book: %#v (error: %v)", b, err)
+	}
+
+	if id, err := snap.Coll("books").Insert(book{Title: "Emma"}); err != nil || id != Id(len(queryData)+1) {
+		t.Errorf("Insert into snapshot returned ID %d (error: %v), expected %d", id, err, len(queryData)+1)
+	}
+
+	snap.Remove()
+}
@@ -0,0 +1,57 @@
+package epos
+
+import (
+	"encoding/json"
+	"os"
+)
+
+// collMeta is the metadata of a collection, which records how the objects of
+// the collection are stored.
+type collMeta struct {
+	Codec       string      `json:"codec,omitempty"`
+	Compression Compression `json:"compression,omitempty"`
+	IdStrategy  string      `json:"ids,omitempty"`
+	// Checksummed is set if all objects of the collection have been
+	// written with a checksum, i.e. if the collection has been created or
+	// completely rewritten since checksums have been introduced.
+	Checksummed bool `json:"checksummed,omitempty"`
+	// UniqueIndexes are the fields whose indexes don't allow two objects
+	// with the same value.
+	UniqueIndexes []string `json:"unique,omitempty"`
+}
+
+// readCollMeta returns the metadata of a collection, or nil if the collection
+// has no metadata yet.
+func (db *Database) readCollMeta(name string) (*collMeta, error) {
+	data, err := readFile(db.fs, db.path+"/meta/"+name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	meta := &collMeta{}
+	if err = json.Unmarshal(data, meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+func (db *Database) writeCollMeta(name string, meta *collMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	// databases created by earlier versions have no meta directory.
+	if err = db.fs.Mkdir(db.path+"/meta", db.opts.DirMode); err != nil && !os.IsExist(err) {
+		return err
+	}
+
+	tmppath := db.path + "/meta/." + name + ".tmp"
+	if err = writeFile(db.fs, tmppath, data, db.opts.FileMode); err != nil {
+		return err
+	}
+	return db.fs.Rename(tmppath, db.path+"/meta/"+name)
+}
@@ -0,0 +1,76 @@
+package epos
+
+import (
+	"fmt"
+)
+
+// MigrateTo copies the whole database to a new database of storage type typ
+// at path. typ must be a concrete storage type, not STORAGE_AUTO. All
+// collections are copied with their IDs, ID counters and indexes, and the new
+// database is checked against the original one afterwards. If the check
+// fails, the new database is removed again. The new database is encrypted
+// with the same keys as the original one.
+//
+// Objects that are written while the database is being migrated may or may
+// not be copied, so the check fails unless the database is left alone during
+// the migration.
+func (db *Database) MigrateTo(path string, typ StorageType) error {
+	if typ == STORAGE_MEMORY || typ == STORAGE_AUTO {
+		return fmt.Errorf("can't migrate to storage type %s", typ)
+	}
+	if _, ok := storageBackends[typ]; !ok {
+		return fmt.Errorf("unknown storage type %s", typ)
+	}
+
+	before, err := db.Check()
+	if err != nil {
+		return err
+	}
+	if err = db.backupTo(path, typ); err != nil {
+		return err
+	}
+
+	migrated, err := OpenDatabaseWithOptions(path, db.copyOptions(typ))
+	if err != nil {
+		return err
+	}
+	after, err := migrated.Check()
+	if err == nil {
+		err = compareReports(before, after)
+	}
+	if err != nil {
+		migrated.Close()
+		migrated.Remove()
+		return fmt.Errorf("migration failed: %w", err)
+	}
+	return migrated.Close()
+}
+
+// compareReports returns an error if the collections in the reports differ
+// in their number of objects, ID counters or indexes, or if any collection in
+// after has problems.
+func compareReports(before, after *CheckReport) error {
+	if len(before.Collections) != len(after.Collections) {
+		return fmt.Errorf("%d collections have been copied, expected %d", len(after.Collections), len(before.Collections))
+	}
+	colls := make(map[string]*CollectionReport)
+	for _, coll := range after.Collections {
+		colls[coll.Name] = coll
+	}
+	for _, orig := range before.Collections {
+		coll := colls[orig.Name]
+		switch {
+		case coll == nil:
+			return fmt.Errorf("collection %s hasn't been copied", orig.Name)
+		case coll.Objects != orig.Objects:
+			return fmt.Errorf("collection %s has %d objects, expected %d", coll.Name, coll.Objects, orig.Objects)
+		case coll.NextId != orig.NextId:
+			return fmt.Errorf("collection %s has next ID %d, expected %d", coll.Name, coll.NextId, orig.NextId)
+		case len(coll.Indexes) != len(orig.Indexes):
+			return fmt.Errorf("collection %s has %d indexes, expected %d", coll.Name, len(coll.Indexes), len(orig.Indexes))
+		case !coll.OK():
+			return fmt.Errorf("collection %s is inconsistent", coll.Name)
+		}
+	}
+	return nil
+}
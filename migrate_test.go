@@ -0,0 +1,99 @@
+package epos
+
+import (
+	"os"
+	"testing"
+)
+
+func TestMigrateTo(t *testing.T) {
+	db, err := OpenDatabase("testdb_migrate", STORAGE_DISKV)
+	if err != nil {
+		t.Fatalf("couldn't open testdb_migrate: %v", err)
+	}
+	defer db.Remove()
+	defer db.Close()
+	books := db.Coll("books")
+	books.AddIndex("Author")
+	for _, book := range queryData {
+		books.Insert(book)
+	}
+	books.Delete(Id(len(queryData)))
+	db.Coll("empty")
+
+	if err = db.MigrateTo("testdb_migrated", STORAGE_MEMORY); err == nil {
+		t.Errorf("migration to memory storage succeeded")
+	}
+	if err = db.MigrateTo("testdb_migrated", STORAGE_AUTO); err == nil {
+		t.Errorf("migrating to STORAGE_AUTO succeeded")
+	}
+	if err = db.MigrateTo("testdb_migrated", StorageType("nonexistent")); err == nil {
+		t.Errorf("migration to unknown storage type succeeded")
+	}
+	if _, err = os.Stat("testdb_migrated"); err == nil {
+		t.Fatalf("failed migration left database behind")
+	}
+
+	if err = db.MigrateTo("testdb_migrated", STORAGE_GOLEVELDB); err != nil {
+		t.Fatalf("MigrateTo failed: %v", err)
+	}
+	migrated, err := OpenDatabase("testdb_migrated", STORAGE_AUTO)
+	if err != nil {
+		t.Fatalf("couldn't open migrated database: %v", err)
+	}
+	defer migrated.Remove()
+	defer migrated.Close()
+	if engine, _ := readFile(migrated.fs, "testdb_migrated/engine"); string(engine) != string(STORAGE_GOLEVELDB) {
+		t.Errorf("migrated database has storage type %s", engine)
+	}
+	if colls, _ := migrated.Collections(); len(colls) != 2 {
+		t.Errorf("migrated database has collections %v", colls)
+	}
+
+	books = migrated.Coll("books")
+	result, err := books.Query(&Equals{Field: "Author", Value: "Aesop"})
+	if err != nil || result.Count() != 1 {
+		t.Errorf("query on migrated index failed (error: %v)", err)
+	}
+	var b book
+	result, _ = books.QueryId(2)
+	if !result.Next(nil, &b) || b.Title != queryData[1].Title {
+		t.Errorf("migrated object 2 is %#v", b)
+	}
+	if id, _ := books.Insert(&book{Title: "New"}); id != Id(len(queryData)+1) {
+		t.Errorf("Insert after migration returned ID %d", id)
+	}
+}
+
+func TestMigrateDuringKeyRotation(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	newkey := []byte("fedcba9876543210")
+	db, err := OpenDatabaseWithOptions("testdb_migrate", &Options{Type: STORAGE_DISKV, EncryptionKey: key})
+	if err != nil {
+		t.Fatalf("couldn't open testdb_migrate: %v", err)
+	}
+	db.Coll("books").AddIndex("Author")
+	db.Coll("books").Insert(&book{Title: "Fables", Author: "Aesop"})
+	db.Close()
+
+	// the objects are still encrypted with the previous key, as if
+	// RotateKey had been interrupted.
+	db, err = OpenDatabaseWithOptions("testdb_migrate", &Options{EncryptionKey: newkey, OldEncryptionKeys: [][]byte{key}})
+	if err != nil {
+		t.Fatalf("couldn't open testdb_migrate with the new key: %v", err)
+	}
+	defer db.Remove()
+	defer db.Close()
+	if err = db.MigrateTo("testdb_migrated", STORAGE_SINGLEFILE); err != nil {
+		t.Fatalf("MigrateTo failed: %v", err)
+	}
+	migrated, err := OpenDatabaseWithOptions("testdb_migrated", &Options{EncryptionKey: newkey, OldEncryptionKeys: [][]byte{key}})
+	if err != nil {
+		t.Fatalf("couldn't open migrated database: %v", err)
+	}
+	defer migrated.Remove()
+	defer migrated.Close()
+	var b book
+	if err = migrated.Coll("books").Get(1, &b); err != nil || b.Title != "Fables" {
+		t.Errorf("migrated object is %#v (error: %v)", b, err)
+	}
+}
@@ -0,0 +1,147 @@
+package epos
+
+import (
+	"errors"
+	"log"
+	"os"
+	"time"
+)
+
+// Durability describes how eagerly changes are committed to stable storage.
+// It applies uniformly to the storage backend, the index files and the
+// write-ahead log.
+type Durability int
+
+const (
+	// DURABILITY_SYNC commits every change to stable storage before the
+	// operation returns. This is the default.
+	DURABILITY_SYNC Durability = iota
+	// DURABILITY_PERIODIC commits changes once per SyncInterval in the
+	// background, so that several operations share a single sync (group
+	// commit). A crash of the operating system may lose the changes of
+	// the last SyncInterval.
+	DURABILITY_PERIODIC
+	// DURABILITY_NONE leaves it to the operating system when changes reach
+	// stable storage. Changes are only committed explicitly when the
+	// database is closed, or when the write-ahead log has grown large.
+	DURABILITY_NONE
+)
+
+const defaultSyncInterval = 1 * time.Second
+
+// Options configures how a database is opened.
+type Options struct {
+	// Type is the storage type that is used when the database is created.
+	// An existing database is always opened with the storage type it was
+	// created with.
+	Type StorageType
+
+	// Durability determines when changes are committed to stable storage.
+	Durability Durability
+
+	// SyncInterval is the time between two commits when using
+	// DURABILITY_PERIODIC. It defaults to one second.
+	SyncInterval time.Duration
+
+	// ReadOnly opens an existing database for reading only. All operations
+	// that would modify the database fail with ErrReadOnly.
+	ReadOnly bool
+
+	// FileMode and DirMode are the permissions of files and directories
+	// that epos creates itself. They default to 0644 and 0755.
+	FileMode os.FileMode
+	DirMode  os.FileMode
+
+	// Logger receives diagnostic messages, e.g. about objects that couldn't
+	// be read. It defaults to a logger writing to standard error.
+	Logger *log.Logger
+
+	// LevelDBCacheSize is the size of LevelDB's block cache in bytes. If it
+	// is 0, LevelDB's default cache is used.
+	LevelDBCacheSize int
+
+	// DiskvCacheSize is the maximum size of diskv's cache in bytes. If it is
+	// 0, no cache is used.
+	DiskvCacheSize uint64
+
+	// Compression is the compression algorithm for the objects of newly
+	// created collections. Existing collections keep the compression they
+	// have been created with, unless they are recompressed. It defaults to
+	// COMPRESSION_NONE.
+	Compression Compression
+
+	// EncryptionKey enables encryption at rest: objects, index files and
+	// the write-ahead log are encrypted with AES-GCM using this key, which
+	// must be 16, 24 or 32 bytes long. Once a database has been opened with
+	// a key, it can only be opened with the same key; opening it with a
+	// different or no key fails with ErrWrongKey. Use Database.RotateKey
+	// to change the key.
+	EncryptionKey []byte
+
+	// OldEncryptionKeys are only used to decrypt data that has been
+	// encrypted with previous keys, e.g. to finish an interrupted RotateKey.
+	OldEncryptionKeys [][]byte
+
+	// CacheSize is the maximum size in bytes of the documents that each
+	// collection keeps in memory, so that documents that are read repeatedly
+	// are only read from the storage backend once. If it is 0, no documents
+	// are cached.
+	CacheSize int
+
+	// Codec is the name of the codec that encodes the objects of newly
+	// created collections, unless CollWithOptions specifies a different
+	// one. It defaults to CODEC_JSON.
+	Codec string
+
+	// NodeId distinguishes databases whose collections use ID_SNOWFLAKE,
+	// so that their IDs can be merged. It must be between 0 and 1023.
+	NodeId int
+
+	// SnapshotPath is only used by databases of type STORAGE_MEMORY. If it
+	// is set, the whole database is written to a regular database at this
+	// path when it is closed, replacing any previous snapshot. The snapshot
+	// can be opened like any other database.
+	SnapshotPath string
+
+	// SnapshotType is the storage type of the snapshot database.
+	SnapshotType StorageType
+
+	fs   fileSystem
+	keys *keyring
+}
+
+// ErrReadOnly is returned by all operations that would modify a database
+// that has been opened read-only.
+var ErrReadOnly = errors.New("database is read-only")
+
+func (opts *Options) withDefaults() *Options {
+	o := &Options{}
+	if opts != nil {
+		*o = *opts
+	}
+	if o.Type == "" {
+		o.Type = STORAGE_AUTO
+	}
+	if o.SnapshotType == "" {
+		o.SnapshotType = STORAGE_AUTO
+	}
+	if o.Codec == "" {
+		o.Codec = CODEC_JSON
+	}
+	if o.Compression == "" {
+		o.Compression = COMPRESSION_NONE
+	}
+	if o.SyncInterval <= 0 {
+		o.SyncInterval = defaultSyncInterval
+	}
+	if o.FileMode == 0 {
+		o.FileMode = 0644
+	}
+	if o.DirMode == 0 {
+		o.DirMode = 0755
+	}
+	if o.Logger == nil {
+		o.Logger = log.New(os.Stderr, "", log.LstdFlags)
+	}
+	return o
+}
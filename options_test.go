@@ -0,0 +1,117 @@
+package epos
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDurability(t *testing.T) {
+	testdata := []struct {
+		Type       StorageType
+		Durability Durability
+		Dirty      bool
+	}{
+		{STORAGE_DISKV, DURABILITY_SYNC, false},
+		{STORAGE_LEVELDB, DURABILITY_SYNC, false},
+		{STORAGE_DISKV, DURABILITY_PERIODIC, true},
+		{STORAGE_LEVELDB, DURABILITY_NONE, true},
+	}
+
+	for i, tt := range testdata {
+		if storageBackends[tt.Type] == nil {
+			continue
+		}
+		db, err := OpenDatabaseWithOptions("testdb_durability", &Options{Type: tt.Type, Durability: tt.Durability, SyncInterval: time.Hour})
+		if err != nil {
+			t.Fatalf("%d. couldn't open testdb_durability: %v", i, err)
+		}
+
+		coll := db.Coll("persons")
+		coll.AddIndex("X")
+		if _, err = coll.Insert(entry{X: "John Doe", Y: 23}); err != nil {
+			t.Errorf("%d. Insert failed: %v", i, err)
+		}
+
+		if coll.dirty != tt.Dirty {
+			t.Errorf("%d. collection dirty = %t after insert, expected %t", i, coll.dirty, tt.Dirty)
+		}
+
+		if err = db.Close(); err != nil {
+			t.Errorf("%d. Close failed: %v", i, err)
+		}
+		if coll.dirty {
+			t.Errorf("%d. collection hasn't been synced on Close", i)
+		}
+
+		db.Remove()
+	}
+}
+
+func TestPeriodicSync(t *testing.T) {
+	db, err := OpenDatabaseWithOptions("testdb_durability", &Options{Durability: DURABILITY_PERIODIC, SyncInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("couldn't open testdb_durability: %v", err)
+	}
+	defer db.Remove()
+	defer db.Close()
+
+	// an idle database is committed in the background.
+	coll := db.Coll("persons")
+	coll.Insert(entry{X: "John Doe", Y: 23})
+	time.Sleep(100 * time.Millisecond)
+	db.mu.Lock()
+	dirty, size := coll.dirty, db.wal.size
+	db.mu.Unlock()
+	if dirty || size != 0 {
+		t.Errorf("idle database hasn't been committed: dirty = %t, log size = %d", dirty, size)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	if _, err := OpenDatabaseWithOptions("testdb_readonly", &Options{ReadOnly: true}); err == nil {
+		t.Errorf("opening a non-existing database read-only succeeded")
+	}
+
+	db, err := OpenDatabaseWithOptions("testdb_readonly", &Options{Type: STORAGE_DISKV, FileMode: 0600})
+	if err != nil {
+		t.Fatalf("couldn't open testdb_readonly: %v", err)
+	}
+	db.Coll("persons").AddIndex("X")
+	db.Coll("persons").Insert(entry{X: "John Doe", Y: 23})
+	db.Close()
+
+	if fi, err := os.Stat("testdb_readonly/engine"); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("engine file wasn't created with the requested permissions")
+	}
+
+	db, err = OpenDatabaseWithOptions("testdb_readonly", &Options{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("couldn't open testdb_readonly read-only: %v", err)
+	}
+
+	coll := db.Coll("persons")
+	if _, err = coll.Insert(entry{X: "Jan Maier"}); err != ErrReadOnly {
+		t.Errorf("Insert returned %v, expected ErrReadOnly", err)
+	}
+	if err = coll.Delete(1); err != ErrReadOnly {
+		t.Errorf("Delete returned %v, expected ErrReadOnly", err)
+	}
+	if _, err = coll.InsertMany([]interface{}{entry{X: "Jan Maier"}}); err != ErrReadOnly {
+		t.Errorf("InsertMany returned %v, expected ErrReadOnly", err)
+	}
+	if err = coll.UpdateMany([]Id{1}, []interface{}{entry{X: "Jan Maier"}}); err != ErrReadOnly {
+		t.Errorf("UpdateMany returned %v, expected ErrReadOnly", err)
+	}
+	if err = coll.AddIndex("Y"); err != ErrReadOnly {
+		t.Errorf("AddIndex returned %v, expected ErrReadOnly", err)
+	}
+
+	result, err := coll.Query(&Equals{Field: "X", Value: "John Doe"})
+	if err != nil || result.Count() != 1 {
+		t.Errorf("query on read-only database failed: %v", err)
+	}
+
+	db.Close()
+	db.Remove()
+}
@@ -0,0 +1,946 @@
+package epos
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A single-file database stores all of its files (objects, indexes, the
+// write-ahead log and metadata) in one file that is divided into pages of
+// pageSize bytes. The content of every file is stored in data pages, which
+// are listed by the file's catalog entry: directly for files of up to
+// directPages pages, and in page table pages for larger files.
+//
+// Pages 0 and 1 hold two alternating copies of the file header, which
+// points to the catalog. The catalog consists of a base, which lists all
+// files, and a chain of deltas, which list the files that have changed in
+// each commit since the base has been written. Changes are never written to
+// pages that are in use: a commit writes the changed pages of all changed
+// files, their page table pages and a delta to free pages, and then
+// atomically switches to them by writing a new header into the older of the
+// two header slots. Once the deltas have grown larger than the base, the
+// next commit writes a new base instead of a delta. Pages that aren't
+// referenced by the catalog are free; they are determined when the file is
+// opened.
+const (
+	pageSize      = 512
+	chainPayload  = pageSize - 4 // the base and the deltas are chains of pages.
+	ptEntries     = pageSize / 4 // page numbers per page table page.
+	directPages   = 16
+	pageMagic     = "EPOSPF02"
+	pageHeaderLen = 40
+
+	// minDeltaSize is the size the deltas may always grow to before a new
+	// base is written, so that small catalogs aren't rewritten every time.
+	minDeltaSize = 16 * pageSize
+)
+
+var errPageFileCorrupt = errors.New("single-file database is corrupt")
+
+const (
+	catalogPut    = 1
+	catalogDelete = 2
+)
+
+type pageEntry struct {
+	name    string
+	dir     bool
+	mode    os.FileMode
+	modTime time.Time
+	length  uint32   // length of the committed content
+	pages   []uint32 // data pages of the committed content
+	pt      []uint32 // page table pages, if the file has more than directPages pages
+	data    []byte   // current content, if loaded
+	loaded  bool
+	touched map[int]bool // data pages that have changed since the last commit
+	refs    int
+}
+
+// pageFS is a fileSystem that lives in a single page-based file.
+type pageFS struct {
+	mu         sync.Mutex
+	f          *os.File
+	root       string
+	readonly   bool
+	seq        uint64
+	pageCount  uint32
+	entries    map[string]*pageEntry
+	changed    map[string]bool     // names whose catalog entries have changed since the last commit
+	dirty      map[*pageEntry]bool // files whose content has changed since the last commit
+	base       uint32              // first page of the committed base
+	base_len   uint32
+	delta      uint32 // first page of the last committed delta, 0 if there is none
+	delta_len  uint32
+	delta_size int      // total size of the pages of all committed deltas
+	catalog    []uint32 // pages of the committed base and deltas
+	free       []uint32 // pages that are neither used nor referenced by the last commit
+	pending    []uint32 // pages that have been freed since the last commit
+	closed     bool
+	err        error
+}
+
+func openPageFS(path string, opts *Options) (*pageFS, error) {
+	flags := os.O_RDWR | os.O_CREATE
+	if opts.ReadOnly {
+		flags = os.O_RDONLY
+	}
+	f, err := os.OpenFile(path, flags, opts.FileMode)
+	if err != nil {
+		return nil, err
+	}
+
+	fs := &pageFS{f: f, root: filepath.Clean(path), readonly: opts.ReadOnly, entries: make(map[string]*pageEntry), changed: make(map[string]bool), dirty: make(map[*pageEntry]bool)}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if fi.Size() == 0 && !opts.ReadOnly {
+		// initialize a new file with an empty catalog.
+		fs.pageCount = 2
+		fs.changed["."] = true
+		err = fs.commit()
+	} else {
+		err = fs.load()
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return fs, nil
+}
+
+// load reads the most recent valid header and the catalog it points to, and
+// determines the free pages.
+func (fs *pageFS) load() error {
+	for slot := int64(0); slot < 2; slot++ {
+		hdr := make([]byte, pageHeaderLen)
+		if _, err := fs.f.ReadAt(hdr, slot*pageSize); err != nil {
+			continue
+		}
+		if string(hdr[0:8]) != pageMagic || crc32.ChecksumIEEE(hdr[:36]) != binary.BigEndian.Uint32(hdr[36:40]) {
+			continue
+		}
+		if seq := binary.BigEndian.Uint64(hdr[8:16]); seq > fs.seq {
+			fs.seq = seq
+			fs.base = binary.BigEndian.Uint32(hdr[16:20])
+			fs.base_len = binary.BigEndian.Uint32(hdr[20:24])
+			fs.delta = binary.BigEndian.Uint32(hdr[24:28])
+			fs.delta_len = binary.BigEndian.Uint32(hdr[28:32])
+			fs.pageCount = binary.BigEndian.Uint32(hdr[32:36])
+		}
+	}
+	if fs.seq == 0 {
+		return fmt.Errorf("%s is not an epos database file", fs.root)
+	}
+
+	base, pages, err := fs.readChain(fs.base, fs.base_len)
+	if err != nil {
+		return err
+	}
+	fs.catalog = pages
+
+	// the deltas point to their predecessors, but are applied in the order
+	// they have been written.
+	deltas := [][]byte{}
+	for first, length := fs.delta, fs.delta_len; first != 0; {
+		delta, pages, err := fs.readChain(first, length)
+		if err != nil {
+			return err
+		}
+		if len(delta) < 8 || len(fs.catalog) > int(fs.pageCount) {
+			return errPageFileCorrupt
+		}
+		fs.catalog = append(fs.catalog, pages...)
+		fs.delta_size += len(pages) * pageSize
+		deltas = append(deltas, delta[8:])
+		first, length = binary.BigEndian.Uint32(delta[0:4]), binary.BigEndian.Uint32(delta[4:8])
+	}
+	if err = fs.applyCatalog(base); err != nil {
+		return err
+	}
+	for i := len(deltas) - 1; i >= 0; i-- {
+		if err = fs.applyCatalog(deltas[i]); err != nil {
+			return err
+		}
+	}
+
+	used := make([]bool, int(fs.pageCount))
+	use := func(pages []uint32) error {
+		for _, page := range pages {
+			if page < 2 || page >= fs.pageCount || used[page] {
+				return errPageFileCorrupt
+			}
+			used[page] = true
+		}
+		return nil
+	}
+	if err = use(fs.catalog); err != nil {
+		return err
+	}
+	for _, e := range fs.entries {
+		if e.pt != nil {
+			if err = use(e.pt); err != nil {
+				return err
+			}
+			if e.pages, err = fs.readPageTable(e.pt, pagesNeeded(int(e.length))); err != nil {
+				return err
+			}
+		}
+		if pagesNeeded(int(e.length)) != len(e.pages) {
+			return errPageFileCorrupt
+		}
+		if err = use(e.pages); err != nil {
+			return err
+		}
+	}
+	for page := uint32(2); page < fs.pageCount; page++ {
+		if !used[page] {
+			fs.free = append(fs.free, page)
+		}
+	}
+	return nil
+}
+
+func (fs *pageFS) encodeEntry(buf *bytes.Buffer, name string) {
+	e, exists := fs.entries[name]
+	if !exists {
+		buf.WriteByte(catalogDelete)
+		binary.Write(buf, binary.BigEndian, uint16(len(name)))
+		buf.WriteString(name)
+		return
+	}
+
+	buf.WriteByte(catalogPut)
+	binary.Write(buf, binary.BigEndian, uint16(len(name)))
+	buf.WriteString(name)
+	dir, pages := byte(0), e.pages
+	if e.dir {
+		dir = 1
+	}
+	// the flags tell whether the pages are data pages or page table pages.
+	if e.pt != nil {
+		dir, pages = dir|2, e.pt
+	}
+	buf.WriteByte(dir)
+	binary.Write(buf, binary.BigEndian, uint32(e.mode))
+	binary.Write(buf, binary.BigEndian, e.modTime.UnixNano())
+	binary.Write(buf, binary.BigEndian, e.length)
+	binary.Write(buf, binary.BigEndian, uint32(len(pages)))
+	binary.Write(buf, binary.BigEndian, pages)
+}
+
+// applyCatalog applies the entries of the base or of a delta.
+func (fs *pageFS) applyCatalog(data []byte) error {
+	r := bytes.NewReader(data)
+
+	for r.Len() > 0 {
+		op, _ := r.ReadByte()
+		var name_len uint16
+		if err := binary.Read(r, binary.BigEndian, &name_len); err != nil {
+			return errPageFileCorrupt
+		}
+		name := make([]byte, int(name_len))
+		if _, err := io.ReadFull(r, name); err != nil {
+			return errPageFileCorrupt
+		}
+		if op == catalogDelete {
+			delete(fs.entries, string(name))
+			continue
+		}
+		if op != catalogPut {
+			return errPageFileCorrupt
+		}
+
+		var entry struct {
+			Flags   byte
+			Mode    uint32
+			ModTime int64
+			Length  uint32
+			Count   uint32
+		}
+		if err := binary.Read(r, binary.BigEndian, &entry); err != nil || int(entry.Count) > r.Len()/4 {
+			return errPageFileCorrupt
+		}
+		pages := make([]uint32, int(entry.Count))
+		binary.Read(r, binary.BigEndian, pages)
+
+		e := &pageEntry{
+			name:    string(name),
+			dir:     entry.Flags&1 != 0,
+			mode:    os.FileMode(entry.Mode),
+			modTime: time.Unix(0, entry.ModTime),
+			length:  entry.Length,
+			pages:   pages,
+		}
+		if entry.Flags&2 != 0 {
+			e.pages, e.pt = nil, pages
+		}
+		fs.entries[e.name] = e
+	}
+	return nil
+}
+
+// readChain returns the content and the pages of the chain of pages starting
+// at first.
+func (fs *pageFS) readChain(first, length uint32) ([]byte, []uint32, error) {
+	data := make([]byte, 0, int(length))
+	pages := []uint32{}
+	page := make([]byte, pageSize)
+	for next := first; len(data) < int(length); next = binary.BigEndian.Uint32(page[0:4]) {
+		if next < 2 || next >= fs.pageCount || len(pages) >= int(fs.pageCount) {
+			return nil, nil, errPageFileCorrupt
+		}
+		if _, err := fs.f.ReadAt(page, int64(next)*pageSize); err != nil {
+			return nil, nil, err
+		}
+		pages = append(pages, next)
+		n := int(length) - len(data)
+		if n > chainPayload {
+			n = chainPayload
+		}
+		data = append(data, page[4:4+n]...)
+	}
+	return data, pages, nil
+}
+
+func (fs *pageFS) writeChain(pages []uint32, data []byte) error {
+	buf := make([]byte, pageSize)
+	for i, page := range pages {
+		next := uint32(0)
+		if i+1 < len(pages) {
+			next = pages[i+1]
+		}
+		for j := range buf {
+			buf[j] = 0
+		}
+		binary.BigEndian.PutUint32(buf[0:4], next)
+		copy(buf[4:], data[i*chainPayload:])
+		if _, err := fs.f.WriteAt(buf, int64(page)*pageSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readPageTable returns the first count data pages listed by the page table
+// pages pt.
+func (fs *pageFS) readPageTable(pt []uint32, count int) ([]uint32, error) {
+	if len(pt) != (count+ptEntries-1)/ptEntries {
+		return nil, errPageFileCorrupt
+	}
+	pages := make([]uint32, 0, count)
+	buf := make([]byte, pageSize)
+	for _, page := range pt {
+		if _, err := fs.f.ReadAt(buf, int64(page)*pageSize); err != nil {
+			return nil, err
+		}
+		for i := 0; i < ptEntries && len(pages) < count; i++ {
+			pages = append(pages, binary.BigEndian.Uint32(buf[i*4:]))
+		}
+	}
+	return pages, nil
+}
+
+// alloc returns a page that is neither used nor referenced by the last
+// commit, growing the file if necessary.
+func (fs *pageFS) alloc() uint32 {
+	if len(fs.free) > 0 {
+		page := fs.free[len(fs.free)-1]
+		fs.free = fs.free[:len(fs.free)-1]
+		return page
+	}
+	fs.pageCount++
+	return fs.pageCount - 1
+}
+
+// allocChain returns the pages for a chain holding length bytes.
+func (fs *pageFS) allocChain(length int) []uint32 {
+	pages := make([]uint32, (length+chainPayload-1)/chainPayload)
+	for i := range pages {
+		pages[i] = fs.alloc()
+	}
+	return pages
+}
+
+func pagesNeeded(length int) int {
+	return (length + pageSize - 1) / pageSize
+}
+
+// touch records that the bytes from start to end of the file's content have
+// changed.
+func (e *pageEntry) touch(start, end int) {
+	if e.touched == nil {
+		e.touched = make(map[int]bool)
+	}
+	for i := start / pageSize; i <= (end-1)/pageSize; i++ {
+		e.touched[i] = true
+	}
+}
+
+// commit atomically writes all changes since the last commit to the file.
+func (fs *pageFS) commit() error {
+	if fs.err != nil {
+		return fs.err
+	}
+	if len(fs.changed) == 0 && len(fs.dirty) == 0 {
+		return nil
+	}
+	if fs.readonly {
+		return ErrReadOnly
+	}
+
+	if err := fs.doCommit(); err != nil {
+		// the in-memory state doesn't reflect the file anymore.
+		fs.err = fmt.Errorf("commit failed, reopen database: %v", err)
+		return err
+	}
+	return nil
+}
+
+func (fs *pageFS) doCommit() error {
+	for e := range fs.dirty {
+		if err := fs.writeContent(e); err != nil {
+			return err
+		}
+		fs.changed[e.name] = true
+	}
+
+	// a delta lists the changed entries and points to the previous delta.
+	// Once the deltas would outgrow the base, a new base is written.
+	delta := bytes.NewBuffer([]byte{})
+	binary.Write(delta, binary.BigEndian, fs.delta)
+	binary.Write(delta, binary.BigEndian, fs.delta_len)
+	for name := range fs.changed {
+		if name != "." {
+			fs.encodeEntry(delta, name)
+		}
+	}
+
+	base, base_len, delta_first, delta_len := fs.base, fs.base_len, uint32(0), uint32(0)
+	catalog := fs.catalog
+	delta_pages := (delta.Len() + chainPayload - 1) / chainPayload
+	delta_size := fs.delta_size + delta_pages*pageSize
+	if delta_size > int(fs.base_len)+minDeltaSize {
+		names := make([]string, 0, len(fs.entries))
+		for name := range fs.entries {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		buf := bytes.NewBuffer([]byte{})
+		for _, name := range names {
+			fs.encodeEntry(buf, name)
+		}
+		pages := fs.allocChain(buf.Len())
+		if err := fs.writeChain(pages, buf.Bytes()); err != nil {
+			return err
+		}
+		fs.pending = append(fs.pending, fs.catalog...)
+		catalog, delta_size = pages, 0
+		base, base_len = 0, uint32(buf.Len())
+		if len(pages) > 0 {
+			base = pages[0]
+		}
+	} else {
+		pages := fs.allocChain(delta.Len())
+		if err := fs.writeChain(pages, delta.Bytes()); err != nil {
+			return err
+		}
+		catalog = append(append([]uint32{}, catalog...), pages...)
+		delta_first, delta_len = pages[0], uint32(delta.Len())
+	}
+	if err := fs.f.Sync(); err != nil {
+		return err
+	}
+
+	hdr := make([]byte, pageHeaderLen)
+	copy(hdr[0:8], pageMagic)
+	binary.BigEndian.PutUint64(hdr[8:16], fs.seq+1)
+	binary.BigEndian.PutUint32(hdr[16:20], base)
+	binary.BigEndian.PutUint32(hdr[20:24], base_len)
+	binary.BigEndian.PutUint32(hdr[24:28], delta_first)
+	binary.BigEndian.PutUint32(hdr[28:32], delta_len)
+	binary.BigEndian.PutUint32(hdr[32:36], fs.pageCount)
+	binary.BigEndian.PutUint32(hdr[36:40], crc32.ChecksumIEEE(hdr[:36]))
+	if _, err := fs.f.WriteAt(hdr, int64((fs.seq+1)%2)*pageSize); err != nil {
+		return err
+	}
+	if err := fs.f.Sync(); err != nil {
+		return err
+	}
+
+	fs.seq++
+	fs.base, fs.base_len, fs.delta, fs.delta_len = base, base_len, delta_first, delta_len
+	fs.catalog, fs.delta_size = catalog, delta_size
+	fs.free = append(fs.free, fs.pending...)
+	fs.pending = nil
+	fs.changed = make(map[string]bool)
+	fs.dirty = make(map[*pageEntry]bool)
+	return nil
+}
+
+// writeContent writes the pages of a file's content that have changed to new
+// pages, as well as the page table pages that refer to them.
+func (fs *pageFS) writeContent(e *pageEntry) error {
+	old := e.pages
+	pages := make([]uint32, pagesNeeded(len(e.data)))
+	copy(pages, old)
+	if len(old) > len(pages) {
+		fs.pending = append(fs.pending, old[len(pages):]...)
+	}
+
+	buf := make([]byte, pageSize)
+	for i := range pages {
+		if i < len(old) && !e.touched[i] {
+			continue
+		}
+		if i < len(old) {
+			fs.pending = append(fs.pending, old[i])
+		}
+		pages[i] = fs.alloc()
+		for j := range buf {
+			buf[j] = 0
+		}
+		copy(buf, e.data[i*pageSize:])
+		if _, err := fs.f.WriteAt(buf, int64(pages[i])*pageSize); err != nil {
+			return err
+		}
+	}
+
+	// only the page table pages that list changed pages are written again.
+	var pt []uint32
+	if len(pages) > directPages {
+		pt = make([]uint32, (len(pages)+ptEntries-1)/ptEntries)
+		copy(pt, e.pt)
+		for j := range pt {
+			start, end := j*ptEntries, (j+1)*ptEntries
+			if end > len(pages) {
+				end = len(pages)
+			}
+			if j < len(e.pt) && end <= len(old) && equalPages(pages[start:end], old[start:end]) {
+				continue
+			}
+			if j < len(e.pt) {
+				fs.pending = append(fs.pending, e.pt[j])
+			}
+			pt[j] = fs.alloc()
+			for k := range buf {
+				buf[k] = 0
+			}
+			for k, page := range pages[start:end] {
+				binary.BigEndian.PutUint32(buf[k*4:], page)
+			}
+			if _, err := fs.f.WriteAt(buf, int64(pt[j])*pageSize); err != nil {
+				return err
+			}
+		}
+	}
+	if len(e.pt) > len(pt) {
+		fs.pending = append(fs.pending, e.pt[len(pt):]...)
+	}
+
+	e.pages, e.pt, e.length, e.touched = pages, pt, uint32(len(e.data)), nil
+	if e.refs == 0 {
+		e.data, e.loaded = nil, false
+	}
+	return nil
+}
+
+func equalPages(a, b []uint32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Sync commits all changes to stable storage.
+func (fs *pageFS) Sync() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.commit()
+}
+
+// Close commits all outstanding changes and closes the database file.
+func (fs *pageFS) Close() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.closed {
+		return nil
+	}
+	fs.closed = true
+	err := fs.commit()
+	if close_err := fs.f.Close(); err == nil {
+		err = close_err
+	}
+	return err
+}
+
+// key returns the name of a path within the file.
+func (fs *pageFS) key(name string) (string, error) {
+	rel, inside := relPath(fs.root, filepath.Clean(name))
+	if !inside {
+		return "", &os.PathError{Op: "open", Path: name, Err: os.ErrInvalid}
+	}
+	return rel, nil
+}
+
+// freeEntry frees the pages of a file that is removed or replaced.
+func (fs *pageFS) freeEntry(e *pageEntry) {
+	fs.pending = append(append(fs.pending, e.pages...), e.pt...)
+	e.pages, e.pt, e.length, e.touched = nil, nil, 0, nil
+	delete(fs.dirty, e)
+}
+
+func (fs *pageFS) OpenFile(name string, flag int, perm os.FileMode) (file, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	key, err := fs.key(name)
+	if err != nil {
+		return nil, err
+	}
+	if fs.readonly && flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		return nil, &os.PathError{Op: "open", Path: name, Err: ErrReadOnly}
+	}
+
+	e, exists := fs.entries[key]
+	if !exists {
+		if flag&os.O_CREATE == 0 || key == "." {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+		e = &pageEntry{name: key, mode: perm, modTime: time.Now(), loaded: true}
+		fs.entries[key] = e
+		fs.changed[key] = true
+	} else if e.dir {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrInvalid}
+	} else if flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	}
+
+	if flag&os.O_TRUNC != 0 {
+		e.data, e.loaded = nil, true
+		fs.dirty[e] = true
+	}
+
+	e.refs++
+	return &pageFile{fs: fs, e: e, flag: flag}, nil
+}
+
+func (fs *pageFS) Stat(name string) (os.FileInfo, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	key, err := fs.key(name)
+	if err != nil {
+		return nil, err
+	}
+	if key == "." {
+		return &memFileInfo{name: filepath.Base(fs.root), mode: 0755 | os.ModeDir}, nil
+	}
+	e, exists := fs.entries[key]
+	if !exists {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	return e.info(filepath.Base(key)), nil
+}
+
+func (e *pageEntry) info(name string) os.FileInfo {
+	if e.dir {
+		return &memFileInfo{name: name, mode: e.mode | os.ModeDir, modTime: e.modTime}
+	}
+	size := int64(e.length)
+	if e.loaded {
+		size = int64(len(e.data))
+	}
+	return &memFileInfo{name: name, size: size, mode: e.mode, modTime: e.modTime}
+}
+
+func (fs *pageFS) Mkdir(name string, perm os.FileMode) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	key, err := fs.key(name)
+	if err != nil {
+		return err
+	}
+	if _, exists := fs.entries[key]; exists || key == "." {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	}
+	if fs.readonly {
+		return &os.PathError{Op: "mkdir", Path: name, Err: ErrReadOnly}
+	}
+	fs.entries[key] = &pageEntry{name: key, dir: true, mode: perm, modTime: time.Now()}
+	fs.changed[key] = true
+	return nil
+}
+
+func (fs *pageFS) ReadDir(name string) ([]os.FileInfo, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	key, err := fs.key(name)
+	if err != nil {
+		return nil, err
+	}
+	if e, exists := fs.entries[key]; key != "." && (!exists || !e.dir) {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+
+	entries := []os.FileInfo{}
+	for path, e := range fs.entries {
+		if path != key && filepath.Dir(path) == key {
+			entries = append(entries, e.info(filepath.Base(path)))
+		}
+	}
+	sort.Sort(byName(entries))
+	return entries, nil
+}
+
+func (fs *pageFS) Rename(oldname, newname string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	oldkey, err := fs.key(oldname)
+	if err != nil {
+		return err
+	}
+	newkey, err := fs.key(newname)
+	if err != nil {
+		return err
+	}
+	e, exists := fs.entries[oldkey]
+	if !exists {
+		return &os.PathError{Op: "rename", Path: oldname, Err: os.ErrNotExist}
+	}
+
+	if !e.dir {
+		if old, exists := fs.entries[newkey]; exists {
+			if old.dir {
+				return &os.PathError{Op: "rename", Path: newname, Err: os.ErrExist}
+			}
+			fs.freeEntry(old)
+		}
+		delete(fs.entries, oldkey)
+		fs.entries[newkey] = e
+		e.name = newkey
+		fs.changed[oldkey], fs.changed[newkey] = true, true
+		return nil
+	}
+
+	if _, exists := fs.entries[newkey]; exists {
+		return &os.PathError{Op: "rename", Path: newname, Err: os.ErrExist}
+	}
+	moved := []*pageEntry{}
+	for path, e := range fs.entries {
+		if _, inside := relPath(oldkey, path); inside {
+			delete(fs.entries, path)
+			fs.changed[path] = true
+			moved = append(moved, e)
+		}
+	}
+	for _, e := range moved {
+		rel, _ := relPath(oldkey, e.name)
+		e.name = filepath.Join(newkey, rel)
+		fs.entries[e.name] = e
+		fs.changed[e.name] = true
+	}
+	return nil
+}
+
+func (fs *pageFS) Remove(name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	key, err := fs.key(name)
+	if err != nil {
+		return err
+	}
+	e, exists := fs.entries[key]
+	if !exists {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	if e.dir {
+		for path, _ := range fs.entries {
+			if path != key && filepath.Dir(path) == key {
+				return &os.PathError{Op: "remove", Path: name, Err: os.ErrInvalid}
+			}
+		}
+	}
+	fs.freeEntry(e)
+	delete(fs.entries, key)
+	fs.changed[key] = true
+	return nil
+}
+
+// RemoveAll removes name and everything within. Removing the root removes
+// the whole database file.
+func (fs *pageFS) RemoveAll(name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	key, err := fs.key(name)
+	if err != nil {
+		return err
+	}
+	if key == "." {
+		fs.entries = make(map[string]*pageEntry)
+		fs.f.Close()
+		fs.err = errors.New("database file has been removed")
+		return os.Remove(fs.root)
+	}
+
+	for path, e := range fs.entries {
+		if _, inside := relPath(key, path); inside {
+			fs.freeEntry(e)
+			delete(fs.entries, path)
+			fs.changed[path] = true
+		}
+	}
+	return nil
+}
+
+// pageFile is an open file of a pageFS. Its content is kept in memory while
+// it is open, and the pages that have changed are written to the database
+// file on commit.
+type pageFile struct {
+	fs     *pageFS
+	e      *pageEntry
+	flag   int
+	pos    int64
+	closed bool
+}
+
+func (f *pageFile) load() error {
+	if f.e.loaded {
+		return nil
+	}
+	data := make([]byte, len(f.e.pages)*pageSize)
+	for i, page := range f.e.pages {
+		if _, err := f.fs.f.ReadAt(data[i*pageSize:(i+1)*pageSize], int64(page)*pageSize); err != nil {
+			return err
+		}
+	}
+	f.e.data, f.e.loaded = data[:f.e.length], true
+	return nil
+}
+
+func (f *pageFile) Read(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.load(); err != nil {
+		return 0, err
+	}
+	if f.pos >= int64(len(f.e.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.e.data[f.pos:])
+	f.pos += int64(n)
+	return n, nil
+}
+
+func (f *pageFile) Write(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return 0, &os.PathError{Op: "write", Err: os.ErrPermission}
+	}
+	if err := f.load(); err != nil {
+		return 0, err
+	}
+	if f.flag&os.O_APPEND != 0 {
+		f.pos = int64(len(f.e.data))
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	// a gap between the end of the content and the written bytes is
+	// filled with zeros, which have to be written as well.
+	start := int(f.pos)
+	if start > len(f.e.data) {
+		start = len(f.e.data)
+	}
+	if end := f.pos + int64(len(p)); end > int64(len(f.e.data)) {
+		f.e.data = append(f.e.data, make([]byte, int(end)-len(f.e.data))...)
+	}
+	copy(f.e.data[f.pos:], p)
+	f.pos += int64(len(p))
+	f.e.touch(start, int(f.pos))
+	f.e.modTime = time.Now()
+	f.fs.dirty[f.e] = true
+	return len(p), nil
+}
+
+func (f *pageFile) Seek(offset int64, whence int) (int64, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	switch whence {
+	case os.SEEK_SET:
+		f.pos = offset
+	case os.SEEK_CUR:
+		f.pos += offset
+	case os.SEEK_END:
+		size := int64(f.e.length)
+		if f.e.loaded {
+			size = int64(len(f.e.data))
+		}
+		f.pos = size + offset
+	}
+	return f.pos, nil
+}
+
+func (f *pageFile) Truncate(size int64) error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.load(); err != nil {
+		return err
+	}
+	if size < int64(len(f.e.data)) {
+		f.e.data = f.e.data[:size]
+	} else if size > int64(len(f.e.data)) {
+		f.e.touch(len(f.e.data), int(size))
+		f.e.data = append(f.e.data, make([]byte, int(size)-len(f.e.data))...)
+	}
+	f.fs.dirty[f.e] = true
+	return nil
+}
+
+func (f *pageFile) Sync() error {
+	return f.fs.Sync()
+}
+
+func (f *pageFile) Close() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.closed {
+		return nil
+	}
+	f.closed = true
+	f.e.refs--
+	if f.e.refs == 0 && !f.fs.dirty[f.e] {
+		f.e.data, f.e.loaded = nil, false
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package epos
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestSingleFileDatabase(t *testing.T) {
+	db, err := OpenDatabase("testdb_singlefile", STORAGE_SINGLEFILE)
+	if err != nil {
+		t.Fatalf("couldn't open testdb_singlefile: %v", err)
+	}
+
+	books := db.Coll("books")
+	books.AddIndex("Author")
+
+	for i, book := range queryData {
+		if _, err := books.Insert(book); err != nil {
+			t.Errorf("%d. Insert failed: %v", i, err)
+		}
+	}
+
+	if err = books.Delete(2); err != nil {
+		t.Errorf("Delete failed: %v", err)
+	}
+	if err = db.Vacuum(); err != nil {
+		t.Errorf("Vacuum failed: %v", err)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	if fi, err := os.Stat("testdb_singlefile"); err != nil || fi.IsDir() {
+		t.Fatalf("single-file database isn't a regular file (error: %v)", err)
+	}
+
+	db, err = OpenDatabase("testdb_singlefile", STORAGE_AUTO)
+	if err != nil {
+		t.Fatalf("couldn't reopen testdb_singlefile: %v", err)
+	}
+
+	books = db.Coll("books")
+	result, err := books.Query(&Equals{Field: "Author", Value: "Aesop"})
+	var b book
+	if err != nil || !result.Next(nil, &b) || b.Title != "Fables" {
+		t.Errorf("reopened database doesn't contain indexed book: %#v (error: %v)", b, err)
+	}
+
+	if colls, err := db.Collections(); err != nil || len(colls) != 1 || colls[0] != "books" {
+		t.Errorf("Collections returned %v (error: %v), expected [books]", colls, err)
+	}
+
+	// pages that are no longer used must be reused.
+	fi, _ := os.Stat("testdb_singlefile")
+	for i := 0; i < 100; i++ {
+		if err = books.Update(1, book{Title: "Ulysses", Author: "James Joyce"}); err != nil {
+			t.Fatalf("%d. Update failed: %v", i, err)
+		}
+	}
+	if fi2, _ := os.Stat("testdb_singlefile"); fi2.Size() > 2*fi.Size() {
+		t.Errorf("database file grew from %d to %d bytes after updating a single object", fi.Size(), fi2.Size())
+	}
+
+	db.Close()
+	db.Remove()
+
+	if _, err = os.Stat("testdb_singlefile"); !os.IsNotExist(err) {
+		t.Errorf("Remove didn't remove the database file")
+	}
+}
+
+func TestSingleFileCommit(t *testing.T) {
+	db, err := OpenDatabase("testdb_singlefile_commit", STORAGE_SINGLEFILE)
+	if err != nil {
+		t.Fatalf("couldn't open testdb_singlefile_commit: %v", err)
+	}
+	db.Coll("persons").Insert(entry{X: "John Doe", Y: 23})
+	db.Close()
+
+	db, err = OpenDatabase("testdb_singlefile_commit", STORAGE_AUTO)
+	if err != nil {
+		t.Fatalf("couldn't reopen testdb_singlefile_commit: %v", err)
+	}
+	db.Coll("persons").Insert(entry{X: "Jan Maier", Y: 42})
+	db.Close()
+
+	// simulate a torn write of the last commit's header: the database must
+	// fall back to the previous commit.
+	f, err := os.OpenFile("testdb_singlefile_commit", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("couldn't open database file: %v", err)
+	}
+	last := db.fs.(*pageFS).seq
+	f.WriteAt([]byte("garbage"), int64(last%2)*pageSize+8)
+	f.Close()
+
+	fs, err := openPageFS("testdb_singlefile_commit", (&Options{ReadOnly: true}).withDefaults())
+	if err != nil {
+		t.Fatalf("couldn't open database file after torn write: %v", err)
+	}
+	if fs.seq != last-1 {
+		t.Errorf("database file opened commit %d, expected %d", fs.seq, last-1)
+	}
+	fs.Close()
+
+	db, err = OpenDatabase("testdb_singlefile_commit", STORAGE_AUTO)
+	if err != nil {
+		t.Fatalf("couldn't open testdb_singlefile_commit after torn write: %v", err)
+	}
+
+	var e entry
+	result, err := db.Coll("persons").QueryId(1)
+	if err != nil || !result.Next(nil, &e) || e.X != "John Doe" {
+		t.Errorf("QueryId(1) returned %#v (error: %v)", e, err)
+	}
+
+	db.Close()
+	db.Remove()
+}
+
+func TestPageFSIncrementalCommit(t *testing.T) {
+	opts := (&Options{}).withDefaults()
+	fs, err := openPageFS("testdb_pagefs", opts)
+	if err != nil {
+		t.Fatalf("couldn't open testdb_pagefs: %v", err)
+	}
+	defer os.Remove("testdb_pagefs")
+
+	fs.Mkdir("testdb_pagefs/objects", opts.DirMode)
+	for i := 0; i < 1000; i++ {
+		writeFile(fs, fmt.Sprintf("testdb_pagefs/objects/%d", i), []byte("object"), opts.FileMode)
+	}
+	log, _ := fs.OpenFile("testdb_pagefs/log", os.O_RDWR|os.O_CREATE, opts.FileMode)
+	log.Write(bytes.Repeat([]byte("x"), 100*pageSize))
+	if err = fs.Sync(); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+
+	// appending to a large file only writes its last pages, and changing
+	// a single file only writes a small delta of the catalog.
+	base, pages := fs.base, append([]uint32{}, fs.entries["log"].pages...)
+	log.Seek(0, os.SEEK_END)
+	log.Write([]byte("appended"))
+	writeFile(fs, "testdb_pagefs/objects/42", []byte("changed"), opts.FileMode)
+	if err = fs.Sync(); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	if fs.base != base || fs.delta_len > pageSize {
+		t.Errorf("commit of two files wrote a new base or a delta of %d bytes", fs.delta_len)
+	}
+	changed := 0
+	for i, page := range fs.entries["log"].pages[:len(pages)] {
+		if page != pages[i] {
+			changed++
+		}
+	}
+	if changed > 1 {
+		t.Errorf("appending to a file rewrote %d of its pages", changed)
+	}
+	log.Close()
+	fs.Close()
+
+	fs, err = openPageFS("testdb_pagefs", opts)
+	if err != nil {
+		t.Fatalf("couldn't reopen testdb_pagefs: %v", err)
+	}
+	defer fs.Close()
+	if data, err := readFile(fs, "testdb_pagefs/objects/42"); err != nil || string(data) != "changed" {
+		t.Errorf("changed file contains %q after reopening (error: %v)", data, err)
+	}
+	if data, err := readFile(fs, "testdb_pagefs/log"); err != nil || len(data) != 100*pageSize+8 || string(data[len(data)-8:]) != "appended" {
+		t.Errorf("appended file is %d bytes long after reopening (error: %v)", len(data), err)
+	}
+	if fi, err := fs.Stat("testdb_pagefs/objects/999"); err != nil || fi.Size() != 6 {
+		t.Errorf("Stat of unchanged file failed: %v", err)
+	}
+}
@@ -0,0 +1,432 @@
+package epos
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Patch applies a patch to an existing object. The patch is either a JSON
+// Merge Patch (RFC 7386), i.e. a JSON object whose fields replace the fields
+// of the object, and whose null fields remove them, or a JSON Patch
+// (RFC 6902), i.e. a JSON array of add, remove, replace, move, copy and test
+// operations. Either the whole patch is applied, or none of it if any
+// operation fails.
+//
+// Other changes to the database wait until the patch has been applied, so
+// concurrent patches of different fields don't overwrite each other. Only
+// the indexes of fields that have changed are updated. Objects that can't be
+// decoded into a map can't be patched. Patch returns ErrNotFound if the
+// object doesn't exist.
+func (c *Collection) Patch(id Id, patch []byte) error {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	return c.patch(id, patch)
+}
+
+func (c *Collection) patch(id Id, patch []byte) error {
+	if err := c.db.checkWritable(); err != nil {
+		return err
+	}
+
+	var p interface{}
+	dec := json.NewDecoder(bytes.NewReader(patch))
+	dec.UseNumber()
+	if err := dec.Decode(&p); err != nil {
+		return fmt.Errorf("invalid patch: %v", err)
+	}
+
+	id_str := fmt.Sprintf("%d", id)
+	old_data, err := c.read(id)
+	if err != nil {
+		return err
+	}
+	doc, err := c.patchableObject(id, old_data)
+	if err != nil {
+		return err
+	}
+
+	if ops, ok := p.([]interface{}); ok {
+		doc, err = applyJSONPatch(doc, ops)
+		if err != nil {
+			return err
+		}
+	} else {
+		doc = applyMergePatch(doc, p)
+	}
+	object, ok := doc.(map[string]interface{})
+	if !ok {
+		return errors.New("patched object isn't a JSON object")
+	}
+
+	data, err := c.codec.Marshal(c.importValue(object))
+	if err != nil {
+		return err
+	}
+
+	// the indexes are updated from both objects, so both must be decodable
+	// before anything is written.
+	var old_object, new_object map[string]interface{}
+	if err = c.codec.Unmarshal(old_data, &old_object); err != nil {
+		return fmt.Errorf("decoding object %d failed: %w", id, err)
+	}
+	if err = c.codec.Unmarshal(data, &new_object); err != nil {
+		return fmt.Errorf("decoding patched object %d failed: %w", id, err)
+	}
+
+	rev := c.revisionOp(id_str, readRev(c.raw, id_str)+1)
+	ops := []walOp{rev, {typ: walUpdate, coll: c.name, key: id_str, data: data}}
+	if err = c.checkUnique(ops); err != nil {
+		return err
+	}
+	if err = c.db.wal.Log(ops); err != nil {
+		return err
+	}
+
+	if err = writeBatch(c.store, []BatchOp{{Key: rev.key, Value: rev.data}, {Key: id_str, Value: data}}); err != nil {
+		c.db.abort()
+		return err
+	}
+	if err = c.updateChangedIndexes(id, old_object, new_object); err != nil {
+		c.db.abort()
+		return err
+	}
+	return c.db.commit(c)
+}
+
+// patchableObject decodes an object into a map whose values have the same
+// types as values decoded from JSON with json.Number, so that they can be
+// compared to the values of a patch.
+func (c *Collection) patchableObject(id Id, data []byte) (interface{}, error) {
+	object, err := c.decodeMap(id, data)
+	if err != nil {
+		return nil, err
+	}
+	encoded, err := json.Marshal(object)
+	if err != nil {
+		return nil, fmt.Errorf("object %d can't be encoded as JSON: %v", id, err)
+	}
+	var doc interface{}
+	dec := json.NewDecoder(bytes.NewReader(encoded))
+	dec.UseNumber()
+	if err = dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// updateChangedIndexes updates the entries for id in the indexes of all fields
+// whose values differ between old_object and object.
+func (c *Collection) updateChangedIndexes(id Id, old_object, object map[string]interface{}) error {
+	for field, idx := range c.indexes {
+		old_value, old_ok := old_object[field]
+		value, ok := object[field]
+		if old_ok == ok && fmt.Sprintf("%v", old_value) == fmt.Sprintf("%v", value) {
+			continue
+		}
+		idx.remove(int64(id))
+		if ok {
+			entry := indexEntry{deleted: false, value: fmt.Sprintf("%v", value), id: int64(id)}
+			if err := idx.append(entry); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// applyMergePatch applies a JSON Merge Patch to doc as described in RFC 7386.
+func applyMergePatch(doc, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	object, ok := doc.(map[string]interface{})
+	if !ok {
+		object = make(map[string]interface{})
+	}
+	for key, value := range p {
+		if value == nil {
+			delete(object, key)
+		} else {
+			object[key] = applyMergePatch(object[key], value)
+		}
+	}
+	return object
+}
+
+// applyJSONPatch applies the operations of a JSON Patch to doc as described
+// in RFC 6902.
+func applyJSONPatch(doc interface{}, ops []interface{}) (interface{}, error) {
+	for i, o := range ops {
+		op, ok := o.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("patch operation %d isn't a JSON object", i)
+		}
+		var err error
+		if doc, err = applyPatchOp(doc, op); err != nil {
+			return nil, fmt.Errorf("patch operation %d (%v): %v", i, op["op"], err)
+		}
+	}
+	return doc, nil
+}
+
+func applyPatchOp(doc interface{}, op map[string]interface{}) (interface{}, error) {
+	path, err := patchPointer(op, "path")
+	if err != nil {
+		return nil, err
+	}
+
+	switch op["op"] {
+	case "add":
+		value, ok := op["value"]
+		if !ok {
+			return nil, errors.New("missing value")
+		}
+		return pointerAdd(doc, path, value)
+	case "remove":
+		_, doc, err = pointerRemove(doc, path)
+		return doc, err
+	case "replace":
+		value, ok := op["value"]
+		if !ok {
+			return nil, errors.New("missing value")
+		}
+		// the whole document can be replaced as well.
+		if len(path) == 0 {
+			return value, nil
+		}
+		if _, doc, err = pointerRemove(doc, path); err != nil {
+			return nil, err
+		}
+		return pointerAdd(doc, path, value)
+	case "move", "copy":
+		from, err := patchPointer(op, "from")
+		if err != nil {
+			return nil, err
+		}
+		var value interface{}
+		if op["op"] == "move" {
+			if len(from) < len(path) && reflect.DeepEqual(from, path[:len(from)]) {
+				return nil, errors.New("can't move a value into itself")
+			}
+			value, doc, err = pointerRemove(doc, from)
+		} else {
+			value, err = pointerGet(doc, from)
+			value = deepCopy(value)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return pointerAdd(doc, path, value)
+	case "test":
+		value, err := pointerGet(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !jsonEqual(value, op["value"]) {
+			return nil, errors.New("test failed")
+		}
+		return doc, nil
+	}
+	return nil, fmt.Errorf("unknown operation %v", op["op"])
+}
+
+// patchPointer returns the reference tokens of the JSON Pointer (RFC 6901) in
+// the field name of a patch operation.
+func patchPointer(op map[string]interface{}, name string) ([]string, error) {
+	pointer, ok := op[name].(string)
+	if !ok {
+		return nil, fmt.Errorf("missing %s", name)
+	}
+	if pointer == "" {
+		return []string{}, nil
+	}
+	if pointer[0] != '/' {
+		return nil, fmt.Errorf("invalid pointer %q", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+// arrayIndex parses the reference token of an element of an array of length n.
+// If add is true, the index may refer to the end of the array.
+func arrayIndex(token string, n int, add bool) (int, error) {
+	if add && token == "-" {
+		return n, nil
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || i > n || (i == n && !add) || (len(token) > 1 && token[0] == '0') {
+		return 0, fmt.Errorf("invalid array index %s", token)
+	}
+	return i, nil
+}
+
+// pointerModify calls fn with the container that the last token of path
+// refers to, and replaces the container with the value returned by fn.
+func pointerModify(doc interface{}, path []string, fn func(container interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(path) == 1 {
+		return fn(doc, path[0])
+	}
+	switch d := doc.(type) {
+	case map[string]interface{}:
+		child, ok := d[path[0]]
+		if !ok {
+			return nil, fmt.Errorf("field %s doesn't exist", path[0])
+		}
+		child, err := pointerModify(child, path[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		d[path[0]] = child
+		return d, nil
+	case []interface{}:
+		i, err := arrayIndex(path[0], len(d), false)
+		if err != nil {
+			return nil, err
+		}
+		if d[i], err = pointerModify(d[i], path[1:], fn); err != nil {
+			return nil, err
+		}
+		return d, nil
+	}
+	return nil, fmt.Errorf("can't refer to %s in a scalar value", path[0])
+}
+
+func pointerGet(doc interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch d := doc.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if doc, ok = d[token]; !ok {
+				return nil, fmt.Errorf("field %s doesn't exist", token)
+			}
+		case []interface{}:
+			i, err := arrayIndex(token, len(d), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = d[i]
+		default:
+			return nil, fmt.Errorf("can't refer to %s in a scalar value", token)
+		}
+	}
+	return doc, nil
+}
+
+func pointerAdd(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return pointerModify(doc, path, func(container interface{}, token string) (interface{}, error) {
+		switch d := container.(type) {
+		case map[string]interface{}:
+			d[token] = value
+			return d, nil
+		case []interface{}:
+			i, err := arrayIndex(token, len(d), true)
+			if err != nil {
+				return nil, err
+			}
+			d = append(d, nil)
+			copy(d[i+1:], d[i:])
+			d[i] = value
+			return d, nil
+		}
+		return nil, fmt.Errorf("can't add %s to a scalar value", token)
+	})
+}
+
+// pointerRemove removes the value that path refers to, and returns it.
+func pointerRemove(doc interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, nil, errors.New("can't remove the whole object")
+	}
+	var removed interface{}
+	doc, err := pointerModify(doc, path, func(container interface{}, token string) (interface{}, error) {
+		switch d := container.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if removed, ok = d[token]; !ok {
+				return nil, fmt.Errorf("field %s doesn't exist", token)
+			}
+			delete(d, token)
+			return d, nil
+		case []interface{}:
+			i, err := arrayIndex(token, len(d), false)
+			if err != nil {
+				return nil, err
+			}
+			removed = d[i]
+			return append(d[:i], d[i+1:]...), nil
+		}
+		return nil, fmt.Errorf("can't remove %s from a scalar value", token)
+	})
+	return removed, doc, err
+}
+
+func deepCopy(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			m[key] = deepCopy(value)
+		}
+		return m
+	case []interface{}:
+		a := make([]interface{}, len(v))
+		for i, value := range v {
+			a[i] = deepCopy(value)
+		}
+		return a
+	}
+	return v
+}
+
+// jsonEqual compares two values decoded from JSON. Numbers are equal if they
+// have the same value, regardless of how they are written.
+func jsonEqual(a, b interface{}) bool {
+	switch a := a.(type) {
+	case json.Number:
+		b, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		if a == b {
+			return true
+		}
+		fa, erra := a.Float64()
+		fb, errb := b.Float64()
+		return erra == nil && errb == nil && fa == fb
+	case map[string]interface{}:
+		b, ok := b.(map[string]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for key, value := range a {
+			if other, ok := b[key]; !ok || !jsonEqual(value, other) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		b, ok := b.([]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !jsonEqual(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
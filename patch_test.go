@@ -0,0 +1,113 @@
+package epos
+
+import (
+	"testing"
+)
+
+type profile struct {
+	Name  string
+	Email string
+	Tags  []string
+	Score int64
+}
+
+func TestMergePatch(t *testing.T) {
+	db, err := OpenDatabase("testdb_patch", STORAGE_AUTO)
+	if err != nil {
+		t.Fatalf("couldn't open testdb_patch: %v", err)
+	}
+	defer db.Remove()
+	defer db.Close()
+	profiles := db.Coll("profiles")
+	profiles.AddIndex("Name")
+	profiles.AddIndex("Email")
+	id, _ := profiles.Insert(&profile{Name: "alice", Email: "alice@example.com", Tags: []string{"a"}, Score: 1<<60 + 1})
+	fpos := profiles.indexes["Name"].data["alice"][0].fpos
+
+	if err = profiles.Patch(id, []byte(`{"Email":"alice@example.org","Tags":null}`)); err != nil {
+		t.Fatalf("Patch failed: %v", err)
+	}
+	var p profile
+	result, _ := profiles.QueryId(id)
+	if !result.Next(nil, &p) || p.Name != "alice" || p.Email != "alice@example.org" || p.Tags != nil || p.Score != 1<<60+1 {
+		t.Errorf("patched object is %#v", p)
+	}
+	if result, _ = profiles.Query(&Equals{Field: "Email", Value: "alice@example.org"}); result.Count() != 1 {
+		t.Errorf("index of patched field hasn't been updated")
+	}
+	if result, _ = profiles.Query(&Equals{Field: "Email", Value: "alice@example.com"}); result.Count() != 0 {
+		t.Errorf("index of patched field still contains old value")
+	}
+	// the entry of the unchanged field hasn't been rewritten.
+	if entries := profiles.indexes["Name"].data["alice"]; len(entries) != 1 || entries[0].fpos != fpos {
+		t.Errorf("index of unchanged field has been rewritten: %#v", entries)
+	}
+
+	if err = profiles.Patch(42, []byte(`{"Name":"nobody"}`)); err == nil {
+		t.Errorf("patching nonexistent object succeeded")
+	}
+	if err = profiles.Patch(id, []byte(`{"Name":`)); err == nil {
+		t.Errorf("invalid patch succeeded")
+	}
+	if err = profiles.Patch(id, []byte(`"replaced"`)); err == nil {
+		t.Errorf("replacing object with a string succeeded")
+	}
+}
+
+func TestJSONPatch(t *testing.T) {
+	db, err := OpenDatabaseWithOptions("testdb_patch", &Options{Codec: CODEC_MSGPACK})
+	if err != nil {
+		t.Fatalf("couldn't open testdb_patch: %v", err)
+	}
+	defer db.Remove()
+	defer db.Close()
+	profiles := db.Coll("profiles")
+	profiles.AddIndex("Name")
+	id, _ := profiles.Insert(&profile{Name: "bob", Tags: []string{"a", "c"}, Score: 3})
+
+	patch := `[
+		{"op": "test", "path": "/Score", "value": 3.0},
+		{"op": "add", "path": "/Tags/1", "value": "b"},
+		{"op": "add", "path": "/Tags/-", "value": "d"},
+		{"op": "replace", "path": "/Score", "value": 4},
+		{"op": "copy", "from": "/Name", "path": "/Email"},
+		{"op": "move", "from": "/Email", "path": "/Name"},
+		{"op": "remove", "path": "/Tags/0"}
+	]`
+	if err = profiles.Patch(id, []byte(patch)); err != nil {
+		t.Fatalf("Patch failed: %v", err)
+	}
+	var p profile
+	result, _ := profiles.QueryId(id)
+	if !result.Next(nil, &p) || p.Name != "bob" || p.Email != "" || p.Score != 4 || len(p.Tags) != 3 || p.Tags[0] != "b" || p.Tags[2] != "d" {
+		t.Errorf("patched object is %#v", p)
+	}
+
+	// a failing operation discards the whole patch.
+	for i, patch := range []string{
+		`[{"op": "replace", "path": "/Name", "value": "carol"}, {"op": "test", "path": "/Score", "value": 5}]`,
+		`[{"op": "replace", "path": "/Name", "value": "carol"}, {"op": "remove", "path": "/Missing"}]`,
+		`[{"op": "replace", "path": "/Name", "value": "carol"}, {"op": "add", "path": "/Tags/7", "value": "x"}]`,
+		`[{"op": "replace", "path": "/Name", "value": "carol"}, {"op": "move", "from": "/Tags", "path": "/Tags/0"}]`,
+		`[{"op": "replace", "path": "/Name", "value": "carol"}, {"op": "frobnicate", "path": "/Name"}]`,
+	} {
+		if err = profiles.Patch(id, []byte(patch)); err == nil {
+			t.Errorf("%d. invalid patch succeeded", i)
+		}
+	}
+	if result, _ = profiles.Query(&Equals{Field: "Name", Value: "bob"}); result.Count() != 1 {
+		t.Errorf("failed patches have been applied")
+	}
+
+	// the whole object can be replaced.
+	if err = profiles.Patch(id, []byte(`[{"op": "replace", "path": "", "value": {"Name": "dave", "Score": 1}}]`)); err != nil {
+		t.Fatalf("replacing the whole object failed: %v", err)
+	}
+	p = profile{}
+	if err = profiles.Get(id, &p); err != nil || p.Name != "dave" || p.Score != 1 || len(p.Tags) != 0 {
+		t.Errorf("replaced object is %#v (error: %v)", p, err)
+	}
+	if result, _ = profiles.Query(&Equals{Field: "Name", Value: "dave"}); result.Count() != 1 {
+		t.Errorf("index hasn't been updated after replacing the whole object")
+	}
+}
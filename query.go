@@ -2,6 +2,7 @@ package epos
 
 import (
 	"fmt"
+	"sort"
 	"strconv"
 )
 
@@ -10,6 +11,10 @@ import (
 func (c *Collection) Query(q Condition) (*Result, error) {
 	fields := getFields(q)
 
+	// the indexes are changed under the write lock.
+	c.db.mu.RLock()
+	defer c.db.mu.RUnlock()
+
 	for _, field := range fields {
 		_, ok := c.indexes[field]
 		if !ok {
@@ -29,16 +34,64 @@ func (c *Collection) QueryId(id Id) (*Result, error) {
 }
 
 // QueryAll returns a Result object that will deliver
-// all objects in the object store in no particular order.
+// all objects in the object store in ascending order of their IDs.
 func (c *Collection) QueryAll() (*Result, error) {
+	return c.QueryRange(0, 0, 0)
+}
+
+// QueryRange returns a Result object that will deliver the objects with IDs
+// from start up to, but not including, end in ascending order of their IDs.
+// If end is 0, there is no upper limit. If limit is greater than 0, at most
+// limit objects are delivered, so that results can be paginated by passing
+// the last ID of a page + 1 as start of the next page.
+func (c *Collection) QueryRange(start, end Id, limit int) (*Result, error) {
+	ids, err := c.idRange(start, end, limit)
+	if err != nil {
+		return nil, err
+	}
+	return newResult(c, ids), nil
+}
+
+// idRange returns the IDs of all objects from start up to, but not including,
+// end. IDs are stored as decimal strings, whose order only matches the order of
+// the IDs if they have the same number of digits, so all keys that can be IDs
+// are collected in a single pass, and the IDs are sorted afterwards.
+func (c *Collection) idRange(start, end Id, limit int) ([]Id, error) {
+	if start < 0 {
+		start = 0
+	}
 	ids := []Id{}
-	for id_str := range c.store.Keys() {
-		id, err := strconv.ParseInt(id_str, 10, 64)
-		if err == nil {
+	add := func(key string) {
+		id, err := strconv.ParseInt(key, 10, 64)
+		if err != nil || strconv.FormatInt(id, 10) != key {
+			return
+		}
+		if Id(id) >= start && (end <= 0 || Id(id) < end) {
 			ids = append(ids, Id(id))
 		}
 	}
-	return newResult(c, ids), nil
+
+	if needsScan(c.raw) {
+		for key := range c.raw.Keys() {
+			add(key)
+		}
+	} else {
+		// all decimal strings are between "0" and ":", which follows "9",
+		// so internal keys are skipped.
+		it := storeRange(c.raw, "0", ":")
+		for it.Next() {
+			add(it.Key())
+		}
+		if err := it.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Sort(byId(ids))
+	if limit > 0 && len(ids) > limit {
+		ids = ids[:limit]
+	}
+	return ids, nil
 }
 
 func getFields(q Condition) []string {
@@ -1,6 +1,7 @@
 package epos
 
 import (
+	"fmt"
 	"testing"
 )
 
@@ -89,3 +90,99 @@ func TestQueries(t *testing.T) {
 
 	db.Remove()
 }
+
+func TestQueryRange(t *testing.T) {
+	for _, typ := range availableStorageTypes(STORAGE_DISKV, STORAGE_LEVELDB, STORAGE_GOLEVELDB, STORAGE_MEMORY) {
+		db, err := OpenDatabase("testdb_range", typ)
+		if err != nil {
+			t.Fatalf("%s: couldn't open testdb_range: %v", typ, err)
+		}
+
+		persons := db.Coll("persons")
+		for i := 0; i < 120; i++ {
+			if _, err = persons.Insert(entry{Y: i + 1}); err != nil {
+				t.Fatalf("%s: %d. Insert failed: %v", typ, i, err)
+			}
+		}
+
+		testdata := []struct {
+			Start, End Id
+			Limit      int
+			Ids        []Id
+		}{
+			{8, 12, 0, []Id{8, 9, 10, 11}},
+			{99, 0, 3, []Id{99, 100, 101}},
+			{118, 200, 0, []Id{118, 119, 120}},
+			{50, 50, 0, []Id{}},
+		}
+
+		for i, tt := range testdata {
+			result, err := persons.QueryRange(tt.Start, tt.End, tt.Limit)
+			if err != nil {
+				t.Errorf("%s: %d. QueryRange failed: %v", typ, i, err)
+				continue
+			}
+			ids := []Id{}
+			var id Id
+			var e entry
+			for result.Next(&id, &e) {
+				if e.Y != int(id) {
+					t.Errorf("%s: %d. object %d has Y = %d", typ, i, id, e.Y)
+				}
+				ids = append(ids, id)
+			}
+			if fmt.Sprint(ids) != fmt.Sprint(tt.Ids) {
+				t.Errorf("%s: %d. QueryRange(%d, %d, %d) returned %v, expected %v", typ, i, tt.Start, tt.End, tt.Limit, ids, tt.Ids)
+			}
+		}
+
+		result, _ := persons.QueryAll()
+		var id, last Id
+		var e entry
+		for result.Next(&id, &e) {
+			if id != last+1 {
+				t.Errorf("%s: QueryAll returned %d after %d", typ, id, last)
+			}
+			last = id
+		}
+		if last != 120 {
+			t.Errorf("%s: QueryAll ended at %d, expected 120", typ, last)
+		}
+
+		db.Close()
+		db.Remove()
+	}
+}
+
+func TestConcurrentQueries(t *testing.T) {
+	db, err := OpenDatabase("testdb_queries", STORAGE_MEMORY)
+	if err != nil {
+		t.Fatalf("couldn't open testdb_queries: %v", err)
+	}
+	defer db.Remove()
+	defer db.Close()
+	books := db.Coll("books")
+	books.AddIndex("Author")
+
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 200; i++ {
+			books.Insert(&book{Title: fmt.Sprintf("Book %d", i), Author: fmt.Sprintf("Author %d", i%10)})
+		}
+		close(done)
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		result, err := books.Query(&Equals{Field: "Author", Value: "Author 3"})
+		if err != nil {
+			t.Fatalf("Query failed: %v", err)
+		}
+		var b book
+		for result.Next(nil, &b) {
+		}
+	}
+}
@@ -1,15 +1,22 @@
 package epos
 
 import (
-	"encoding/json"
 	"fmt"
 	"log"
+	"sync"
 )
 
 type Result struct {
-	ids   []Id
-	i     int
-	store StorageBackend
+	ids    []Id
+	i      int
+	store  StorageBackend
+	raw    StorageBackend
+	mu     *sync.RWMutex // the database's lock
+	keys   *keyring
+	codec  Codec
+	logger *log.Logger
+	err    error
+	rev    Rev
 }
 
 func (r *Result) Count() int {
@@ -18,6 +25,7 @@ func (r *Result) Count() int {
 
 func (r *Result) First(id *Id, result interface{}) bool {
 	r.i = 0
+	r.err = nil
 	return r.Next(id, result)
 }
 
@@ -30,14 +38,22 @@ func (r *Result) Next(id *Id, result interface{}) bool {
 		*id = r.ids[r.i]
 	}
 
-	jsondata, err := r.store.Read(fmt.Sprintf("%d", r.ids[r.i]))
+	// the revision and the object are read under the read lock, so that
+	// they belong together.
+	key := fmt.Sprintf("%d", r.ids[r.i])
+	r.mu.RLock()
+	r.rev = readRev(r.raw, key)
+	data, err := r.store.Read(key)
+	r.mu.RUnlock()
 	if err != nil {
-		log.Printf("result.Next: retrieving %d failed: %v", r.ids[r.i], err)
+		r.logger.Printf("result.Next: retrieving %d failed: %v", r.ids[r.i], err)
+		r.err = err
 		return false
 	}
 
-	if err := json.Unmarshal(jsondata, result); err != nil {
-		log.Printf("result.Next: json.Unmarshal of entry %d failed: %v", r.ids[r.i], err)
+	if err := r.codec.Unmarshal(data, result); err != nil {
+		r.logger.Printf("result.Next: decoding entry %d failed: %v", r.ids[r.i], err)
+		r.err = err
 		return false
 	}
 
@@ -45,6 +61,28 @@ func (r *Result) Next(id *Id, result interface{}) bool {
 	return true
 }
 
+// Revision returns the revision of the object that Next has returned last. It
+// can be passed to UpdateIfRevision and DeleteIfRevision.
+func (r *Result) Revision() Rev {
+	return r.rev
+}
+
+// Key returns the key of the object that Next has returned last, or its ID as
+// decimal string if it doesn't have a key.
+func (r *Result) Key() string {
+	if r.i == 0 {
+		return ""
+	}
+	return readKey(r.raw, r.keys, r.ids[r.i-1])
+}
+
+// Err returns the error that made Next return false, or nil if all objects
+// have been delivered. Objects that have been damaged on disk result in a
+// CorruptError.
+func (r *Result) Err() error {
+	return r.err
+}
+
 func newResult(c *Collection, ids []Id) *Result {
-	return &Result{store: c.store, ids: ids, i: 0}
+	return &Result{store: c.store, raw: c.raw, mu: &c.db.mu, keys: c.db.opts.keys, codec: c.codec, ids: ids, i: 0, logger: c.db.opts.Logger}
 }
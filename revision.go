@@ -0,0 +1,96 @@
+package epos
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Rev is the revision of an object. It starts at 1 when the object is
+// inserted, and is increased every time the object is changed. Objects that
+// have been stored by earlier versions have revision 0 until they are changed.
+type Rev int64
+
+// revKey returns the key under which the revision of the object with the
+// specified key is stored.
+func revKey(key string) string {
+	return "_rev_" + key
+}
+
+// readRev returns the revision of the object with the specified key, as stored
+// in store. Revisions are read from the collection's raw storage backend, so
+// that they don't take up space in the cache.
+func readRev(store StorageBackend, key string) Rev {
+	data, err := store.Read(revKey(key))
+	if err != nil {
+		return 0
+	}
+	rev, _ := binary.Varint(data)
+	return Rev(rev)
+}
+
+// revisionOp returns the operation that sets the revision of the object with
+// the specified key to rev. It is logged together with the object, so that
+// replaying the write-ahead log sets the same revision however often it is
+// replayed, and it is applied before the object, so that the revision has
+// always been increased when the object has changed.
+func (c *Collection) revisionOp(key string, rev Rev) walOp {
+	buf := make([]byte, binary.MaxVarintLen64)
+	return walOp{typ: walUpdate, coll: c.name, key: revKey(key), data: buf[:binary.PutVarint(buf, int64(rev))]}
+}
+
+// unrevisionOps returns the storage operations that erase the revision of the
+// object with the specified key when the object is deleted.
+func (c *Collection) unrevisionOps(key string) []BatchOp {
+	if data, err := c.raw.Read(revKey(key)); err != nil || len(data) == 0 {
+		return nil
+	}
+	return []BatchOp{{Key: revKey(key), Erase: true}}
+}
+
+// Revision returns the current revision of an object, or ErrNotFound if the
+// object doesn't exist.
+func (c *Collection) Revision(id Id) (Rev, error) {
+	rev := readRev(c.raw, fmt.Sprintf("%d", id))
+	if !c.Exists(id) {
+		return 0, ErrNotFound
+	}
+	return rev, nil
+}
+
+// checkRevision returns ErrConflict if the object doesn't exist or doesn't
+// have revision rev.
+func (c *Collection) checkRevision(id Id, rev Rev) error {
+	if current, err := c.Revision(id); err != nil || current != rev {
+		return ErrConflict
+	}
+	return nil
+}
+
+// UpdateIfRevision replaces an object with a new object, but only if the
+// object still has revision rev, e.g. the revision that Result.Revision
+// returned when the object was read. Otherwise, it returns ErrConflict. It
+// returns the new revision of the object.
+func (c *Collection) UpdateIfRevision(id Id, rev Rev, value interface{}) (Rev, error) {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+
+	if err := c.checkRevision(id, rev); err != nil {
+		return 0, err
+	}
+	if err := c.update(id, value); err != nil {
+		return 0, err
+	}
+	return c.Revision(id)
+}
+
+// DeleteIfRevision deletes an object, but only if it still has revision rev.
+// Otherwise, it returns ErrConflict.
+func (c *Collection) DeleteIfRevision(id Id, rev Rev) error {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+
+	if err := c.checkRevision(id, rev); err != nil {
+		return err
+	}
+	return c.delete(id)
+}
@@ -0,0 +1,80 @@
+package epos
+
+import (
+	"testing"
+)
+
+func TestRevisions(t *testing.T) {
+	db, err := OpenDatabase("testdb_revision", STORAGE_AUTO)
+	if err != nil {
+		t.Fatalf("couldn't open testdb_revision: %v", err)
+	}
+	defer db.Remove()
+	defer db.Close()
+	books := db.Coll("books")
+
+	id, _ := books.Insert(&book{Title: "First"})
+	if rev, err := books.Revision(id); err != nil || rev != 1 {
+		t.Errorf("revision of inserted object is %d (error: %v)", rev, err)
+	}
+	var b book
+	result, _ := books.QueryId(id)
+	if !result.Next(nil, &b) || result.Revision() != 1 {
+		t.Errorf("Result.Revision returned %d", result.Revision())
+	}
+
+	rev, err := books.UpdateIfRevision(id, 1, &book{Title: "Second"})
+	if err != nil || rev != 2 {
+		t.Errorf("UpdateIfRevision returned %d (error: %v)", rev, err)
+	}
+	if _, err = books.UpdateIfRevision(id, 1, &book{Title: "Lost update"}); err != ErrConflict {
+		t.Errorf("UpdateIfRevision with old revision returned %v", err)
+	}
+	if err = books.DeleteIfRevision(id, 1); err != ErrConflict {
+		t.Errorf("DeleteIfRevision with old revision returned %v", err)
+	}
+
+	// all kinds of changes increase the revision.
+	books.Update(id, &book{Title: "Third"})
+	books.UpdateMany([]Id{id}, []interface{}{&book{Title: "Fourth"}})
+	books.Patch(id, []byte(`{"Title":"Fifth"}`))
+	if rev, _ = books.Revision(id); rev != 5 {
+		t.Errorf("revision after 4 changes is %d", rev)
+	}
+	result, _ = books.QueryId(id)
+	if !result.Next(nil, &b) || b.Title != "Fifth" || result.Revision() != 5 {
+		t.Errorf("object %#v has revision %d", b, result.Revision())
+	}
+
+	b = book{}
+	if rev, err = books.GetWithRevision(id, &b); err != nil || b.Title != "Fifth" || rev != 5 {
+		t.Errorf("GetWithRevision returned %#v with revision %d (error: %v)", b, rev, err)
+	}
+
+	if err = books.DeleteIfRevision(id, 5); err != nil {
+		t.Errorf("DeleteIfRevision failed: %v", err)
+	}
+	if _, err = books.Revision(id); err == nil {
+		t.Errorf("deleted object still has a revision")
+	}
+	if _, err = books.GetWithRevision(id, &b); err != ErrNotFound {
+		t.Errorf("GetWithRevision of deleted object returned %v", err)
+	}
+	if _, err = books.UpdateIfRevision(id, 5, &book{}); err != ErrConflict {
+		t.Errorf("UpdateIfRevision of deleted object returned %v", err)
+	}
+	if _, err = books.raw.Read(revKey("1")); err == nil {
+		t.Errorf("revision of deleted object hasn't been removed")
+	}
+
+	ids, _ := books.InsertMany([]interface{}{&book{Title: "A"}, &book{Title: "B"}})
+	for _, id := range ids {
+		if rev, _ = books.Revision(id); rev != 1 {
+			t.Errorf("object %d inserted with InsertMany has revision %d", id, rev)
+		}
+	}
+	books.DeleteMany(ids)
+	if _, err = books.raw.Read(revKey("2")); err == nil {
+		t.Errorf("revision of object deleted with DeleteMany hasn't been removed")
+	}
+}
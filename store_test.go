@@ -1,7 +1,9 @@
 package epos
 
 import (
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"testing"
 )
 
@@ -33,6 +35,24 @@ func TestStore(t *testing.T) {
 	}
 }
 
+// availableStorageTypes returns those of types that are available in this
+// build. STORAGE_LEVELDB is only available with cgo.
+func availableStorageTypes(types ...StorageType) []StorageType {
+	available := []StorageType{}
+	for _, typ := range types {
+		if storageBackends[typ] != nil {
+			available = append(available, typ)
+		}
+	}
+	return available
+}
+
+func skipUnavailable(tb testing.TB, typ StorageType) {
+	if storageBackends[typ] == nil {
+		tb.Skipf("storage type %s isn't available in this build", typ)
+	}
+}
+
 var benchmarkData = struct {
 	Name         string
 	Age          uint
@@ -58,9 +78,10 @@ func BenchmarkInsertGoLevelDB(b *testing.B) {
 }
 
 func benchmarkInsert(b *testing.B, typ StorageType) {
+	skipUnavailable(b, typ)
 	b.StopTimer()
 
-	db, _ := OpenDatabase(fmt.Sprintf("testdb_bench_insert_%d", typ), typ)
+	db, _ := OpenDatabase(fmt.Sprintf("testdb_bench_insert_%s", typ), typ)
 
 	b.StartTimer()
 
@@ -89,9 +110,10 @@ func BenchmarkUpdateGoLevelDB(b *testing.B) {
 }
 
 func benchmarkUpdate(b *testing.B, typ StorageType) {
+	skipUnavailable(b, typ)
 	b.StopTimer()
 
-	db, _ := OpenDatabase(fmt.Sprintf("testdb_bench_update_%d", typ), typ)
+	db, _ := OpenDatabase(fmt.Sprintf("testdb_bench_update_%s", typ), typ)
 
 	id, err := db.Coll("bench").Insert(benchmarkData)
 	if err != nil {
@@ -125,6 +147,7 @@ func BenchmarkDeleteGoLevelDB(b *testing.B) {
 }
 
 func benchmarkDelete(b *testing.B, typ StorageType) {
+	skipUnavailable(b, typ)
 	b.StopTimer()
 
 	db, _ := OpenDatabase(fmt.Sprintf("testdb_bench_delete_%s", typ), typ)
@@ -147,3 +170,97 @@ func benchmarkDelete(b *testing.B, typ StorageType) {
 	db.Close()
 	db.Remove()
 }
+
+func TestCollE(t *testing.T) {
+	RegisterStorageBackend("failing", func(path string, opts *Options) (StorageBackend, error) {
+		return nil, errors.New("no storage available")
+	})
+
+	db, err := OpenDatabase("testdb_colle", StorageType("failing"))
+	if err != nil {
+		t.Fatalf("couldn't open testdb_colle: %v", err)
+	}
+	if _, err = db.CollE("foo"); err == nil {
+		t.Errorf("CollE succeeded even though the storage backend failed")
+	}
+	db.Close()
+	db.Remove()
+
+	db, err = OpenDatabase("testdb_colle", STORAGE_AUTO)
+	if err != nil {
+		t.Fatalf("couldn't open testdb_colle: %v", err)
+	}
+	db.Coll("foo").AddIndex("X")
+	db.Close()
+
+	// truncate the index file in the middle of the first entry.
+	if err = ioutil.WriteFile("testdb_colle/indexes/foo/X", []byte{0, 0, 0}, 0644); err != nil {
+		t.Fatalf("couldn't overwrite index file: %v", err)
+	}
+
+	db, err = OpenDatabase("testdb_colle", STORAGE_AUTO)
+	if err != nil {
+		t.Fatalf("couldn't open testdb_colle: %v", err)
+	}
+	if _, err = db.CollE("foo"); err == nil {
+		t.Errorf("CollE succeeded even though the index is broken")
+	}
+	db.Close()
+	db.Remove()
+}
+
+type closeFailingBackend struct {
+	StorageBackend
+}
+
+func (s closeFailingBackend) Close() error {
+	s.StorageBackend.Close()
+	return errors.New("close failed")
+}
+
+func TestClose(t *testing.T) {
+	db, err := OpenDatabase("testdb_close", STORAGE_GOLEVELDB)
+	if err != nil {
+		t.Fatalf("couldn't open testdb_close: %v", err)
+	}
+
+	persons := db.Coll("persons")
+	persons.AddIndex("X")
+	persons.Insert(entry{X: "John Doe", Y: 23})
+	if err = persons.Close(); err != nil {
+		t.Errorf("Collection.Close failed: %v", err)
+	}
+
+	// goleveldb locks its directory, so the collection can only be opened
+	// again if it has been closed properly.
+	persons, err = db.CollE("persons")
+	if err != nil {
+		t.Fatalf("couldn't open collection again: %v", err)
+	}
+	if result, err := persons.Query(&Equals{Field: "X", Value: "John Doe"}); err != nil || result.Count() != 1 {
+		t.Errorf("reopened collection doesn't contain indexed object (error: %v)", err)
+	}
+
+	if err = db.Close(); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+	db.Remove()
+
+	RegisterStorageBackend("closefailing", func(path string, opts *Options) (StorageBackend, error) {
+		store, err := NewMemoryStorageBackend(path, opts)
+		return closeFailingBackend{store}, err
+	})
+
+	db, err = OpenDatabase("testdb_close", StorageType("closefailing"))
+	if err != nil {
+		t.Fatalf("couldn't open testdb_close: %v", err)
+	}
+	db.Coll("foo")
+	db.Coll("bar")
+
+	err = db.Close()
+	if errs, ok := err.(MultiError); !ok || len(errs) != 2 {
+		t.Errorf("Close returned %v, expected 2 errors", err)
+	}
+	db.Remove()
+}
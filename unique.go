@@ -0,0 +1,128 @@
+package epos
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// AddUniqueIndex creates an index for a field like AddIndex, but the index
+// doesn't allow two objects to have the same value of the field. If an index
+// for the field already exists, it is made unique. AddUniqueIndex fails with
+// an error that wraps ErrDuplicate if objects already share a value.
+//
+// Every change that would give an object a value that another object already
+// has fails with an error that wraps ErrDuplicate. Batches like InsertMany,
+// UpdateWhere and Upsert are checked as a whole, in the same critical section
+// in which they are written, so they either succeed completely or not at all.
+func (c *Collection) AddUniqueIndex(field string) error {
+	if err := c.db.checkWritable(); err != nil {
+		return err
+	}
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+
+	if c.isUnique(field) {
+		return nil
+	}
+	_, existed := c.indexes[field]
+	if err := c.addIndex(field); err != nil {
+		return err
+	}
+	for value, entries := range c.indexes[field].data {
+		for _, e := range entries[1:] {
+			if e.id != entries[0].id {
+				if !existed {
+					c.removeIndex(field)
+				}
+				return fmt.Errorf("objects %d and %d: field %s: value %s: %w", entries[0].id, e.id, field, value, ErrDuplicate)
+			}
+		}
+	}
+
+	c.meta.UniqueIndexes = append(c.meta.UniqueIndexes, field)
+	return c.db.writeCollMeta(c.name, c.meta)
+}
+
+func (c *Collection) isUnique(field string) bool {
+	for _, f := range c.meta.UniqueIndexes {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// forgetUnique removes field from the unique indexes of the collection.
+func (c *Collection) forgetUnique(field string) error {
+	fields := []string{}
+	for _, f := range c.meta.UniqueIndexes {
+		if f != field {
+			fields = append(fields, f)
+		}
+	}
+	if len(fields) == len(c.meta.UniqueIndexes) {
+		return nil
+	}
+	c.meta.UniqueIndexes = fields
+	return c.db.writeCollMeta(c.name, c.meta)
+}
+
+// checkUnique returns an error that wraps ErrDuplicate if applying ops would
+// give two objects the same value of a field with a unique index. db.mu must
+// be held for writing until ops have been applied, so that nothing changes in
+// between.
+func (c *Collection) checkUnique(ops []walOp) error {
+	if len(c.meta.UniqueIndexes) == 0 {
+		return nil
+	}
+
+	// the objects as they are after ops, in the order they are changed.
+	// Deleted objects and objects that can't be decoded into a map have
+	// no index entries.
+	ids := []int64{}
+	objects := make(map[int64]map[string]interface{})
+	for _, op := range ops {
+		if isInternalKey(op.key) {
+			continue
+		}
+		id, err := strconv.ParseInt(op.key, 10, 64)
+		if err != nil {
+			continue
+		}
+		if _, seen := objects[id]; !seen {
+			ids = append(ids, id)
+		}
+		var object map[string]interface{}
+		if op.typ != walDelete {
+			c.codec.Unmarshal(op.data, &object)
+		}
+		objects[id] = object
+	}
+
+	for _, field := range c.meta.UniqueIndexes {
+		idx := c.indexes[field]
+		if idx == nil {
+			continue
+		}
+		owners := make(map[string]int64)
+		for _, id := range ids {
+			v, exists := objects[id][field]
+			if !exists {
+				continue
+			}
+			value := fmt.Sprintf("%v", v)
+			if other, taken := owners[value]; taken {
+				return fmt.Errorf("objects %d and %d: field %s: value %s: %w", other, id, field, value, ErrDuplicate)
+			}
+			owners[value] = id
+			for _, e := range idx.data[value] {
+				// objects that are changed by ops give up their
+				// current values.
+				if _, changed := objects[e.id]; !changed {
+					return fmt.Errorf("objects %d and %d: field %s: value %s: %w", e.id, id, field, value, ErrDuplicate)
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package epos
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestUniqueIndex(t *testing.T) {
+	db, err := OpenDatabase("testdb_unique", STORAGE_AUTO)
+	if err != nil {
+		t.Fatalf("couldn't open testdb_unique: %v", err)
+	}
+	defer db.Remove()
+	accounts := db.Coll("accounts")
+	accounts.Insert(&account{Login: "alice", Group: "staff"})
+	accounts.Insert(&account{Login: "bob", Group: "staff"})
+
+	if err = accounts.AddUniqueIndex("Group"); !errors.Is(err, ErrDuplicate) {
+		t.Errorf("AddUniqueIndex on duplicate values returned %v", err)
+	}
+	if _, exists := accounts.indexes["Group"]; exists {
+		t.Errorf("failed AddUniqueIndex left an index behind")
+	}
+	if err = accounts.AddUniqueIndex("Login"); err != nil {
+		t.Fatalf("AddUniqueIndex failed: %v", err)
+	}
+
+	if _, err = accounts.Insert(&account{Login: "alice"}); !errors.Is(err, ErrDuplicate) {
+		t.Errorf("Insert of duplicate returned %v", err)
+	}
+	if err = accounts.Update(2, &account{Login: "alice"}); !errors.Is(err, ErrDuplicate) {
+		t.Errorf("Update to duplicate returned %v", err)
+	}
+	if err = accounts.Patch(2, []byte(`{"Login":"alice"}`)); !errors.Is(err, ErrDuplicate) {
+		t.Errorf("Patch to duplicate returned %v", err)
+	}
+	if _, err = accounts.InsertMany([]interface{}{&account{Login: "carol"}, &account{Login: "carol"}}); !errors.Is(err, ErrDuplicate) {
+		t.Errorf("InsertMany of duplicates returned %v", err)
+	}
+	// both objects match, so they would get the same login.
+	accounts.AddIndex("Group")
+	if _, err = accounts.Upsert(&Equals{Field: "Group", Value: "staff"}, &account{Login: "dave", Group: "staff"}); !errors.Is(err, ErrDuplicate) {
+		t.Errorf("Upsert of duplicates returned %v", err)
+	}
+	if result, _ := accounts.QueryAll(); result.Count() != 2 {
+		t.Errorf("collection contains %d objects after failed changes, expected 2", result.Count())
+	}
+	var a account
+	if accounts.Get(2, &a); a.Login != "bob" {
+		t.Errorf("object 2 has been changed to %#v", a)
+	}
+
+	// objects that are changed together may swap their values.
+	if err = accounts.UpdateMany([]Id{1, 2}, []interface{}{&account{Login: "bob"}, &account{Login: "alice"}}); err != nil {
+		t.Errorf("UpdateMany swapping values failed: %v", err)
+	}
+	if id, err := accounts.Insert(&account{Login: "carol"}); err != nil || id != 3 {
+		t.Errorf("Insert returned ID %d (error: %v)", id, err)
+	}
+
+	// the index stays unique when it is rebuilt and the database is reopened.
+	accounts.Reindex("Login")
+	db.Close()
+	if db, err = OpenDatabase("testdb_unique", STORAGE_AUTO); err != nil {
+		t.Fatalf("couldn't reopen testdb_unique: %v", err)
+	}
+	defer db.Close()
+	accounts = db.Coll("accounts")
+	if _, err = accounts.Insert(&account{Login: "carol"}); !errors.Is(err, ErrDuplicate) {
+		t.Errorf("Insert of duplicate after reopening returned %v", err)
+	}
+
+	accounts.RemoveIndex("Login")
+	if _, err = accounts.Insert(&account{Login: "carol"}); err != nil {
+		t.Errorf("Insert of duplicate without unique index failed: %v", err)
+	}
+}
@@ -0,0 +1,277 @@
+package epos
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+const (
+	walInsert byte = iota + 1
+	walUpdate
+	walDelete
+)
+
+// walOp describes a single change to a collection: the key in the storage
+// backend and, for inserts and updates, the new document data.
+type walOp struct {
+	typ  byte
+	coll string
+	key  string
+	data []byte
+}
+
+// wal is the write-ahead log of a database. Before a change is applied to
+// the storage backend and the index files, it is appended to the log as one
+// checksummed record. The log is only cleared once all changes have been
+// committed to stable storage, which depends on the database's durability.
+// If the process crashes in between, the logged changes are replayed when
+// the database is opened the next time. As all operations are replayed as
+// idempotent "redo" operations, the storage backend and the indexes are
+// consistent again afterwards.
+type wal struct {
+	file file
+	sync bool
+	err  error
+	keys *keyring // encrypts the records if not nil
+	size int64
+}
+
+// walCheckpointSize is the size of the log at which all changes are
+// committed, so that the log can be cleared, regardless of the durability.
+const walCheckpointSize = 16 << 20
+
+var errWALShortRecord = errors.New("short WAL record")
+
+func openWAL(fs fileSystem, path string, opts *Options) (*wal, error) {
+	flags := os.O_RDWR | os.O_CREATE
+	if opts.ReadOnly {
+		flags = os.O_RDONLY
+	}
+	file, err := fs.OpenFile(path, flags, opts.FileMode)
+	if err != nil {
+		if opts.ReadOnly && os.IsNotExist(err) {
+			return &wal{err: ErrReadOnly}, nil
+		}
+		return nil, err
+	}
+	w := &wal{file: file, sync: opts.Durability == DURABILITY_SYNC, keys: opts.keys}
+	if opts.ReadOnly {
+		w.err = ErrReadOnly
+	}
+	return w, nil
+}
+
+// Log appends a record containing all ops to the log and, if requested,
+// syncs it to disk. A record is either replayed completely or not at all.
+func (w *wal) Log(ops []walOp) error {
+	if w.err != nil {
+		return w.err
+	}
+
+	payload := bytes.NewBuffer([]byte{})
+
+	binary.Write(payload, binary.BigEndian, uint32(len(ops)))
+	for _, op := range ops {
+		payload.WriteByte(op.typ)
+		binary.Write(payload, binary.BigEndian, uint16(len(op.coll)))
+		payload.WriteString(op.coll)
+		binary.Write(payload, binary.BigEndian, uint16(len(op.key)))
+		payload.WriteString(op.key)
+		binary.Write(payload, binary.BigEndian, uint32(len(op.data)))
+		payload.Write(op.data)
+	}
+
+	// the payload of an unencrypted record starts with the number of ops,
+	// which never gets large enough to be mistaken for encryptionMagic.
+	if w.keys != nil {
+		sealed := append([]byte(encryptionMagic), w.keys.seal(payload.Bytes(), nil)...)
+		payload = bytes.NewBuffer(sealed)
+	}
+
+	record := bytes.NewBuffer([]byte{})
+	binary.Write(record, binary.BigEndian, uint32(payload.Len()))
+	binary.Write(record, binary.BigEndian, crc32.ChecksumIEEE(payload.Bytes()))
+	record.Write(payload.Bytes())
+
+	offset, err := w.file.Seek(0, os.SEEK_END)
+	if err != nil {
+		return err
+	}
+	if _, err = w.file.Write(record.Bytes()); err != nil {
+		return err
+	}
+	w.size = offset + int64(record.Len())
+	if !w.sync {
+		return nil
+	}
+	return w.file.Sync()
+}
+
+// Sync commits the log to stable storage. It must be called before the
+// logged changes are committed, so that changes that have only partially
+// reached stable storage can be replayed.
+func (w *wal) Sync() error {
+	if w.err != nil || w.sync {
+		return nil
+	}
+	return w.file.Sync()
+}
+
+// Clear empties the log after all logged changes have been committed to
+// stable storage. A log that needs recovery is never cleared.
+func (w *wal) Clear() error {
+	if w.err == ErrReadOnly {
+		return nil
+	}
+	if w.err != nil {
+		return w.err
+	}
+	if err := w.file.Truncate(0); err != nil {
+		return err
+	}
+	w.size = 0
+	_, err := w.file.Seek(0, os.SEEK_SET)
+	return err
+}
+
+// Records returns all complete records found in the log. A truncated or
+// corrupt record at the end of the log stems from a crash while logging;
+// the corresponding change has never been applied, so it is ignored.
+func (w *wal) Records() ([][]walOp, error) {
+	if _, err := w.file.Seek(0, os.SEEK_SET); err != nil {
+		return nil, err
+	}
+
+	records := [][]walOp{}
+	for {
+		var length, checksum uint32
+		if err := binary.Read(w.file, binary.BigEndian, &length); err != nil {
+			break
+		}
+		if err := binary.Read(w.file, binary.BigEndian, &checksum); err != nil {
+			break
+		}
+		payload := make([]byte, int(length))
+		if _, err := io.ReadFull(w.file, payload); err != nil {
+			break
+		}
+		if crc32.ChecksumIEEE(payload) != checksum {
+			break
+		}
+		if isEncrypted(payload) {
+			if w.keys == nil {
+				return nil, ErrWrongKey
+			}
+			var err error
+			if payload, err = w.keys.open(payload[len(encryptionMagic):], nil); err != nil {
+				return nil, err
+			}
+		}
+		ops, err := decodeWALRecord(payload)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, ops)
+	}
+
+	return records, nil
+}
+
+func decodeWALRecord(payload []byte) ([]walOp, error) {
+	r := bytes.NewReader(payload)
+
+	var count uint32
+	if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+		return nil, errWALShortRecord
+	}
+
+	ops := make([]walOp, 0, int(count))
+	for i := 0; i < int(count); i++ {
+		var op walOp
+		var err error
+		if op.typ, err = r.ReadByte(); err != nil {
+			return nil, errWALShortRecord
+		}
+		var coll_len, key_len uint16
+		var data_len uint32
+		if err = binary.Read(r, binary.BigEndian, &coll_len); err != nil {
+			return nil, errWALShortRecord
+		}
+		coll := make([]byte, int(coll_len))
+		if _, err = io.ReadFull(r, coll); err != nil {
+			return nil, errWALShortRecord
+		}
+		if err = binary.Read(r, binary.BigEndian, &key_len); err != nil {
+			return nil, errWALShortRecord
+		}
+		key := make([]byte, int(key_len))
+		if _, err = io.ReadFull(r, key); err != nil {
+			return nil, errWALShortRecord
+		}
+		if err = binary.Read(r, binary.BigEndian, &data_len); err != nil {
+			return nil, errWALShortRecord
+		}
+		op.data = make([]byte, int(data_len))
+		if _, err = io.ReadFull(r, op.data); err != nil {
+			return nil, errWALShortRecord
+		}
+		op.coll = string(coll)
+		op.key = string(key)
+		ops = append(ops, op)
+	}
+
+	return ops, nil
+}
+
+func (w *wal) Close() error {
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+// recover replays all changes that are still recorded in the write-ahead
+// log, and clears the log once they have been committed.
+func (db *Database) recover() error {
+	if db.wal.file == nil {
+		return nil
+	}
+
+	records, err := db.wal.Records()
+	if err != nil {
+		return err
+	}
+
+	if db.opts.ReadOnly {
+		if len(records) > 0 {
+			return fmt.Errorf("database needs recovery, but is opened read-only")
+		}
+		return nil
+	}
+
+	for _, ops := range records {
+		for _, op := range ops {
+			coll, err := db.CollE(op.coll)
+			if err != nil {
+				return err
+			}
+			if err = coll.redo(op); err != nil {
+				return err
+			}
+		}
+	}
+
+	// the recovered changes must be on disk before they're removed from the
+	// log, regardless of the configured durability.
+	for _, coll := range db.openColls() {
+		coll.dirty = true
+	}
+	return db.sync()
+}
@@ -0,0 +1,146 @@
+package epos
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+)
+
+func TestWALRecovery(t *testing.T) {
+	db, err := OpenDatabase("testdb_wal", STORAGE_AUTO)
+	if err != nil {
+		t.Fatalf("couldn't open testdb_wal: %v", err)
+	}
+
+	coll := db.Coll("persons")
+	coll.AddIndex("X")
+
+	id, err := coll.Insert(entry{X: "John Doe", Y: 23})
+	if err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+
+	// simulate a crash: the changes are logged, but never applied.
+	updated, _ := json.Marshal(entry{X: "Max Mustermann", Y: 42})
+	inserted, _ := json.Marshal(entry{X: "Jan Maier", Y: 17})
+	if err = db.wal.Log([]walOp{{typ: walUpdate, coll: "persons", key: "1", data: updated}, {typ: walInsert, coll: "persons", key: "2", data: inserted}}); err != nil {
+		t.Fatalf("logging failed: %v", err)
+	}
+	// a torn record at the end of the log must be ignored.
+	db.wal.file.Write([]byte{0, 0, 1, 0, 42})
+	crash(db)
+
+	db, err = OpenDatabase("testdb_wal", STORAGE_AUTO)
+	if err != nil {
+		t.Fatalf("couldn't reopen testdb_wal: %v", err)
+	}
+	defer db.Close()
+	coll = db.Coll("persons")
+
+	if fi, err := os.Stat("testdb_wal/wal"); err != nil || fi.Size() != 0 {
+		t.Errorf("write-ahead log hasn't been cleared after recovery")
+	}
+
+	result, _ := coll.Query(&Equals{Field: "X", Value: "Max Mustermann"})
+	var e entry
+	var found_id Id
+	if !result.Next(&found_id, &e) || found_id != id || e.Y != 42 {
+		t.Errorf("update hasn't been recovered: id = %d, entry = %#v", found_id, e)
+	}
+
+	result, _ = coll.Query(&Equals{Field: "X", Value: "John Doe"})
+	if result.Count() != 0 {
+		t.Errorf("old index entry still exists after recovery")
+	}
+
+	result, _ = coll.Query(&Equals{Field: "X", Value: "Jan Maier"})
+	if result.Count() != 1 {
+		t.Errorf("insert hasn't been recovered")
+	}
+
+	if id, err = coll.Insert(entry{X: "Franz Huber"}); err != nil || id != 3 {
+		t.Errorf("expected next ID to be 3, got %d (error: %v)", id, err)
+	}
+
+	db.Remove()
+}
+
+func TestWALCheckpoint(t *testing.T) {
+	db, err := OpenDatabaseWithOptions("testdb_wal", &Options{Durability: DURABILITY_NONE})
+	if err != nil {
+		t.Fatalf("couldn't open testdb_wal: %v", err)
+	}
+	coll := db.Coll("persons")
+	coll.AddIndex("X")
+
+	// changes that haven't been committed yet stay in the log.
+	for i := 0; i < 3; i++ {
+		if _, err = coll.Insert(entry{X: "John Doe", Y: i}); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+	}
+	if records, _ := db.wal.Records(); len(records) != 3 {
+		t.Errorf("expected 3 records in write-ahead log, got %d", len(records))
+	}
+	crash(db)
+
+	db, err = OpenDatabaseWithOptions("testdb_wal", &Options{Durability: DURABILITY_NONE})
+	if err != nil {
+		t.Fatalf("couldn't reopen testdb_wal: %v", err)
+	}
+	defer db.Remove()
+	defer db.Close()
+	coll = db.Coll("persons")
+	if result, _ := coll.Query(&Equals{Field: "X", Value: "John Doe"}); result.Count() != 3 {
+		t.Errorf("expected 3 objects after recovery, got %d", result.Count())
+	}
+	if records, _ := db.wal.Records(); len(records) != 0 {
+		t.Errorf("write-ahead log hasn't been cleared after recovery")
+	}
+
+	coll.Insert(entry{X: "Jan Maier"})
+	if err = db.sync(); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+	if fi, err := os.Stat("testdb_wal/wal"); err != nil || fi.Size() != 0 {
+		t.Errorf("write-ahead log hasn't been cleared after sync")
+	}
+}
+
+func TestWALRevisions(t *testing.T) {
+	db, err := OpenDatabaseWithOptions("testdb_wal", &Options{Durability: DURABILITY_NONE})
+	if err != nil {
+		t.Fatalf("couldn't open testdb_wal: %v", err)
+	}
+	coll := db.Coll("persons")
+
+	// updates that don't change the object still increase its revision,
+	// and replaying them must neither skip nor repeat that.
+	id, _ := coll.Insert(entry{X: "John Doe", Y: 23})
+	coll.Update(id, entry{X: "John Doe", Y: 23})
+	coll.Update(id, entry{X: "John Doe", Y: 23})
+
+	// simulate a crash before the last update has been applied.
+	coll.raw.Write(revKey("1"), []byte{4}) // revision 2, varint-encoded
+	crash(db)
+
+	db, err = OpenDatabaseWithOptions("testdb_wal", &Options{Durability: DURABILITY_NONE})
+	if err != nil {
+		t.Fatalf("couldn't reopen testdb_wal: %v", err)
+	}
+	defer db.Remove()
+	defer db.Close()
+	coll = db.Coll("persons")
+	if rev, err := coll.Revision(id); err != nil || rev != 3 {
+		t.Errorf("expected revision 3 after recovery, got %d (error: %v)", rev, err)
+	}
+}
+
+// crash closes db without committing anything, like a crash of the process.
+func crash(db *Database) {
+	for _, coll := range db.colls {
+		coll.close()
+	}
+	db.wal.Close()
+	db.closeFS()
+}